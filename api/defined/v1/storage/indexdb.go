@@ -11,6 +11,7 @@ import (
 
 var ErrKeyNotFound = errors.New("key not found")
 
+// IterateFunc is called for each record, returns false to stop the iteration.
 type IterateFunc func(key []byte, val *object.Metadata) bool
 
 // IndexDB represents the interface for metadata storage operations
@@ -15,6 +15,21 @@ const (
 	FlagChunkedCache CacheFlag = 0x1 << 2 // chunked index
 )
 
+// Names returns the names of the set flags, empty for the normal cache.
+func (f CacheFlag) Names() []string {
+	names := make([]string, 0, 3)
+	if f&FlagVaryIndex > 0 {
+		names = append(names, "vary-index")
+	}
+	if f&FlagVaryCache > 0 {
+		names = append(names, "vary-cache")
+	}
+	if f&FlagChunkedCache > 0 {
+		names = append(names, "chunked")
+	}
+	return names
+}
+
 type Metadata struct {
 	Flags CacheFlag `json:"flags"`
 
@@ -25,11 +40,14 @@ type Metadata struct {
 	Code        int           `json:"code"`           // http response code
 	Size        uint64        `json:"size"`           // object size
 	RespUnix    int64         `json:"resp_unix"`      // response time
+	CreatedUnix int64         `json:"created_unix"`   // stored time of the object, not updated by the refreshes
+	InitialAge  int64         `json:"initial_age"`    // corrected initial age of the response, seconds
 	LastRefUnix int64         `json:"last_ref_unix"`  // last reference time
 	Refs        int64         `json:"refs"`           // reference count
 	ExpiresAt   int64         `json:"expires_at"`     // expiration time
 	Headers     http.Header   `json:"headers"`        // http headers
 	VirtualKey  []string      `json:"vkey,omitempty"` // vary keys
+	Tags        []string      `json:"tags,omitempty"` // surrogate keys, e.g. Surrogate-Key / Cache-Tag
 }
 
 // IsVary returns true if the metadata is a vary metadata.
@@ -72,6 +90,21 @@ func (m *Metadata) HasComplete() bool {
 	return n == uint64(m.Chunks.Count())
 }
 
+// StoredBytes returns the bytes of the stored chunks, the last chunk may be partial.
+func (m *Metadata) StoredBytes() uint64 {
+	if m.BlockSize == 0 || m.Size == 0 {
+		return 0
+	}
+
+	n := uint64(m.Chunks.Count())
+	bytes := n * m.BlockSize
+	last := (m.Size - 1) / m.BlockSize
+	if n > 0 && m.Chunks.Contains(uint32(last)) {
+		bytes -= m.BlockSize - (m.Size - last*m.BlockSize)
+	}
+	return bytes
+}
+
 // Clone clones the metadata.
 func (m *Metadata) Clone() *Metadata {
 	return &Metadata{
@@ -82,11 +115,14 @@ func (m *Metadata) Clone() *Metadata {
 		Code:        m.Code,
 		Size:        m.Size,
 		RespUnix:    m.RespUnix,
+		CreatedUnix: m.CreatedUnix,
+		InitialAge:  m.InitialAge,
 		LastRefUnix: m.LastRefUnix,
 		Refs:        m.Refs,
 		ExpiresAt:   m.ExpiresAt,
 		Headers:     m.Headers.Clone(),
 		Flags:       m.Flags,
 		VirtualKey:  append([]string{}, m.VirtualKey...),
+		Tags:        append([]string{}, m.Tags...),
 	}
 }
@@ -19,6 +19,8 @@ type Selector interface {
 type Operation interface {
 	// Lookup retrieves the metadata for the specified object ID.
 	Lookup(ctx context.Context, id *object.ID) (*object.Metadata, error)
+	// LookupWithHash retrieves the metadata for the specified object hash.
+	LookupWithHash(ctx context.Context, hash object.IDHash) (*object.Metadata, error)
 	// Store store the metadata for the specified object ID.
 	Store(ctx context.Context, meta *object.Metadata) error
 	// Exist checks if the object exists.
@@ -37,6 +39,8 @@ type Operation interface {
 	Iterate(ctx context.Context, fn func(*object.Metadata) error) error
 	// Expired if the object is expired callback.
 	Expired(ctx context.Context, id *object.ID, md *object.Metadata) bool
+	// Touch records a hit of the object, bumps the refs and the last access time.
+	Touch(ctx context.Context, id *object.ID)
 }
 
 type Storage interface {
@@ -47,7 +51,8 @@ type Storage interface {
 
 	SharedKV() SharedKV
 
-	PURGE(storeUrl string, typ PurgeControl) error
+	// PURGE removes or expires the objects of storeUrl, returns the number of processed objects.
+	PURGE(storeUrl string, typ PurgeControl) (int, error)
 }
 
 type Bucket interface {
@@ -73,9 +78,13 @@ type Bucket interface {
 }
 
 type PurgeControl struct {
-	Hard        bool `json:"hard"`         // 是否硬删除, default: false 与 MarkExpired 冲突
-	Dir         bool `json:"dir"`          // 是否清理目录, default: false
-	MarkExpired bool `json:"mark_expired"` // 是否标记为过期, default: false 与 Hard 冲突
+	Hard        bool   `json:"hard"`            // 是否硬删除, default: false 与 MarkExpired 冲突
+	Dir         bool   `json:"dir"`             // 是否清理目录, default: false
+	Domain      bool   `json:"domain"`          // 清理 storeUrl 所属域名 (http 与 https) 下的全部对象
+	MarkExpired bool   `json:"mark_expired"`    // 是否标记为过期, default: false 与 Hard 冲突
+	Tag         string `json:"tag,omitempty"`   // 按标签清理 storeUrl 所属域名下的对象, e.g. Surrogate-Key
+	Match       string `json:"match,omitempty"` // 按 RE2 正则清理 storeUrl 所属域名下 URL 匹配的对象
+	VirtualKey  string `json:"vkey,omitempty"`  // 仅清理单个 vary 变体, 为空时清理 URL 及其全部变体
 }
 
 var ErrSharedKVKeyNotFound = errors.New("key not found")
@@ -99,7 +108,8 @@ type SharedKV interface {
 	DropPrefix(ctx context.Context, prefix []byte) error
 	// Iterate iterates over all key-value pairs.
 	Iterate(ctx context.Context, f func(key, val []byte) error) error
-	// IteratePrefix iterates over all key-value pairs with the given prefix.
+	// IteratePrefix iterates over all key-value pairs with the given prefix,
+	// the iteration stops at the first error returned by f and returns it.
 	IteratePrefix(ctx context.Context, prefix []byte, f func(key, val []byte) error) error
 }
 
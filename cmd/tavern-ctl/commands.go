@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+)
+
+// objectDump is the human-readable form of object.Metadata.
+type objectDump struct {
+	URL         string      `json:"url"`
+	VirtualKey  string      `json:"virtual_key,omitempty"`
+	Hash        string      `json:"hash"`
+	Flags       []string    `json:"flags"`
+	Code        int         `json:"code"`
+	Size        uint64      `json:"size"`
+	BlockSize   uint64      `json:"block_size"`
+	ChunkCount  int         `json:"chunk_count"`
+	ChunkTotal  uint64      `json:"chunk_total"`
+	Chunks      []uint32    `json:"chunks"`
+	Complete    bool        `json:"complete"`
+	Refs        int64       `json:"refs"`
+	RespTime    string      `json:"resp_time"`
+	LastRefTime string      `json:"last_ref_time"`
+	ExpiresAt   string      `json:"expires_at"`
+	Expired     bool        `json:"expired"`
+	Headers     http.Header `json:"headers"`
+	VaryKeys    []string    `json:"vary_keys,omitempty"`
+}
+
+// runList lists objects by url prefix.
+func runList(b *bucket, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "url prefix, e.g. http://www.example.com/path/")
+	limit := fs.Int("limit", 0, "max number of objects to list, 0 is unlimited")
+	_ = fs.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "HASH\tCODE\tSIZE\tCHUNKS\tEXPIRES\tURL")
+
+	count := 0
+	err := iterate(b, *prefix, func(md *object.Metadata) bool {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%d/%d\t%s\t%s\n",
+			md.ID.HashStr(), md.Code, md.Size, md.Chunks.Count(), chunkTotal(md),
+			formatUnix(md.ExpiresAt), md.ID.Key())
+		count++
+		return *limit <= 0 || count < *limit
+	})
+
+	_ = w.Flush()
+	_, _ = fmt.Fprintf(os.Stderr, "%d objects\n", count)
+	return err
+}
+
+// runDump dumps one object metadata, the argument is the url or the hex hash.
+func runDump(b *bucket, args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	vkey := fs.String("vkey", "", "vary virtual key of the url")
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		return errors.New("missing url or hash argument")
+	}
+
+	md, err := lookup(b, fs.Arg(0), *vkey)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(os.Stdout, newObjectDump(md), true)
+}
+
+// runVerify verifies slice files against the metadata.
+func runVerify(b *bucket, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "url prefix, e.g. http://www.example.com/path/")
+	verbose := fs.Bool("v", false, "print every verified object")
+	_ = fs.Parse(args)
+
+	total, broken := 0, 0
+	err := iterate(b, *prefix, func(md *object.Metadata) bool {
+		if md.IsVary() {
+			return true
+		}
+
+		total++
+		problems := verifyObject(b.path, md)
+		if len(problems) > 0 {
+			broken++
+			fmt.Printf("BAD %s %s\n", md.ID.HashStr(), md.ID.Key())
+			for _, p := range problems {
+				fmt.Printf("    %s\n", p)
+			}
+			return true
+		}
+
+		if *verbose {
+			fmt.Printf("OK  %s %s\n", md.ID.HashStr(), md.ID.Key())
+		}
+		return true
+	})
+
+	_, _ = fmt.Fprintf(os.Stderr, "%d objects verified, %d broken\n", total, broken)
+	return err
+}
+
+// runStats prints per-host and size histograms.
+func runStats(b *bucket, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "url prefix, e.g. http://www.example.com/")
+	top := fs.Int("top", 20, "number of hosts to print, 0 is unlimited")
+	_ = fs.Parse(args)
+
+	type hostStat struct {
+		host  string
+		count uint64
+		bytes uint64
+	}
+
+	hosts := make(map[string]*hostStat)
+	sizes := make([]uint64, len(sizeBuckets)+1)
+	var count, bytes uint64
+
+	err := iterate(b, *prefix, func(md *object.Metadata) bool {
+		if md.IsVary() {
+			return true
+		}
+
+		host := "-"
+		if u, err := url.Parse(md.ID.Path()); err == nil {
+			host = u.Host
+		}
+
+		hs, ok := hosts[host]
+		if !ok {
+			hs = &hostStat{host: host}
+			hosts[host] = hs
+		}
+		hs.count++
+		hs.bytes += md.Size
+		count++
+		bytes += md.Size
+
+		sizes[sort.Search(len(sizeBuckets), func(i int) bool { return md.Size < sizeBuckets[i] })]++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	list := make([]*hostStat, 0, len(hosts))
+	for _, hs := range hosts {
+		list = append(list, hs)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].bytes > list[j].bytes
+	})
+	if *top > 0 && len(list) > *top {
+		list = list[:*top]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "objects: %d, bytes: %d (%s), hosts: %d\n\n", count, bytes, formatBytes(bytes), len(hosts))
+
+	_, _ = fmt.Fprintln(w, "HOST\tOBJECTS\tBYTES\t")
+	for _, hs := range list {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t\n", hs.host, hs.count, formatBytes(hs.bytes))
+	}
+
+	_, _ = fmt.Fprintln(w, "\nSIZE\tOBJECTS\t")
+	for i, n := range sizes {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t\n", sizeBucketName(i), n)
+	}
+	return w.Flush()
+}
+
+// runExport exports metadata as json lines.
+func runExport(b *bucket, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "url prefix, e.g. http://www.example.com/path/")
+	output := fs.String("o", "", "output file, default stdout")
+	raw := fs.Bool("raw", false, "export raw object.Metadata instead of the readable dump")
+	_ = fs.Parse(args)
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	count := 0
+	var werr error
+	err := iterate(b, *prefix, func(md *object.Metadata) bool {
+		var v any = newObjectDump(md)
+		if *raw {
+			v = md
+		}
+		if werr = writeJSON(w, v, false); werr != nil {
+			return false
+		}
+		count++
+		return true
+	})
+
+	_, _ = fmt.Fprintf(os.Stderr, "%d objects exported\n", count)
+	return errors.Join(err, werr)
+}
+
+// runRemove deletes objects from the indexdb and removes their slice files.
+func runRemove(b *bucket, args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "delete all objects with the url prefix")
+	dryRun := fs.Bool("n", false, "dry run, print objects only")
+	_ = fs.Parse(args)
+
+	targets := make([]*object.Metadata, 0)
+	if *prefix != "" {
+		if err := iterate(b, *prefix, func(md *object.Metadata) bool {
+			targets = append(targets, md)
+			return true
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, arg := range fs.Args() {
+		md, err := lookup(b, arg, "")
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "skip %s: %v\n", arg, err)
+			continue
+		}
+		targets = append(targets, md)
+
+		// the vary index is removed with all its variants.
+		for _, vkey := range md.VirtualKey {
+			if vmd, err1 := b.db.Get(context.Background(), object.NewVirtualID(md.ID.Path(), vkey).Bytes()); err1 == nil {
+				targets = append(targets, vmd)
+			}
+		}
+	}
+
+	removed := 0
+	for _, md := range targets {
+		fmt.Printf("rm %s %s\n", md.ID.HashStr(), md.ID.Key())
+		if *dryRun {
+			continue
+		}
+
+		if err := b.db.Delete(context.Background(), md.ID.Bytes()); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "delete %s failed: %v\n", md.ID.Key(), err)
+			continue
+		}
+		md.Chunks.Range(func(x uint32) {
+			wpath := md.ID.WPathSlice(b.path, x)
+			if err := os.Remove(wpath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				_, _ = fmt.Fprintf(os.Stderr, "remove %s failed: %v\n", wpath, err)
+			}
+		})
+		removed++
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "%d objects removed\n", removed)
+	return nil
+}
+
+// iterate walks all objects whose url has the given prefix, f returns false to stop.
+func iterate(b *bucket, prefix string, f func(md *object.Metadata) bool) error {
+	return b.db.Iterate(context.Background(), nil, func(_ []byte, md *object.Metadata) bool {
+		if md == nil || md.ID == nil {
+			return true
+		}
+		if prefix != "" && !strings.HasPrefix(md.ID.Path(), prefix) {
+			return true
+		}
+		return f(md)
+	})
+}
+
+// lookup finds an object by url or the 40 chars hex hash.
+func lookup(b *bucket, key string, vkey string) (*object.Metadata, error) {
+	if len(key) == object.IdHashSize*2 {
+		if hash, err := hex.DecodeString(key); err == nil {
+			return b.db.Get(context.Background(), hash)
+		}
+	}
+
+	return b.db.Get(context.Background(), object.NewVirtualID(key, vkey).Bytes())
+}
+
+// verifyObject checks every slice file marked in md.Chunks exists with the right size.
+func verifyObject(bucketPath string, md *object.Metadata) []string {
+	problems := make([]string, 0)
+
+	if md.BlockSize == 0 {
+		return append(problems, "block size is zero")
+	}
+
+	total := chunkTotal(md)
+	md.Chunks.Range(func(x uint32) {
+		wpath := md.ID.WPathSlice(bucketPath, x)
+
+		if total > 0 && uint64(x) >= total {
+			problems = append(problems, fmt.Sprintf("chunk %d out of object range %d", x, total))
+			return
+		}
+
+		stat, err := os.Stat(wpath)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("chunk %d: %v", x, err))
+			return
+		}
+
+		want := md.BlockSize
+		if md.Size > 0 && uint64(x) == md.Size/md.BlockSize {
+			want = md.Size % md.BlockSize // last chunk size
+		}
+		if md.Size > 0 && uint64(stat.Size()) != want {
+			problems = append(problems, fmt.Sprintf("chunk %d: file-size(%d) != chunk-size(%d) %s", x, stat.Size(), want, wpath))
+		}
+	})
+	return problems
+}
+
+func newObjectDump(md *object.Metadata) *objectDump {
+	d := &objectDump{
+		URL:         md.ID.Path(),
+		VirtualKey:  md.ID.Ext(),
+		Hash:        md.ID.HashStr(),
+		Flags:       formatFlags(md.Flags),
+		Code:        md.Code,
+		Size:        md.Size,
+		BlockSize:   md.BlockSize,
+		ChunkCount:  md.Chunks.Count(),
+		ChunkTotal:  chunkTotal(md),
+		Chunks:      make([]uint32, 0, md.Chunks.Count()),
+		Complete:    md.HasComplete(),
+		Refs:        md.Refs,
+		RespTime:    formatUnix(md.RespUnix),
+		LastRefTime: formatUnix(md.LastRefUnix),
+		ExpiresAt:   formatUnix(md.ExpiresAt),
+		Expired:     md.ExpiresAt < time.Now().Unix(),
+		Headers:     md.Headers,
+		VaryKeys:    md.VirtualKey,
+	}
+	md.Chunks.Range(func(x uint32) {
+		d.Chunks = append(d.Chunks, x)
+	})
+	return d
+}
+
+func chunkTotal(md *object.Metadata) uint64 {
+	if md.BlockSize == 0 {
+		return 0
+	}
+	n := md.Size / md.BlockSize
+	if md.Size%md.BlockSize != 0 {
+		n++
+	}
+	return n
+}
+
+func formatFlags(flags object.CacheFlag) []string {
+	names := flags.Names()
+	if len(names) == 0 {
+		names = append(names, "cache")
+	}
+	return names
+}
+
+func formatUnix(unix int64) string {
+	if unix <= 0 {
+		return "-"
+	}
+	return time.Unix(unix, 0).Format(time.RFC3339)
+}
+
+var sizeBuckets = []uint64{
+	4 << 10,
+	64 << 10,
+	1 << 20,
+	16 << 20,
+	256 << 20,
+	1 << 30,
+}
+
+func sizeBucketName(i int) string {
+	if i == 0 {
+		return "< " + formatBytes(sizeBuckets[0])
+	}
+	if i == len(sizeBuckets) {
+		return ">= " + formatBytes(sizeBuckets[i-1])
+	}
+	return formatBytes(sizeBuckets[i-1]) + " - " + formatBytes(sizeBuckets[i])
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func writeJSON(w io.Writer, v any, indent bool) error {
+	var (
+		buf []byte
+		err error
+	)
+	if indent {
+		buf, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		buf, err = json.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+
+	buf = append(buf, '\n')
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/storage/indexdb"
+)
+
+// newTestBucket creates a bucket of the objects, each object has its slice files of the block size 4.
+func newTestBucket(t *testing.T, urls ...string) string {
+	bucketPath := t.TempDir()
+	dbPath := path.Join(bucketPath, ".indexdb/")
+	db, err := indexdb.Create("pebble", indexdb.NewOption(dbPath, indexdb.WithType("pebble"), indexdb.WithDBConfig(map[string]any{})))
+	require.NoError(t, err)
+
+	for _, u := range urls {
+		md := &object.Metadata{
+			ID:        object.NewID(u),
+			Code:      http.StatusOK,
+			Size:      10,
+			BlockSize: 4,
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			Headers:   http.Header{"Content-Type": {"image/jpeg"}},
+		}
+		for x, size := range []int{4, 4, 2} {
+			md.Chunks.Set(uint32(x))
+			wpath := md.ID.WPathSlice(bucketPath, uint32(x))
+			require.NoError(t, os.MkdirAll(filepath.Dir(wpath), 0o755))
+			require.NoError(t, os.WriteFile(wpath, bytes.Repeat([]byte("a"), size), 0o644))
+		}
+		require.NoError(t, db.Set(context.Background(), md.ID.Bytes(), md))
+	}
+	require.NoError(t, db.Close())
+	return bucketPath
+}
+
+func openTestBucket(t *testing.T, bucketPath string, readOnly bool) *bucket {
+	b, err := openBucket(bucketPath, "pebble", readOnly)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = b.db.Close() })
+	return b
+}
+
+// captureStdout returns the stdout written by fn.
+func captureStdout(t *testing.T, fn func() error) string {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		buf, _ := io.ReadAll(r)
+		out <- string(buf)
+	}()
+
+	require.NoError(t, fn())
+	_ = w.Close()
+	return <-out
+}
+
+func TestIterate(t *testing.T) {
+	urls := make([]string, 0, 10)
+	for i := 0; i < 5; i++ {
+		urls = append(urls, fmt.Sprintf("http://www.example.com/%d.jpg", i), fmt.Sprintf("http://img.example.com/%d.jpg", i))
+	}
+	b := openTestBucket(t, newTestBucket(t, urls...), true)
+
+	tests := []struct {
+		name   string
+		prefix string
+		stop   int // f returns false at the n-th object
+		want   int
+	}{
+		{name: "all", want: 10},
+		{name: "prefix", prefix: "http://img.example.com/", want: 5},
+		{name: "stop", stop: 3, want: 3},
+		{name: "prefix and stop", prefix: "http://www.example.com/", stop: 2, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			visited := 0
+			require.NoError(t, iterate(b, tt.prefix, func(md *object.Metadata) bool {
+				assert.True(t, strings.HasPrefix(md.ID.Path(), tt.prefix))
+				visited++
+				return visited != tt.stop
+			}))
+			assert.Equal(t, tt.want, visited)
+		})
+	}
+}
+
+func TestRunList(t *testing.T) {
+	b := openTestBucket(t, newTestBucket(t,
+		"http://www.example.com/1.jpg", "http://www.example.com/2.jpg", "http://img.example.com/1.jpg"), true)
+
+	out := captureStdout(t, func() error { return runList(b, []string{"-prefix", "http://www.example.com/"}) })
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], "HASH"))
+	assert.Contains(t, lines[1], "3/3")
+
+	out = captureStdout(t, func() error { return runList(b, []string{"-limit", "1"}) })
+	assert.Len(t, strings.Split(strings.TrimSpace(out), "\n"), 2)
+}
+
+func TestRunDump(t *testing.T) {
+	rawUrl := "http://www.example.com/1.jpg"
+	b := openTestBucket(t, newTestBucket(t, rawUrl), true)
+
+	for _, key := range []string{rawUrl, object.NewID(rawUrl).HashStr()} {
+		dump := &objectDump{}
+		require.NoError(t, json.Unmarshal([]byte(captureStdout(t, func() error { return runDump(b, []string{key}) })), dump))
+		assert.Equal(t, rawUrl, dump.URL)
+		assert.Equal(t, []uint32{0, 1, 2}, dump.Chunks)
+		assert.True(t, dump.Complete)
+		assert.Equal(t, "image/jpeg", dump.Headers.Get("Content-Type"))
+	}
+
+	assert.Error(t, runDump(b, nil))
+	assert.Error(t, runDump(b, []string{"http://www.example.com/2.jpg"}))
+}
+
+func TestRunVerify(t *testing.T) {
+	bucketPath := newTestBucket(t, "http://www.example.com/ok.jpg", "http://www.example.com/missing.jpg", "http://www.example.com/short.jpg")
+	require.NoError(t, os.Remove(object.NewID("http://www.example.com/missing.jpg").WPathSlice(bucketPath, 1)))
+	require.NoError(t, os.WriteFile(object.NewID("http://www.example.com/short.jpg").WPathSlice(bucketPath, 2), []byte("a"), 0o644))
+	b := openTestBucket(t, bucketPath, true)
+
+	out := captureStdout(t, func() error { return runVerify(b, []string{"-v"}) })
+	assert.Contains(t, out, "OK  "+object.NewID("http://www.example.com/ok.jpg").HashStr())
+	assert.Contains(t, out, "BAD "+object.NewID("http://www.example.com/missing.jpg").HashStr())
+	assert.Contains(t, out, "chunk 1: ")
+	assert.Contains(t, out, "BAD "+object.NewID("http://www.example.com/short.jpg").HashStr())
+	assert.Contains(t, out, "chunk 2: file-size(1) != chunk-size(2)")
+}
+
+func TestRunExport(t *testing.T) {
+	b := openTestBucket(t, newTestBucket(t,
+		"http://www.example.com/1.jpg", "http://www.example.com/2.jpg", "http://img.example.com/1.jpg"), true)
+
+	output := filepath.Join(t.TempDir(), "export.jsonl")
+	require.NoError(t, runExport(b, []string{"-prefix", "http://www.example.com/", "-raw", "-o", output}))
+
+	f, err := os.Open(output)
+	require.NoError(t, err)
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		md := &object.Metadata{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), md))
+		assert.Equal(t, uint64(10), md.Size)
+		count++
+	}
+	assert.Equal(t, 2, count)
+}
+
+func TestRunRemove(t *testing.T) {
+	bucketPath := newTestBucket(t, "http://www.example.com/1.jpg", "http://www.example.com/2.jpg", "http://img.example.com/1.jpg")
+	exists := func(rawUrl string) bool {
+		_, err := os.Stat(object.NewID(rawUrl).WPathSlice(bucketPath, 0))
+		return err == nil
+	}
+
+	// dry run keeps the objects.
+	b, err := openBucket(bucketPath, "pebble", false)
+	require.NoError(t, err)
+	out := captureStdout(t, func() error { return runRemove(b, []string{"-n", "-prefix", "http://www.example.com/"}) })
+	assert.Len(t, strings.Split(strings.TrimSpace(out), "\n"), 2)
+	assert.True(t, exists("http://www.example.com/1.jpg"))
+
+	captureStdout(t, func() error {
+		return runRemove(b, []string{"-prefix", "http://www.example.com/", "http://img.example.com/1.jpg"})
+	})
+	require.NoError(t, b.db.Close())
+
+	for _, rawUrl := range []string{"http://www.example.com/1.jpg", "http://www.example.com/2.jpg", "http://img.example.com/1.jpg"} {
+		assert.False(t, exists(rawUrl))
+	}
+
+	b = openTestBucket(t, bucketPath, true)
+	count := 0
+	require.NoError(t, iterate(b, "", func(*object.Metadata) bool {
+		count++
+		return true
+	}))
+	assert.Zero(t, count)
+}
+
+func TestOpenBucket(t *testing.T) {
+	_, err := openBucket(t.TempDir(), "pebble", true)
+	assert.Error(t, err)
+
+	// the read only bucket is not modified.
+	rawUrl := "http://www.example.com/1.jpg"
+	bucketPath := newTestBucket(t, rawUrl)
+	b := openTestBucket(t, bucketPath, true)
+	captureStdout(t, func() error { return runRemove(b, []string{rawUrl}) })
+
+	_, err = lookup(b, rawUrl, "")
+	assert.NoError(t, err)
+	_, err = os.Stat(object.NewID(rawUrl).WPathSlice(bucketPath, 0))
+	assert.NoError(t, err)
+}
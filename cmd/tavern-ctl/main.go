@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage/indexdb"
+	_ "github.com/omalloc/tavern/storage/indexdb/pebble"
+)
+
+const usage = `tavern-ctl - offline cache bucket inspection
+
+Usage:
+  tavern-ctl -b <bucket-path> [-db pebble] <command> [arguments]
+
+Commands:
+  ls      list objects by url prefix
+  dump    dump one object metadata, chunks and headers
+  verify  verify slice files against the metadata
+  stats   print per-host and size histograms
+  export  export metadata as json lines
+  rm      delete objects (index + slice files)
+
+Run 'tavern-ctl <command> -h' for more information about a command.
+`
+
+var (
+	// flagBucket is the bucket path, the indexdb lives in <bucket>/.indexdb
+	flagBucket string
+	// flagDBType is the indexdb type.
+	flagDBType string
+)
+
+type command struct {
+	// write opens the indexdb read-write, otherwise read-only.
+	write bool
+	run   func(b *bucket, args []string) error
+}
+
+var commands = map[string]command{
+	"ls":     {run: runList},
+	"dump":   {run: runDump},
+	"verify": {run: runVerify},
+	"stats":  {run: runStats},
+	"export": {run: runExport},
+	"rm":     {run: runRemove, write: true},
+}
+
+// bucket is an opened offline bucket.
+type bucket struct {
+	path string
+	db   storagev1.IndexDB
+}
+
+func main() {
+	flag.StringVar(&flagBucket, "b", "", "bucket path, e.g. /cache1")
+	flag.StringVar(&flagDBType, "db", "pebble", "indexdb type")
+	flag.Usage = func() {
+		_, _ = fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+
+	// keep pebble and indexdb logs out of the output.
+	log.SetLogger(log.NewFilter(log.GetLogger(), log.FilterLevel(log.LevelError)))
+
+	args := flag.Args()
+	if len(args) < 1 || flagBucket == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		_, _ = fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	b, err := openBucket(flagBucket, flagDBType, !cmd.write)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "open bucket %s failed: %v\n", flagBucket, err)
+		os.Exit(1)
+	}
+
+	err = cmd.run(b, args[1:])
+	_ = b.db.Close()
+
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+func openBucket(bucketPath, dbType string, readOnly bool) (*bucket, error) {
+	dbPath := path.Join(bucketPath, ".indexdb/")
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+
+	db, err := indexdb.Create(dbType, indexdb.NewOption(dbPath,
+		indexdb.WithType(dbType),
+		indexdb.WithDBConfig(map[string]any{"read_only": readOnly})))
+	if err != nil {
+		return nil, err
+	}
+
+	return &bucket{
+		path: bucketPath,
+		db:   db,
+	}, nil
+}
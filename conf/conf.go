@@ -7,6 +7,9 @@ import (
 	"github.com/omalloc/tavern/pkg/mapstruct"
 )
 
+// DefaultSharedKVPath the on-disk sharedkv used when `storage.sharedkv_path` is empty.
+const DefaultSharedKVPath = "./data/sharedkv"
+
 type Bootstrap struct {
 	Strict   bool      `json:"strict" yaml:"strict"`
 	Hostname string    `json:"hostname" yaml:"hostname"`
@@ -40,6 +43,7 @@ type Server struct {
 	Middleware         []*middlewarev1.Middleware `json:"middleware" yaml:"middleware"`
 	PProf              *ServerPProf               `json:"pprof" yaml:"pprof"`
 	AccessLog          *ServerAccessLog           `json:"access_log" yaml:"access_log"`
+	Push               *ServerPush                `json:"push" yaml:"push"`
 	LocalApiAllowHosts []string                   `json:"local_api_allow_hosts" yaml:"local_api_allow_hosts"`
 }
 
@@ -57,6 +61,12 @@ type ServerAccessLog struct {
 	} `json:"encrypt" yaml:"encrypt"`
 }
 
+type ServerPush struct {
+	MaxConcurrency int `json:"max_concurrency" yaml:"max_concurrency"` // max concurrent upstream fetches of all jobs
+	MaxURLs        int `json:"max_urls" yaml:"max_urls"`               // max urls per job
+	History        int `json:"history" yaml:"history"`                 // finished jobs kept in memory
+}
+
 type Upstream struct {
 	Balancing           string         `json:"balancing" yaml:"balancing"`
 	Address             []string       `json:"address" yaml:"address"`
@@ -75,6 +85,8 @@ type Storage struct {
 	EvictionPolicy  string    `json:"eviction_policy" yaml:"eviction_policy"`
 	SelectionPolicy string    `json:"selection_policy" yaml:"selection_policy"`
 	SliceSize       uint64    `json:"slice_size" yaml:"slice_size"`
+	SharedKVPath    string    `json:"sharedkv_path" yaml:"sharedkv_path"`   // on-disk, e.g. purge queue survives restart, default ./data/sharedkv
+	DomainMetrics   int       `json:"domain_metrics" yaml:"domain_metrics"` // max domains of the per-domain usage metrics, default 100
 	Buckets         []*Bucket `json:"buckets" yaml:"buckets"`
 }
 
@@ -34,6 +34,8 @@ import (
 	"github.com/omalloc/tavern/proxy"
 	"github.com/omalloc/tavern/server"
 	"github.com/omalloc/tavern/storage"
+	"github.com/omalloc/tavern/storage/accounting"
+	"github.com/omalloc/tavern/storage/ban"
 )
 
 var (
@@ -109,13 +111,26 @@ func newApp(bc *conf.Bootstrap, logger log.Logger) (*kratos.App, error) {
 		}
 	}
 
-	// init storage
+	// init storage, the sharedkv is always on disk so the purge tasks and bans survive restart
+	if bc.Storage.SharedKVPath == "" {
+		bc.Storage.SharedKVPath = conf.DefaultSharedKVPath
+	}
 	st, err := storage.New(bc.Storage, log.GetLogger())
 	if err != nil {
 		log.Fatalf("failed to initialize storage: %v", err)
 	}
 	storage.SetDefault(st)
 
+	// per-domain usage metrics, the top domains by bytes
+	prometheus.MustRegister(accounting.NewCollector(accounting.Default(), bc.Storage.DomainMetrics))
+
+	// init ban list, evaluated lazily at cache lookup
+	bans := ban.New(st.SharedKV(), log.GetLogger())
+	if err = bans.Load(context.Background()); err != nil {
+		log.Warnf("failed to load ban list: %v", err)
+	}
+	ban.SetDefault(bans)
+
 	// init upstream
 	nodes := make([]selector.Node, 0, len(bc.Upstream.Address))
 	for _, addr := range bc.Upstream.Address {
@@ -140,6 +155,8 @@ func newApp(bc *conf.Bootstrap, logger log.Logger) (*kratos.App, error) {
 
 	srv := server.NewServer(flip, bc, plugins)
 	servers = append(servers, srv)
+	// ban lurker
+	servers = append(servers, bans)
 
 	for _, p := range plugins {
 		servers = append(servers, p)
@@ -0,0 +1,78 @@
+package cmsketch
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const depth = 4
+
+// Sketch is a count-min sketch with 8-bit saturating counters,
+// it estimates the access frequency of the keys in a fixed memory.
+//
+// the counters are halved by Decay, so the old popularity fades out (TinyLFU aging).
+type Sketch struct {
+	mu   sync.Mutex
+	rows [depth][]uint8
+	mask uint64
+}
+
+// New returns a sketch with `width` counters per row, rounded up to the power of 2.
+func New(width int) *Sketch {
+	if width < 64 {
+		width = 64
+	}
+	width = 1 << bits.Len(uint(width-1))
+
+	s := &Sketch{mask: uint64(width - 1)}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// Incr increments the counters of the key and returns the estimated frequency.
+func (s *Sketch) Incr(key uint64) uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	est := uint8(255)
+	for i := range s.rows {
+		idx := s.index(key, i)
+		if s.rows[i][idx] < 255 {
+			s.rows[i][idx]++
+		}
+		est = min(est, s.rows[i][idx])
+	}
+	return est
+}
+
+// Estimate returns the estimated frequency of the key.
+func (s *Sketch) Estimate(key uint64) uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	est := uint8(255)
+	for i := range s.rows {
+		est = min(est, s.rows[i][s.index(key, i)])
+	}
+	return est
+}
+
+// Decay halves all the counters.
+func (s *Sketch) Decay() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+}
+
+// index returns the counter index of the row with double hashing.
+func (s *Sketch) index(key uint64, row int) uint64 {
+	h1, h2 := key&0xffffffff, key>>32
+	return (h1 + uint64(row)*h2 + uint64(row)) & s.mask
+}
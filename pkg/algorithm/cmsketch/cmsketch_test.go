@@ -0,0 +1,71 @@
+package cmsketch_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/omalloc/tavern/pkg/algorithm/cmsketch"
+)
+
+func TestIncr(t *testing.T) {
+	s := cmsketch.New(1024)
+
+	for i := 1; i <= 10; i++ {
+		assert.Equal(t, uint8(i), s.Incr(42))
+	}
+	assert.Equal(t, uint8(10), s.Estimate(42))
+	assert.Equal(t, uint8(0), s.Estimate(43))
+}
+
+func TestIncrSaturation(t *testing.T) {
+	s := cmsketch.New(64)
+
+	for range 300 {
+		s.Incr(7)
+	}
+	assert.Equal(t, uint8(255), s.Incr(7))
+	assert.Equal(t, uint8(255), s.Estimate(7))
+}
+
+func TestDecay(t *testing.T) {
+	s := cmsketch.New(1024)
+
+	for range 9 {
+		s.Incr(1)
+	}
+	for range 255 {
+		s.Incr(2)
+	}
+
+	s.Decay()
+	assert.Equal(t, uint8(4), s.Estimate(1))
+	assert.Equal(t, uint8(127), s.Estimate(2))
+
+	// the saturated counter counts again after the decay.
+	assert.Equal(t, uint8(128), s.Incr(2))
+
+	for range 8 {
+		s.Decay()
+	}
+	assert.Equal(t, uint8(0), s.Estimate(1))
+	assert.Equal(t, uint8(0), s.Estimate(2))
+}
+
+func TestEstimateNeverUnderCounts(t *testing.T) {
+	// the small sketch has collisions, the estimation is at least the real count.
+	s := cmsketch.New(64)
+
+	counts := make(map[uint64]uint8)
+	for key := uint64(0); key < 512; key++ {
+		n := uint8(key%5 + 1)
+		for range n {
+			s.Incr(key * 0x9e3779b97f4a7c15)
+		}
+		counts[key*0x9e3779b97f4a7c15] = n
+	}
+
+	for key, n := range counts {
+		assert.GreaterOrEqual(t, s.Estimate(key), n)
+	}
+}
@@ -93,6 +93,43 @@ func (c *Cache[K, V]) Set(key K, value V) {
 	}
 }
 
+// SetWithFrequency sets given key-value with the initial frequency, e.g. restored from the persisted refs.
+// If the key-value already exists, it increases the frequency.
+func (c *Cache[K, V]) SetWithFrequency(key K, value V, freq int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.values[key]; ok {
+		e.value = value
+		c.increment(e)
+		return
+	}
+
+	e := new(cacheEntry[K, V])
+	e.key = key
+	e.value = value
+	c.values[key] = e
+	c.place(e, max(freq, 1))
+	c.len++
+	if c.UpperBound > 0 && c.LowerBound > 0 {
+		if c.len > c.UpperBound {
+			c.evict(c.len - c.LowerBound)
+		}
+	}
+}
+
+// Update applies fn to the key's value in place and increments the frequency.
+// It returns false if there is no value for the given key.
+func (c *Cache[K, V]) Update(key K, fn func(*V)) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.values[key]; ok {
+		fn(&e.value)
+		c.increment(e)
+		return true
+	}
+	return false
+}
+
 // Len returns the length of the cache
 func (c *Cache[K, V]) Len() int {
 	c.lock.Lock()
@@ -187,6 +224,28 @@ func (c *Cache[K, V]) increment(e *cacheEntry[K, V]) {
 	}
 }
 
+// place inserts the new entry to the list of the frequency, walking from the front.
+func (c *Cache[K, V]) place(e *cacheEntry[K, V], freq int) {
+	var prev *list.Element[V]
+	place := c.freqs.Front()
+	for place != nil && place.Value.(*listEntry[K, V]).freq < freq {
+		prev, place = place, place.Next()
+	}
+
+	if place == nil || place.Value.(*listEntry[K, V]).freq != freq {
+		li := new(listEntry[K, V])
+		li.freq = freq
+		li.entries = make(map[*cacheEntry[K, V]]byte)
+		if prev != nil {
+			place = c.freqs.InsertAfter(li, prev)
+		} else {
+			place = c.freqs.PushFront(li)
+		}
+	}
+	e.freqNode = place
+	place.Value.(*listEntry[K, V]).entries[e] = 1
+}
+
 func (c *Cache[K, V]) remEntry(place *list.Element[V], entry *cacheEntry[K, V]) {
 	entries := place.Value.(*listEntry[K, V]).entries
 	delete(entries, entry)
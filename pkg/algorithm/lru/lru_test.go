@@ -0,0 +1,110 @@
+package lru_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/omalloc/tavern/pkg/algorithm/lru"
+)
+
+// evictOrder evicts all the keys one by one, returns the keys in the eviction order.
+func evictOrder(c *lru.Cache[string, int]) []string {
+	ch := make(chan lru.Eviction[string, int], c.Len())
+	c.EvictionChannel = ch
+
+	keys := make([]string, 0, c.Len())
+	for c.Evict(1) > 0 {
+		keys = append(keys, (<-ch).Key)
+	}
+	return keys
+}
+
+func TestSetWithFrequency(t *testing.T) {
+	c := lru.New[string, int](0)
+
+	c.SetWithFrequency("a", 1, 5)
+	c.SetWithFrequency("b", 2, 0)
+	c.SetWithFrequency("c", 3, -1)
+	assert.Equal(t, 3, c.Len())
+	assert.Equal(t, 5, c.GetFrequency("a"))
+	assert.Equal(t, 1, c.GetFrequency("b"))
+	assert.Equal(t, 1, c.GetFrequency("c"))
+
+	// the existing key is incremented, the restored frequency is ignored.
+	c.SetWithFrequency("a", 10, 100)
+	assert.Equal(t, 6, c.GetFrequency("a"))
+	assert.Equal(t, 10, *c.Get("a"))
+	assert.Equal(t, 3, c.Len())
+
+	// the Set of the restored key moves up from its frequency.
+	c.Set("b", 20)
+	assert.Equal(t, 2, c.GetFrequency("b"))
+}
+
+func TestSetWithFrequencyBound(t *testing.T) {
+	c := lru.New[string, int](2)
+
+	c.SetWithFrequency("a", 1, 3)
+	c.SetWithFrequency("b", 2, 2)
+	c.SetWithFrequency("c", 3, 4)
+
+	// the least frequently used is evicted over the bound.
+	assert.Equal(t, 2, c.Len())
+	assert.False(t, c.Has("b"))
+	assert.True(t, c.Has("a"))
+	assert.True(t, c.Has("c"))
+}
+
+func TestPlaceOrder(t *testing.T) {
+	c := lru.New[string, int](0)
+
+	// the restored frequencies out of order, placed before, between, after and into the existing ones.
+	c.SetWithFrequency("f4", 0, 4)
+	c.SetWithFrequency("f2", 0, 2)
+	c.SetWithFrequency("f8", 0, 8)
+	c.SetWithFrequency("f6", 0, 6)
+	c.SetWithFrequency("f1", 0, 1)
+	c.Set("new", 0)
+
+	assert.Equal(t, 6, c.Len())
+	assert.Equal(t, 1, c.GetFrequency("new"))
+
+	order := evictOrder(c)
+	require.Len(t, order, 6)
+	assert.ElementsMatch(t, []string{"f1", "new"}, order[:2])
+	assert.Equal(t, []string{"f2", "f4", "f6", "f8"}, order[2:])
+	assert.Zero(t, c.Len())
+}
+
+func TestPlaceIncrement(t *testing.T) {
+	c := lru.New[string, int](0)
+
+	c.SetWithFrequency("a", 0, 3)
+	c.SetWithFrequency("b", 0, 5)
+	c.SetWithFrequency("c", 0, 4)
+
+	// a moves into the list of c, then after b.
+	c.Get("a")
+	assert.Equal(t, 4, c.GetFrequency("a"))
+	c.Get("a")
+	c.Get("a")
+	assert.Equal(t, 6, c.GetFrequency("a"))
+
+	assert.Equal(t, []string{"c", "b", "a"}, evictOrder(c))
+}
+
+func TestUpdate(t *testing.T) {
+	c := lru.New[string, []int](0)
+
+	assert.False(t, c.Update("a", func(v *[]int) { *v = append(*v, 1) }))
+	assert.False(t, c.Has("a"))
+
+	c.SetWithFrequency("a", []int{1}, 2)
+	assert.True(t, c.Update("a", func(v *[]int) { *v = append(*v, 2) }))
+	assert.Equal(t, []int{1, 2}, *c.Get("a"))
+
+	// Update and Get both increment.
+	assert.Equal(t, 4, c.GetFrequency("a"))
+}
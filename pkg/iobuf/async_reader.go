@@ -11,17 +11,21 @@ type ProxyCallback func() (*http.Response, error)
 // asyncReader is a struct that wraps an io.ReadCloser for reading data asynchronously.
 // It captures any errors encountered during reading for later retrieval.
 type asyncReader struct {
-	R   io.ReadCloser
-	err error
+	R     io.ReadCloser
+	err   error
+	ready chan struct{} // closed once the callback returned
+	rerr  error         // the error of the callback
 }
 
 // AsyncReadCloser creates an asynchronous io.ReadCloser that invokes a ProxyCallback to process data in the background.
 func AsyncReadCloser(proxy ProxyCallback) io.ReadCloser {
 	pr, pw := io.Pipe()
 
-	ar := &asyncReader{R: pr}
+	ar := &asyncReader{R: pr, ready: make(chan struct{})}
 	go func() {
 		resp, err := proxy()
+		ar.rerr = err
+		close(ar.ready)
 		defer func() {
 			if resp != nil && resp.Body != nil {
 				_ = resp.Body.Close()
@@ -51,6 +55,17 @@ func AsyncReadCloser(proxy ProxyCallback) io.ReadCloser {
 	return ar
 }
 
+// WaitAsync waits for the callback of the reader created by AsyncReadCloser, e.g. the response headers,
+// returns the error of the callback. The other readers return nil immediately.
+func WaitAsync(r io.ReadCloser) error {
+	ar, ok := r.(*asyncReader)
+	if !ok {
+		return nil
+	}
+	<-ar.ready
+	return ar.rerr
+}
+
 // Read reads data into the provided byte slice and returns the number of bytes read and an error, if any occurred.
 func (r *asyncReader) Read(p []byte) (n int, err error) {
 	n, err = r.R.Read(p)
@@ -0,0 +1,39 @@
+package iobuf_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/omalloc/tavern/pkg/iobuf"
+)
+
+func TestWaitAsync(t *testing.T) {
+	body := markbuf(1024)
+	r := iobuf.AsyncReadCloser(func() (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))}, nil
+	})
+
+	// the response is resolved before the body is read.
+	assert.NoError(t, iobuf.WaitAsync(r))
+	buf, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, body, buf)
+	assert.NoError(t, r.Close())
+
+	errChanged := errors.New("changed")
+	r = iobuf.AsyncReadCloser(func() (*http.Response, error) {
+		return nil, errChanged
+	})
+	assert.ErrorIs(t, iobuf.WaitAsync(r), errChanged)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, errChanged)
+	assert.NoError(t, r.Close())
+
+	// the other readers are never waited.
+	assert.NoError(t, iobuf.WaitAsync(io.NopCloser(bytes.NewReader(body))))
+}
@@ -45,6 +45,11 @@ func (c CacheControl) MaxAge() time.Duration {
 	return c.timedDirective("max-age")
 }
 
+// SMaxAge returns -1 if the directive wasn't present, it overrides max-age for the shared caches.
+func (c CacheControl) SMaxAge() time.Duration {
+	return c.timedDirective("s-maxage")
+}
+
 func (c CacheControl) Private() (bool, string) {
 	str, ok := c["private"]
 	return ok, str
@@ -55,6 +60,12 @@ func (c CacheControl) NoCache() (bool, string) {
 	return ok, str
 }
 
+// Immutable reports the response will not be updated while fresh. (RFC 8246)
+func (c CacheControl) Immutable() bool {
+	_, ok := c["immutable"]
+	return ok
+}
+
 func (c CacheControl) MustRevalidate() bool {
 	_, ok := c["must-revalidate"]
 	return ok
@@ -94,6 +105,11 @@ func (c CacheControl) timedDirective(key string) time.Duration {
 		return -1
 	}
 
+	// Surrogate-Control max-age=300+60, the stale part is ignored.
+	if idx := strings.IndexByte(t, '+'); idx > 0 {
+		t = t[:idx]
+	}
+
 	i, err := strconv.Atoi(t)
 	if err != nil {
 		return -1
@@ -0,0 +1,129 @@
+package http
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Hypertext Transfer Protocol (HTTP): Conditional Requests
+// https://www.rfc-editor.org/rfc/rfc9110.html#section-13
+
+type Precondition int
+
+const (
+	PreconditionNone        Precondition = iota // serve the representation
+	PreconditionNotModified                     // 304 Not Modified
+	PreconditionFailed                          // 412 Precondition Failed
+)
+
+// CheckPreconditions evaluates the client preconditions against the validators of the
+// selected representation, in the order of RFC 9110 13.2.2.
+//
+// If-Range is not evaluated here, see CheckIfRange.
+func CheckPreconditions(req *http.Request, etag, lastModified string) Precondition {
+	modtime := parseHTTPTime(lastModified)
+
+	// step 1, 2
+	if im := req.Header.Get("If-Match"); im != "" {
+		if !matchETag(im, etag, false) {
+			return PreconditionFailed
+		}
+	} else if ius := parseHTTPTime(req.Header.Get("If-Unmodified-Since")); !ius.IsZero() && !modtime.IsZero() {
+		if modtime.After(ius) {
+			return PreconditionFailed
+		}
+	}
+
+	// step 3, 4
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if matchETag(inm, etag, true) {
+			if req.Method == http.MethodGet || req.Method == http.MethodHead {
+				return PreconditionNotModified
+			}
+			return PreconditionFailed
+		}
+	} else if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		if ims := parseHTTPTime(req.Header.Get("If-Modified-Since")); !ims.IsZero() && !modtime.IsZero() {
+			if !modtime.After(ims) {
+				return PreconditionNotModified
+			}
+		}
+	}
+
+	return PreconditionNone
+}
+
+// CheckIfRange reports whether the Range header can be honored, the request
+// without If-Range or with the matched validator keeps the Range,
+// otherwise the full representation is sent. (RFC 9110 13.1.5)
+func CheckIfRange(req *http.Request, etag, lastModified string) bool {
+	ir := req.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+
+	// entity-tag, strong comparison
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return matchETag(ir, etag, false)
+	}
+
+	// HTTP-date, exact match with the Last-Modified
+	modtime := parseHTTPTime(lastModified)
+	t := parseHTTPTime(ir)
+	return !modtime.IsZero() && !t.IsZero() && modtime.Equal(t)
+}
+
+// NotModifiedHeader returns the headers of the 304 response from the representation headers. (RFC 9110 15.4.5)
+func NotModifiedHeader(src http.Header) http.Header {
+	dst := make(http.Header)
+	for _, k := range []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"} {
+		for _, v := range src.Values(k) {
+			dst.Add(k, v)
+		}
+	}
+	return dst
+}
+
+// matchETag reports whether the comma separated list of the header matches the etag,
+// "*" matches any current representation.
+func matchETag(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = textproto.TrimString(candidate)
+		if candidate == "" {
+			continue
+		}
+		if candidate == "*" {
+			// the cached representation exists.
+			return true
+		}
+		if etag == "" {
+			continue
+		}
+
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+			continue
+		}
+
+		// strong comparison, the weak tags never match.
+		if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(etag, "W/") && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHTTPTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,255 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testETag         = `"v1"`
+	testLastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	testBefore       = "Sun, 01 Jan 2006 15:04:05 GMT"
+	testAfter        = "Tue, 03 Jan 2006 15:04:05 GMT"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		etag   string
+		want   Precondition
+	}{
+		{
+			name: "no preconditions",
+			want: PreconditionNone,
+		},
+		{
+			name:   "if-match matched",
+			header: map[string]string{"If-Match": `"v0", "v1"`},
+			want:   PreconditionNone,
+		},
+		{
+			name:   "if-match mismatched",
+			header: map[string]string{"If-Match": `"v0"`},
+			want:   PreconditionFailed,
+		},
+		{
+			name:   "if-match any",
+			header: map[string]string{"If-Match": "*"},
+			want:   PreconditionNone,
+		},
+		{
+			name:   "if-match weak never matches",
+			header: map[string]string{"If-Match": `W/"v1"`},
+			want:   PreconditionFailed,
+		},
+		{
+			name:   "if-match wins over if-unmodified-since",
+			header: map[string]string{"If-Match": testETag, "If-Unmodified-Since": testBefore},
+			want:   PreconditionNone,
+		},
+		{
+			name:   "if-unmodified-since modified",
+			header: map[string]string{"If-Unmodified-Since": testBefore},
+			want:   PreconditionFailed,
+		},
+		{
+			name:   "if-unmodified-since unmodified",
+			header: map[string]string{"If-Unmodified-Since": testLastModified},
+			want:   PreconditionNone,
+		},
+		{
+			name:   "if-unmodified-since invalid date ignored",
+			header: map[string]string{"If-Unmodified-Since": "yesterday"},
+			want:   PreconditionNone,
+		},
+		{
+			name:   "if-match failed before if-none-match",
+			header: map[string]string{"If-Match": `"v0"`, "If-None-Match": testETag},
+			want:   PreconditionFailed,
+		},
+		{
+			name:   "if-unmodified-since failed before if-none-match",
+			header: map[string]string{"If-Unmodified-Since": testBefore, "If-None-Match": testETag},
+			want:   PreconditionFailed,
+		},
+		{
+			name:   "if-none-match matched",
+			header: map[string]string{"If-None-Match": testETag},
+			want:   PreconditionNotModified,
+		},
+		{
+			name:   "if-none-match weak comparison",
+			header: map[string]string{"If-None-Match": `W/"v1"`},
+			want:   PreconditionNotModified,
+		},
+		{
+			name:   "if-none-match weak etag",
+			header: map[string]string{"If-None-Match": testETag},
+			etag:   `W/"v1"`,
+			want:   PreconditionNotModified,
+		},
+		{
+			name:   "if-none-match mismatched",
+			header: map[string]string{"If-None-Match": `"v0"`},
+			want:   PreconditionNone,
+		},
+		{
+			name:   "if-none-match matched unsafe method",
+			method: http.MethodPut,
+			header: map[string]string{"If-None-Match": "*"},
+			want:   PreconditionFailed,
+		},
+		{
+			name:   "if-none-match wins over if-modified-since",
+			header: map[string]string{"If-None-Match": `"v0"`, "If-Modified-Since": testAfter},
+			want:   PreconditionNone,
+		},
+		{
+			name:   "if-modified-since unmodified",
+			header: map[string]string{"If-Modified-Since": testLastModified},
+			want:   PreconditionNotModified,
+		},
+		{
+			name:   "if-modified-since modified",
+			header: map[string]string{"If-Modified-Since": testBefore},
+			want:   PreconditionNone,
+		},
+		{
+			name:   "if-modified-since head",
+			method: http.MethodHead,
+			header: map[string]string{"If-Modified-Since": testAfter},
+			want:   PreconditionNotModified,
+		},
+		{
+			name:   "if-modified-since ignored for post",
+			method: http.MethodPost,
+			header: map[string]string{"If-Modified-Since": testAfter},
+			want:   PreconditionNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, _ := http.NewRequest(method, "http://www.example.com/1.jpg", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+
+			etag := tt.etag
+			if etag == "" {
+				etag = testETag
+			}
+			assert.Equal(t, tt.want, CheckPreconditions(req, etag, testLastModified))
+		})
+	}
+}
+
+func TestCheckIfRange(t *testing.T) {
+	tests := []struct {
+		name         string
+		ifRange      string
+		etag         string
+		lastModified string
+		want         bool
+	}{
+		{
+			name: "without if-range",
+			etag: testETag,
+			want: true,
+		},
+		{
+			name:    "etag matched",
+			ifRange: testETag,
+			etag:    testETag,
+			want:    true,
+		},
+		{
+			name:    "etag mismatched",
+			ifRange: `"v0"`,
+			etag:    testETag,
+			want:    false,
+		},
+		{
+			name:    "weak etag never matches",
+			ifRange: `W/"v1"`,
+			etag:    `W/"v1"`,
+			want:    false,
+		},
+		{
+			name:    "etag missing",
+			ifRange: testETag,
+			want:    false,
+		},
+		{
+			name:         "date matched",
+			ifRange:      testLastModified,
+			lastModified: testLastModified,
+			want:         true,
+		},
+		{
+			name:         "date mismatched",
+			ifRange:      testAfter,
+			lastModified: testLastModified,
+			want:         false,
+		},
+		{
+			name:    "date without last-modified",
+			ifRange: testLastModified,
+			want:    false,
+		},
+		{
+			name:         "invalid date",
+			ifRange:      "yesterday",
+			lastModified: testLastModified,
+			want:         false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/1.jpg", nil)
+			req.Header.Set("Range", "bytes=0-99")
+			if tt.ifRange != "" {
+				req.Header.Set("If-Range", tt.ifRange)
+			}
+			assert.Equal(t, tt.want, CheckIfRange(req, tt.etag, tt.lastModified))
+		})
+	}
+}
+
+func TestMatchETag(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		weak   bool
+		want   bool
+	}{
+		{name: "strong equal", header: `"a"`, etag: `"a"`, want: true},
+		{name: "strong different", header: `"a"`, etag: `"b"`, want: false},
+		{name: "strong weak candidate", header: `W/"a"`, etag: `"a"`, want: false},
+		{name: "strong weak etag", header: `"a"`, etag: `W/"a"`, want: false},
+		{name: "strong both weak", header: `W/"a"`, etag: `W/"a"`, want: false},
+		{name: "weak equal", header: `"a"`, etag: `"a"`, weak: true, want: true},
+		{name: "weak weak candidate", header: `W/"a"`, etag: `"a"`, weak: true, want: true},
+		{name: "weak weak etag", header: `"a"`, etag: `W/"a"`, weak: true, want: true},
+		{name: "weak different", header: `W/"a"`, etag: `W/"b"`, weak: true, want: false},
+		{name: "list", header: `"x", "y" ,"a"`, etag: `"a"`, want: true},
+		{name: "list with empty", header: `, ,"a"`, etag: `"a"`, want: true},
+		{name: "any", header: "*", etag: `"a"`, want: true},
+		{name: "any without etag", header: "*", want: true},
+		{name: "without etag", header: `"a"`, want: false},
+		{name: "empty header", header: "", etag: `"a"`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchETag(tt.header, tt.etag, tt.weak))
+		})
+	}
+}
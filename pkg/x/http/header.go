@@ -124,40 +124,97 @@ func IsChunked(h http.Header) bool {
 	return h.Get("Transfer-Encoding") == "chunked" || h.Get("Content-Length") == ""
 }
 
+// The targeted cache-control fields of the CDN, removed before the responses go to the clients.
+const (
+	CDNCacheControlKey  = "CDN-Cache-Control" // RFC 9213
+	SurrogateControlKey = "Surrogate-Control" // Edge Architecture Specification
+)
+
+// EdgeCacheControl returns the directives of the cache in order of precedence:
+// CDN-Cache-Control, Surrogate-Control, Cache-Control.
+//
+// targeted reports whether the directives are from the targeted fields, then the Cache-Control and Expires are ignored.
+func EdgeCacheControl(src http.Header) (ctrl cachecontrol.CacheControl, targeted bool) {
+	for _, key := range []string{CDNCacheControlKey, SurrogateControlKey} {
+		if v := src.Get(key); v != "" {
+			return cachecontrol.Parse(v), true
+		}
+	}
+	return cachecontrol.Parse(src.Get("Cache-Control")), false
+}
+
+// RemoveEdgeCacheControl removes the targeted cache-control fields.
+func RemoveEdgeCacheControl(h http.Header) {
+	h.Del(CDNCacheControlKey)
+	h.Del(SurrogateControlKey)
+}
+
 // ParseCacheTime parses cache time from HTTP headers.
 //
-// If withKey is empty, it will parse from standard Cache-Control and Expires headers.
+// If withKey is empty, it will parse the freshness lifetime in order of CDN-Cache-Control, Surrogate-Control,
+// then s-maxage, max-age of Cache-Control and Expires headers, the response without explicit
+// expiration uses the heuristic freshness. (RFC 9111 4.2.1)
+//
+// the `no-cache` response is stored as stale, so it is always revalidated.
 // If withKey is provided, it will look for that specific header key to determine cache time.
 //
 // It returns the parsed cache duration and a boolean indicating whether caching is allowed.
 func ParseCacheTime(withKey string, src http.Header) (time.Duration, bool) {
 	if withKey == "" {
+		if ctrl, targeted := EdgeCacheControl(src); targeted {
+			return parseTargetedCacheTime(ctrl, src)
+		}
+
 		hcc := src.Get("Cache-Control")
 		expire := src.Get("Expires")
 
 		if hcc == "" && expire == "" {
-			return DefaultProtocolCacheTime, true
+			return HeuristicFreshness(src), true
 		}
 
 		ctrl := cachecontrol.Parse(hcc)
 
-		if ctrl.MaxAge() > 0 {
+		// the per-user or not storable response, never in the shared cache.
+		if private, _ := ctrl.Private(); private || ctrl.NoStore() {
+			return 0, false
+		}
+
+		if noCache, _ := ctrl.NoCache(); noCache {
+			return 0, true
+		}
+
+		// shared cache, s-maxage overrides max-age, even the zero one.
+		if ctrl.SMaxAge() > 0 {
+			return ctrl.SMaxAge(), true
+		}
+		if ctrl.MaxAge() > 0 && ctrl.SMaxAge() < 0 {
 			return ctrl.MaxAge(), true
 		}
+		// stored as stale, revalidated on every request.
+		if ctrl.SMaxAge() == 0 || ctrl.MaxAge() == 0 {
+			return 0, ctrl.Cacheable()
+		}
 
 		if expire != "" {
-			if t, err := time.Parse(time.RFC1123, expire); err == nil {
+			if t, err := http.ParseTime(expire); err == nil {
 				// use the server time from the Date header to calculate
-				return time.Until(t), true
+				if date, err1 := http.ParseTime(src.Get("Date")); err1 == nil {
+					return max(t.Sub(date), 0), true
+				}
+				return max(time.Until(t), 0), true
 			}
 		}
 
+		// `public` without the explicit expiration is heuristically cacheable.
+		if noCache, _ := ctrl.NoCache(); ctrl.Public() && !noCache {
+			return HeuristicFreshness(src), true
+		}
+
 		if !ctrl.Cacheable() {
 			return 0, false
 		}
 
-		// default cache time
-		return DefaultProtocolCacheTime, true
+		return HeuristicFreshness(src), true
 	}
 
 	str := src.Get(withKey)
@@ -170,3 +227,114 @@ func ParseCacheTime(withKey string, src http.Header) (time.Duration, bool) {
 
 	return time.Duration(ct) * time.Second, true
 }
+
+// parseTargetedCacheTime parses the CDN-Cache-Control or Surrogate-Control directives.
+func parseTargetedCacheTime(ctrl cachecontrol.CacheControl, src http.Header) (time.Duration, bool) {
+	if ok, _ := ctrl.Private(); ok || ctrl.NoStore() {
+		return 0, false
+	}
+	// Surrogate-Control, the remote surrogates must not store.
+	if _, ok := ctrl["no-store-remote"]; ok {
+		return 0, false
+	}
+	if ok, _ := ctrl.NoCache(); ok {
+		return 0, true
+	}
+
+	if ctrl.SMaxAge() >= 0 {
+		return ctrl.SMaxAge(), true
+	}
+	if ctrl.MaxAge() >= 0 {
+		return ctrl.MaxAge(), true
+	}
+	return HeuristicFreshness(src), true
+}
+
+const (
+	// HeuristicFraction is the fraction of the Last-Modified age used as the heuristic freshness.
+	HeuristicFraction = 10
+	// HeuristicMaxCacheTime caps the heuristic freshness.
+	HeuristicMaxCacheTime = 24 * time.Hour
+)
+
+// HeuristicFreshness returns 10% of the time since the Last-Modified, capped by HeuristicMaxCacheTime,
+// the response without Last-Modified uses DefaultProtocolCacheTime. (RFC 9111 4.2.2)
+func HeuristicFreshness(src http.Header) time.Duration {
+	lm, err := http.ParseTime(src.Get("Last-Modified"))
+	if err != nil {
+		return DefaultProtocolCacheTime
+	}
+
+	date, err := http.ParseTime(src.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+
+	if !lm.Before(date) {
+		return 0
+	}
+	return min(date.Sub(lm)/HeuristicFraction, HeuristicMaxCacheTime)
+}
+
+// CorrectedInitialAge returns the age of the response when it is received, includes the
+// upstream Age and the response delay. (RFC 9111 4.2.3)
+//
+//	apparent_age = max(0, response_time - date_value)
+//	corrected_age_value = age_value + (response_time - request_time)
+//	corrected_initial_age = max(apparent_age, corrected_age_value)
+func CorrectedInitialAge(src http.Header, requestTime, responseTime time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, err := http.ParseTime(src.Get("Date")); err == nil {
+		apparentAge = max(responseTime.Sub(date), 0)
+	}
+
+	var ageValue time.Duration
+	if age, err := strconv.ParseInt(strings.TrimSpace(src.Get("Age")), 10, 64); err == nil && age > 0 {
+		ageValue = time.Duration(age) * time.Second
+	}
+
+	correctedAgeValue := ageValue + max(responseTime.Sub(requestTime), 0)
+	return max(apparentAge, correctedAgeValue).Truncate(time.Second)
+}
+
+// UpdateStoredHeader merges the header fields of the 304 or HEAD response into the
+// stored header, replacing the values already present. (RFC 9111 3.2, 4.3.4)
+//
+// Content-Length and the framing fields are not updated, `excludeKeys` are skipped too.
+func UpdateStoredHeader(stored, src http.Header, excludeKeys ...string) {
+	skip := []string{"Content-Length", "Content-Range", "Transfer-Encoding"}
+	skip = append(skip, hopHeaders...)
+	skip = append(skip, excludeKeys...)
+
+	for k, vv := range src {
+		if slices.ContainsFunc(skip, func(key string) bool { return textproto.CanonicalMIMEHeaderKey(key) == k }) {
+			continue
+		}
+		stored[k] = slices.Clone(vv)
+	}
+}
+
+// MaxSurrogateKeys is the max surrogate keys of a response, the rest are dropped.
+const MaxSurrogateKeys = 64
+
+// ParseSurrogateKeys parses the `Surrogate-Key` (space separated) or `Cache-Tag` (comma separated)
+// header values, the duplicate keys are removed.
+//
+//	Surrogate-Key: product-123 category-7
+//	Cache-Tag: product-123,category-7
+func ParseSurrogateKeys(values []string) []string {
+	keys := make([]string, 0, len(values))
+	for _, v := range values {
+		for _, key := range strings.FieldsFunc(v, func(r rune) bool {
+			return r == ' ' || r == ',' || r == '\t'
+		}) {
+			if len(keys) >= MaxSurrogateKeys {
+				return keys
+			}
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
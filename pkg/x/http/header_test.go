@@ -0,0 +1,395 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrectedInitialAge(t *testing.T) {
+	requestTime := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		date         string
+		age          string
+		responseTime time.Time
+		want         time.Duration
+	}{
+		{
+			name:         "fresh from origin",
+			date:         requestTime.Format(http.TimeFormat),
+			responseTime: requestTime,
+			want:         0,
+		},
+		{
+			name:         "upstream age",
+			date:         requestTime.Format(http.TimeFormat),
+			age:          "60",
+			responseTime: requestTime,
+			want:         60 * time.Second,
+		},
+		{
+			name:         "upstream age with response delay",
+			date:         requestTime.Format(http.TimeFormat),
+			age:          "60",
+			responseTime: requestTime.Add(2 * time.Second),
+			want:         62 * time.Second,
+		},
+		{
+			name:         "apparent age greater than the age value",
+			date:         requestTime.Add(-5 * time.Minute).Format(http.TimeFormat),
+			age:          "60",
+			responseTime: requestTime,
+			want:         5 * time.Minute,
+		},
+		{
+			name:         "date in the future",
+			date:         requestTime.Add(time.Hour).Format(http.TimeFormat),
+			responseTime: requestTime,
+			want:         0,
+		},
+		{
+			name:         "invalid age",
+			date:         requestTime.Format(http.TimeFormat),
+			age:          "-10",
+			responseTime: requestTime,
+			want:         0,
+		},
+		{
+			name:         "without date",
+			age:          " 30 ",
+			responseTime: requestTime.Add(1500 * time.Millisecond),
+			want:         31 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := make(http.Header)
+			if tt.date != "" {
+				h.Set("Date", tt.date)
+			}
+			if tt.age != "" {
+				h.Set("Age", tt.age)
+			}
+			assert.Equal(t, tt.want, CorrectedInitialAge(h, requestTime, tt.responseTime))
+		})
+	}
+}
+
+func TestHeuristicFreshness(t *testing.T) {
+	date := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		lastModified string
+		date         string
+		want         time.Duration
+	}{
+		{
+			name: "without last-modified",
+			date: date.Format(http.TimeFormat),
+			want: DefaultProtocolCacheTime,
+		},
+		{
+			name:         "invalid last-modified",
+			lastModified: "yesterday",
+			date:         date.Format(http.TimeFormat),
+			want:         DefaultProtocolCacheTime,
+		},
+		{
+			name:         "10% of the last-modified age",
+			lastModified: date.Add(-10 * time.Hour).Format(http.TimeFormat),
+			date:         date.Format(http.TimeFormat),
+			want:         time.Hour,
+		},
+		{
+			name:         "capped",
+			lastModified: date.Add(-365 * 24 * time.Hour).Format(http.TimeFormat),
+			date:         date.Format(http.TimeFormat),
+			want:         HeuristicMaxCacheTime,
+		},
+		{
+			name:         "modified in the future",
+			lastModified: date.Add(time.Hour).Format(http.TimeFormat),
+			date:         date.Format(http.TimeFormat),
+			want:         0,
+		},
+		{
+			name:         "without date",
+			lastModified: time.Now().Add(-30 * 24 * time.Hour).Format(http.TimeFormat),
+			want:         HeuristicMaxCacheTime,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := make(http.Header)
+			if tt.lastModified != "" {
+				h.Set("Last-Modified", tt.lastModified)
+			}
+			if tt.date != "" {
+				h.Set("Date", tt.date)
+			}
+			assert.Equal(t, tt.want, HeuristicFreshness(h))
+		})
+	}
+}
+
+func TestParseCacheTimeHeuristic(t *testing.T) {
+	date := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	lastModified := date.Add(-10 * time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{
+			name:   "without explicit expiration",
+			header: http.Header{"Last-Modified": {lastModified}},
+			want:   time.Hour,
+			ok:     true,
+		},
+		{
+			name:   "public without explicit expiration",
+			header: http.Header{"Cache-Control": {"public"}, "Last-Modified": {lastModified}},
+			want:   time.Hour,
+			ok:     true,
+		},
+		{
+			name:   "explicit max-age",
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Last-Modified": {lastModified}},
+			want:   time.Minute,
+			ok:     true,
+		},
+		{
+			name:   "not cacheable",
+			header: http.Header{"Cache-Control": {"private"}, "Last-Modified": {lastModified}},
+			want:   0,
+			ok:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.header.Set("Date", date.Format(http.TimeFormat))
+			got, ok := ParseCacheTime("", tt.header)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.ok, ok)
+		})
+	}
+}
+
+func TestUpdateStoredHeader(t *testing.T) {
+	stored := http.Header{
+		"Etag":           {`"v1"`},
+		"Cache-Control":  {"max-age=60"},
+		"Content-Length": {"100"},
+		"X-Origin":       {"a"},
+	}
+	UpdateStoredHeader(stored, http.Header{
+		"Cache-Control":  {"max-age=3600"},
+		"Content-Length": {"0"},
+		"Connection":     {"close"},
+		"Date":           {"Mon, 02 Jan 2006 15:04:05 GMT"},
+		"X-Skip":         {"b"},
+	}, "X-Skip")
+
+	assert.Equal(t, "max-age=3600", stored.Get("Cache-Control"))
+	assert.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", stored.Get("Date"))
+	assert.Equal(t, "100", stored.Get("Content-Length"))
+	assert.Equal(t, `"v1"`, stored.Get("ETag"))
+	assert.Equal(t, "a", stored.Get("X-Origin"))
+	assert.Empty(t, stored.Get("Connection"))
+	assert.Empty(t, stored.Get("X-Skip"))
+}
+
+func TestParseCacheTimePrecedence(t *testing.T) {
+	date := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{
+			name: "cdn-cache-control first",
+			header: http.Header{
+				"Cdn-Cache-Control": {"max-age=10"},
+				"Surrogate-Control": {"max-age=20"},
+				"Cache-Control":     {"s-maxage=30, max-age=40"},
+			},
+			want: 10 * time.Second,
+			ok:   true,
+		},
+		{
+			name: "surrogate-control over cache-control",
+			header: http.Header{
+				"Surrogate-Control": {"max-age=20"},
+				"Cache-Control":     {"s-maxage=30, max-age=40"},
+			},
+			want: 20 * time.Second,
+			ok:   true,
+		},
+		{
+			name:   "surrogate-control stale part ignored",
+			header: http.Header{"Surrogate-Control": {"max-age=300+60"}},
+			want:   300 * time.Second,
+			ok:     true,
+		},
+		{
+			name:   "targeted s-maxage over max-age",
+			header: http.Header{"Cdn-Cache-Control": {"s-maxage=5, max-age=10"}},
+			want:   5 * time.Second,
+			ok:     true,
+		},
+		{
+			name:   "targeted zero max-age",
+			header: http.Header{"Cdn-Cache-Control": {"max-age=0"}, "Cache-Control": {"max-age=60"}},
+			want:   0,
+			ok:     true,
+		},
+		{
+			name:   "targeted no-store wins over cache-control",
+			header: http.Header{"Cdn-Cache-Control": {"no-store"}, "Cache-Control": {"max-age=60"}},
+			want:   0,
+			ok:     false,
+		},
+		{
+			name:   "targeted private",
+			header: http.Header{"Cdn-Cache-Control": {"private"}},
+			want:   0,
+			ok:     false,
+		},
+		{
+			name:   "surrogate no-store-remote",
+			header: http.Header{"Surrogate-Control": {"no-store-remote"}},
+			want:   0,
+			ok:     false,
+		},
+		{
+			name:   "targeted no-cache is stored as stale",
+			header: http.Header{"Cdn-Cache-Control": {"no-cache"}},
+			want:   0,
+			ok:     true,
+		},
+		{
+			name:   "targeted private cache-control ignored",
+			header: http.Header{"Cdn-Cache-Control": {"max-age=10"}, "Cache-Control": {"private, no-store"}},
+			want:   10 * time.Second,
+			ok:     true,
+		},
+		{
+			name: "targeted expires ignored",
+			header: http.Header{
+				"Cdn-Cache-Control": {"max-age=10"},
+				"Expires":           {date.Add(time.Hour).Format(http.TimeFormat)},
+			},
+			want: 10 * time.Second,
+			ok:   true,
+		},
+		{
+			name: "targeted without the age is heuristic",
+			header: http.Header{
+				"Cdn-Cache-Control": {"public"},
+				"Last-Modified":     {date.Add(-10 * time.Hour).Format(http.TimeFormat)},
+			},
+			want: time.Hour,
+			ok:   true,
+		},
+		{
+			name:   "s-maxage over max-age",
+			header: http.Header{"Cache-Control": {"s-maxage=30, max-age=40"}},
+			want:   30 * time.Second,
+			ok:     true,
+		},
+		{
+			name:   "zero s-maxage over max-age",
+			header: http.Header{"Cache-Control": {"s-maxage=0, max-age=40"}},
+			want:   0,
+			ok:     true,
+		},
+		{
+			name:   "max-age",
+			header: http.Header{"Cache-Control": {"max-age=40"}},
+			want:   40 * time.Second,
+			ok:     true,
+		},
+		{
+			name: "max-age over expires",
+			header: http.Header{
+				"Cache-Control": {"max-age=40"},
+				"Expires":       {date.Add(time.Hour).Format(http.TimeFormat)},
+			},
+			want: 40 * time.Second,
+			ok:   true,
+		},
+		{
+			name:   "expires from the date",
+			header: http.Header{"Expires": {date.Add(time.Hour).Format(http.TimeFormat)}},
+			want:   time.Hour,
+			ok:     true,
+		},
+		{
+			name:   "no-cache is stored as stale",
+			header: http.Header{"Cache-Control": {"no-cache"}},
+			want:   0,
+			ok:     true,
+		},
+		{
+			name:   "no-store",
+			header: http.Header{"Cache-Control": {"no-store"}},
+			want:   0,
+			ok:     false,
+		},
+		{
+			name:   "private no-cache is not stored",
+			header: http.Header{"Cache-Control": {"private, no-cache"}},
+			want:   0,
+			ok:     false,
+		},
+		{
+			name:   "private s-maxage is not stored",
+			header: http.Header{"Cache-Control": {"private, s-maxage=60"}},
+			want:   0,
+			ok:     false,
+		},
+		{
+			name:   "no-store no-cache is not stored",
+			header: http.Header{"Cache-Control": {"no-store, no-cache, max-age=60"}},
+			want:   0,
+			ok:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.header.Set("Date", date.Format(http.TimeFormat))
+			got, ok := ParseCacheTime("", tt.header)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.ok, ok)
+		})
+	}
+}
+
+func TestRemoveEdgeCacheControl(t *testing.T) {
+	h := http.Header{
+		"Cdn-Cache-Control": {"max-age=10"},
+		"Surrogate-Control": {"max-age=20"},
+		"Cache-Control":     {"max-age=30"},
+	}
+
+	ctrl, targeted := EdgeCacheControl(h)
+	assert.True(t, targeted)
+	assert.Equal(t, 10*time.Second, ctrl.MaxAge())
+
+	RemoveEdgeCacheControl(h)
+	assert.Empty(t, h.Get(CDNCacheControlKey))
+	assert.Empty(t, h.Get(SurrogateControlKey))
+
+	ctrl, targeted = EdgeCacheControl(h)
+	assert.False(t, targeted)
+	assert.Equal(t, 30*time.Second, ctrl.MaxAge())
+}
@@ -0,0 +1,27 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/goccy/go-json"
+)
+
+// WriteJSON writes v as the JSON response body with the status code.
+func WriteJSON(w http.ResponseWriter, code int, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		code = http.StatusInternalServerError
+		payload, _ = json.Marshal(map[string]string{"message": err.Error()})
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = w.Write(payload)
+}
+
+// WriteJSONError writes a `{"message": "..."}` JSON response with the status code.
+func WriteJSONError(w http.ResponseWriter, code int, message string) {
+	WriteJSON(w, code, map[string]string{"message": message})
+}
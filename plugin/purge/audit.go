@@ -0,0 +1,143 @@
+package purge
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	AuditDenied   = "denied"   // the request is rejected by the allowlist or signature
+	AuditPurged   = "purged"   // single url purged synchronously
+	AuditQueued   = "queued"   // purge tasks queued
+	AuditFinished = "finished" // the queued task finished
+)
+
+// AuditEntry is a line of the purge audit log.
+type AuditEntry struct {
+	Time    int64    `json:"time"`
+	Event   string   `json:"event"`
+	Client  string   `json:"client"`
+	Key     string   `json:"key,omitempty"` // key id of the signed request
+	URL     string   `json:"url"`
+	Type    string   `json:"type,omitempty"`
+	Tag     string   `json:"tag,omitempty"`
+	Match   string   `json:"match,omitempty"`
+	Tasks   []string `json:"tasks,omitempty"`
+	Status  int      `json:"status,omitempty"`
+	Removed int      `json:"removed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// auditFilter is the query of the audit log, the empty fields match all.
+type auditFilter struct {
+	Since  int64
+	Event  string
+	Client string
+	Key    string
+	URL    string // substring of the url
+	Task   string
+}
+
+func (f *auditFilter) match(e *AuditEntry) bool {
+	switch {
+	case e.Time < f.Since:
+		return false
+	case f.Event != "" && e.Event != f.Event:
+		return false
+	case f.Client != "" && e.Client != f.Client:
+		return false
+	case f.Key != "" && e.Key != f.Key:
+		return false
+	case f.URL != "" && !strings.Contains(e.URL, f.URL):
+		return false
+	case f.Task != "" && !slices.Contains(e.Tasks, f.Task):
+		return false
+	}
+	return true
+}
+
+// auditLog appends the purge records as json lines to `log_path`, nil auditLog drops all.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, f: f}, nil
+}
+
+func (a *auditLog) Record(e *AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, err = a.f.Write(append(buf, '\n'))
+	return err
+}
+
+// Query returns the latest `limit` entries matched the filter, oldest first.
+func (a *auditLog) Query(filter *auditFilter, limit int) ([]*AuditEntry, error) {
+	entries := make([]*AuditEntry, 0)
+	if a == nil {
+		return entries, nil
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil || !filter.match(e) {
+			continue
+		}
+
+		// keep the latest `limit` entries.
+		if len(entries) >= limit {
+			entries = append(entries[1:], e)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
@@ -0,0 +1,233 @@
+package purge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KeyHeader       = "Purge-Key"       // key id of the signing secret
+	TimestampHeader = "Purge-Timestamp" // unix seconds of the signing time
+	SignatureHeader = "Purge-Signature" // hex HMAC-SHA256 of the canonical request
+)
+
+var (
+	ErrForbidden        = errors.New("purge not allowed from the address")
+	ErrSignatureMissing = errors.New("purge signature required")
+	ErrSignatureInvalid = errors.New("invalid purge signature")
+	ErrSignatureExpired = errors.New("purge signature expired")
+	ErrSignatureReplay  = errors.New("purge signature replayed")
+)
+
+// authorizer checks the purge requests by the source address allowlist and the HMAC signature.
+//
+// a signed request is authorized by its key only, an invalid signature is never
+// fallback to the allowlist.
+type authorizer struct {
+	allow   []netip.Prefix
+	names   map[string]struct{} // the allow_hosts entries not an ip or cidr, compared as is
+	trusted []netip.Prefix      // trusted proxies, the client address is taken from X-Forwarded-For
+
+	headers          [3]string         // signed headers, Purge-Type, Purge-Tag and Purge-Match
+	keys             map[string][]byte // key id -> secret
+	window           time.Duration
+	requireSignature bool
+
+	mu   sync.Mutex
+	seen map[string]int64 // signature -> expires unix, rejects the replayed signatures
+}
+
+func newAuthorizer(opt *option) (*authorizer, error) {
+	a := &authorizer{
+		names:            make(map[string]struct{}),
+		headers:          [3]string{opt.HeaderName, opt.TagHeaderName, opt.MatchHeaderName},
+		keys:             make(map[string][]byte, len(opt.Keys)),
+		window:           time.Duration(opt.ReplayWindow) * time.Second,
+		requireSignature: opt.RequireSignature,
+		seen:             make(map[string]int64),
+	}
+	if a.window <= 0 {
+		a.window = 5 * time.Minute
+	}
+
+	for _, v := range opt.AllowHosts {
+		if v == "localhost" {
+			a.allow = append(a.allow, netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128"))
+			continue
+		}
+		if p, ok := parsePrefix(v); ok {
+			a.allow = append(a.allow, p)
+			continue
+		}
+		a.names[v] = struct{}{}
+	}
+
+	for _, v := range opt.TrustedProxies {
+		p, ok := parsePrefix(v)
+		if !ok {
+			return nil, errors.New("invalid trusted proxy " + strconv.Quote(v))
+		}
+		a.trusted = append(a.trusted, p)
+	}
+
+	for id, secret := range opt.Keys {
+		if secret == "" {
+			return nil, errors.New("empty secret of purge key " + strconv.Quote(id))
+		}
+		a.keys[id] = []byte(secret)
+	}
+
+	if a.requireSignature && len(a.keys) == 0 {
+		return nil, errors.New("require_signature without any keys")
+	}
+	return a, nil
+}
+
+// parsePrefix parses the cidr or the single ip, e.g. `10.0.0.0/8`, `::1`.
+func parsePrefix(v string) (netip.Prefix, bool) {
+	if p, err := netip.ParsePrefix(v); err == nil {
+		return p.Masked(), true
+	}
+	if addr, err := netip.ParseAddr(v); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the client address of the request, the X-Forwarded-For is only
+// trusted if the request comes from the trusted proxies, the rightmost untrusted address wins.
+func (a *authorizer) clientAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !contains(a.trusted, addr.Unmap()) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		hopAddr, err := netip.ParseAddr(hop)
+		if err != nil {
+			// garbage from the untrusted client.
+			return host
+		}
+		if host = hop; !contains(a.trusted, hopAddr.Unmap()) {
+			break
+		}
+	}
+	return host
+}
+
+// authorize returns the client address and the key id of the signed request,
+// the body is the request body read by the caller, nil for the request without body.
+func (a *authorizer) authorize(req *http.Request, storeUrl string, body []byte) (client, key string, err error) {
+	client = a.clientAddr(req)
+
+	if req.Header.Get(SignatureHeader) != "" && len(a.keys) > 0 {
+		key = req.Header.Get(KeyHeader)
+		return client, key, a.verify(req, storeUrl, key, body)
+	}
+
+	if a.requireSignature {
+		return client, "", ErrSignatureMissing
+	}
+
+	if _, ok := a.names[client]; ok {
+		return client, "", nil
+	}
+	if addr, err := netip.ParseAddr(client); err == nil && contains(a.allow, addr.Unmap()) {
+		return client, "", nil
+	}
+	return client, "", ErrForbidden
+}
+
+func (a *authorizer) verify(req *http.Request, storeUrl, key string, body []byte) error {
+	secret, ok := a.keys[key]
+	if !ok {
+		return ErrSignatureInvalid
+	}
+
+	ts := req.Header.Get(TimestampHeader)
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(unix, 0)); d > a.window || d < -a.window {
+		return ErrSignatureExpired
+	}
+
+	sig, err := hex.DecodeString(req.Header.Get(SignatureHeader))
+	if err != nil || !hmac.Equal(sig, Sign(secret, req.Method, storeUrl,
+		signedValue(req, a.headers[0]), signedValue(req, a.headers[1]), signedValue(req, a.headers[2]), ts, body)) {
+		return ErrSignatureInvalid
+	}
+
+	// the signature is valid only once in the replay window.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	nowUnix := now.Unix()
+	if len(a.seen) >= 4096 {
+		for s, expires := range a.seen {
+			if expires < nowUnix {
+				delete(a.seen, s)
+			}
+		}
+	}
+
+	s := string(sig)
+	if expires, ok := a.seen[s]; ok && expires >= nowUnix {
+		return ErrSignatureReplay
+	}
+	a.seen[s] = unix + int64(a.window/time.Second)
+	return nil
+}
+
+// signedValue returns all the values of the signed header joined by comma,
+// so no extra header can be appended to the signed request.
+func signedValue(req *http.Request, name string) string {
+	return strings.Join(req.Header.Values(name), ",")
+}
+
+// Sign returns the HMAC-SHA256 of the canonical purge request:
+//
+//	METHOD \n URL \n Purge-Type \n Purge-Tag \n Purge-Match \n Purge-Timestamp \n hex(SHA256(body))
+//
+// the URL is the purged url, e.g. `http://www.example.com/static/`, the absent headers are empty lines,
+// the multiple values of a header are joined by comma in order.
+// the last line is the hash of the request body, e.g. the items of the batch purge,
+// the request without body is the hash of the empty body.
+func Sign(secret []byte, method, storeUrl, typ, tag, match, timestamp string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{method, storeUrl, typ, tag, match, timestamp, hex.EncodeToString(sum[:])}, "\n")))
+	return mac.Sum(nil)
+}
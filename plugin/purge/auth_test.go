@@ -0,0 +1,188 @@
+package purge
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/omalloc/tavern/contrib/log"
+)
+
+func newTestAuthorizer(t *testing.T, opt *option) *authorizer {
+	if opt.HeaderName == "" {
+		opt.HeaderName, opt.TagHeaderName, opt.MatchHeaderName = "Purge-Type", "Purge-Tag", "Purge-Match"
+	}
+	a, err := newAuthorizer(opt)
+	require.NoError(t, err)
+	return a
+}
+
+// signRequest signs the request with the key `ops` at the time.
+func signRequest(req *http.Request, secret, storeUrl string, at time.Time, body []byte) {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	req.Header.Set(KeyHeader, "ops")
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, hex.EncodeToString(Sign([]byte(secret), req.Method, storeUrl,
+		req.Header.Get("Purge-Type"), req.Header.Get("Purge-Tag"), req.Header.Get("Purge-Match"), ts, body)))
+}
+
+func TestAuthorizeAllowHosts(t *testing.T) {
+	a := newTestAuthorizer(t, &option{
+		AllowHosts:     []string{"localhost", "10.0.0.0/8", "2001:db8::/32", "gateway"},
+		TrustedProxies: []string{"192.168.1.0/24"},
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		client     string
+		err        error
+	}{
+		{name: "loopback", remoteAddr: "127.0.0.1:1234", client: "127.0.0.1"},
+		{name: "cidr", remoteAddr: "10.1.2.3:1234", client: "10.1.2.3"},
+		{name: "ipv6 cidr", remoteAddr: "[2001:db8::1]:1234", client: "2001:db8::1"},
+		{name: "not allowed", remoteAddr: "172.16.0.1:1234", client: "172.16.0.1", err: ErrForbidden},
+		{name: "untrusted xff ignored", remoteAddr: "172.16.0.1:1234", xff: "10.1.2.3", client: "172.16.0.1", err: ErrForbidden},
+		{name: "trusted proxy xff", remoteAddr: "192.168.1.1:1234", xff: "10.1.2.3", client: "10.1.2.3"},
+		{name: "rightmost untrusted hop", remoteAddr: "192.168.1.1:1234", xff: "10.1.2.3, 172.16.0.1, 192.168.1.2", client: "172.16.0.1", err: ErrForbidden},
+		{name: "garbage xff hop", remoteAddr: "192.168.1.1:1234", xff: "10.1.2.3, gateway", client: "192.168.1.1", err: ErrForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(Method, "http://www.example.com/1.jpg", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+
+			client, _, err := a.authorize(req, req.URL.String(), nil)
+			assert.Equal(t, tt.client, client)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestAuthorizeSignature(t *testing.T) {
+	const storeUrl = "/plugin/purge/batch"
+	body := []byte(`["http://www.example.com/1.jpg"]`)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		secret  string
+		at      time.Time
+		mutate  func(req *http.Request)
+		reqBody []byte // the body received, the signed body if nil
+		err     error
+	}{
+		{name: "valid", secret: "secret", at: now},
+		{name: "wrong secret", secret: "other", at: now, err: ErrSignatureInvalid},
+		{name: "expired", secret: "secret", at: now.Add(-10 * time.Minute), err: ErrSignatureExpired},
+		{name: "from the future", secret: "secret", at: now.Add(10 * time.Minute), err: ErrSignatureExpired},
+		{name: "unknown key", secret: "secret", at: now, mutate: func(req *http.Request) { req.Header.Set(KeyHeader, "dev") }, err: ErrSignatureInvalid},
+		{name: "signed header changed", secret: "secret", at: now, mutate: func(req *http.Request) { req.Header.Set("Purge-Type", "dir") }, err: ErrSignatureInvalid},
+		{name: "signed header appended", secret: "secret", at: now, mutate: func(req *http.Request) { req.Header.Add("Purge-Tag", "a") }, err: ErrSignatureInvalid},
+		{name: "body replaced", secret: "secret", at: now, reqBody: []byte(`[{"url":"http://www.example.com/","type":"domain"}]`), err: ErrSignatureInvalid},
+		{name: "body dropped", secret: "secret", at: now, reqBody: []byte{}, err: ErrSignatureInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the signed request is authorized by the key only, not by the allowlist.
+			a := newTestAuthorizer(t, &option{
+				AllowHosts: []string{"localhost"},
+				Keys:       map[string]string{"ops": "secret"},
+			})
+
+			req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:8080"+storeUrl, nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			req.Header.Set("Purge-Tag", "product-123")
+			signRequest(req, tt.secret, storeUrl, tt.at, body)
+			if tt.mutate != nil {
+				tt.mutate(req)
+			}
+
+			received := body
+			if tt.reqBody != nil {
+				received = tt.reqBody
+			}
+			_, _, err := a.authorize(req, storeUrl, received)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestAuthorizeReplay(t *testing.T) {
+	a := newTestAuthorizer(t, &option{Keys: map[string]string{"ops": "secret"}})
+
+	req, _ := http.NewRequest(Method, "http://www.example.com/1.jpg", nil)
+	signRequest(req, "secret", req.URL.String(), time.Now(), nil)
+
+	_, key, err := a.authorize(req, req.URL.String(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "ops", key)
+
+	_, _, err = a.authorize(req, req.URL.String(), nil)
+	assert.ErrorIs(t, err, ErrSignatureReplay)
+}
+
+func TestAuthorizeRequireSignature(t *testing.T) {
+	_, err := newAuthorizer(&option{RequireSignature: true})
+	assert.Error(t, err)
+
+	a := newTestAuthorizer(t, &option{
+		AllowHosts:       []string{"localhost"},
+		Keys:             map[string]string{"ops": "secret"},
+		RequireSignature: true,
+	})
+
+	req, _ := http.NewRequest(Method, "http://www.example.com/1.jpg", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	_, _, err = a.authorize(req, req.URL.String(), nil)
+	assert.ErrorIs(t, err, ErrSignatureMissing)
+}
+
+func TestGuardSignsBody(t *testing.T) {
+	r := &PurgePlugin{
+		log:  log.NewHelper(log.GetLogger()),
+		auth: newTestAuthorizer(t, &option{Keys: map[string]string{"ops": "secret"}}),
+	}
+
+	var received []byte
+	h := r.Guard(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received, _ = io.ReadAll(req.Body)
+	}))
+
+	signed := []byte(`{"host":"www.example.com","url":"\\.jpg$"}`)
+	for _, tt := range []struct {
+		name string
+		body []byte
+		code int
+	}{
+		{name: "signed body", body: signed, code: http.StatusOK},
+		{name: "replaced body", body: []byte(`{"host":"www.example.com","url":".*"}`), code: http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			received = nil
+			req := httptest.NewRequest(http.MethodPost, "/cache/bans", bytes.NewReader(tt.body))
+			signRequest(req, "secret", "/cache/bans", time.Now(), signed)
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, signed, received)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package purge
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"golang.org/x/sync/semaphore"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
+	"github.com/omalloc/tavern/storage"
+)
+
+const (
+	maxBatchItems      = 10000
+	maxBatchBody       = 8 << 20
+	defaultConcurrency = 8
+	maxConcurrency     = 64
+)
+
+const (
+	BatchRemoved  = "removed"
+	BatchNotFound = "not_found"
+	BatchQueued   = "queued"
+	BatchError    = "error"
+)
+
+// BatchItem is an entry of the batch purge, the plain json string is the url of the hard purge.
+//
+// e.g.
+//
+//	"http://www.example.com/1.jpg"
+//	{"url":"http://www.example.com/static/","type":"dir,soft"}
+//	{"url":"http://www.example.com/","type":"tag","tag":"product-123"}
+//	{"url":"http://www.example.com/","type":"domain"}
+//	{"url":"http://www.example.com/","type":"regex","match":"^http://www.example.com/v[0-9]+/"}
+//	{"url":"http://www.example.com/1.jpg","vkey":"gzip"}
+//
+// the url purge removes the url and all the vary variants, `vkey` only removes the variant.
+type BatchItem struct {
+	URL   string `json:"url"`
+	Type  string `json:"type,omitempty"` // same as the `Purge-Type` header, e.g. dir, tag, regex, glob, soft, refresh
+	Tag   string `json:"tag,omitempty"`
+	Match string `json:"match,omitempty"`
+	VKey  string `json:"vkey,omitempty"`
+}
+
+func (i *BatchItem) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &i.URL)
+	}
+
+	type alias BatchItem
+	return json.Unmarshal(data, (*alias)(i))
+}
+
+// BatchResult is the result of the deduplicated item.
+type BatchResult struct {
+	BatchItem
+	Status  string `json:"status"`
+	Removed int    `json:"removed"`
+	Task    string `json:"task,omitempty"` // the queued task of the dir, domain, tag and pattern purge
+	Error   string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Total    int            `json:"total"`
+	Unique   int            `json:"unique"`
+	Removed  int            `json:"removed"`
+	NotFound int            `json:"not_found"`
+	Queued   int            `json:"queued"`
+	Failed   int            `json:"failed"`
+	Results  []*BatchResult `json:"results"`
+}
+
+// batchJob is the parsed item.
+type batchJob struct {
+	result  *BatchResult
+	url     string
+	control storagev1.PurgeControl
+	refresh bool
+}
+
+func (j *batchJob) dedupKey() string {
+	c := j.control
+	return fmt.Sprintf("%t/%t/%t/%t/%t/%s/%s/%s/%s", c.Dir, c.Domain, c.Hard, c.MarkExpired, j.refresh, c.Tag, c.Match, c.VirtualKey, j.url)
+}
+
+// scan reports whether the job scans the objects, which runs on the rate limited queue.
+func (j *batchJob) scan() bool {
+	c := j.control
+	return c.Dir || c.Domain || c.Tag != "" || c.Match != ""
+}
+
+// handleBatch purges the json array of items, the urls are purged with bounded concurrency
+// and the dir, domain, tag and pattern purges are queued, e.g.
+//
+//	curl -X POST 'http://127.0.0.1:8080/plugin/purge/batch?concurrency=16' \
+//	  -d '["http://www.example.com/1.jpg", {"url":"http://www.example.com/static/","type":"dir,soft"}]'
+func (r *PurgePlugin) handleBatch(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Device-Plugin", "purger")
+
+	// the body is read once and signed with the request uri, the items can not be replaced.
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBatchBody))
+	if err != nil {
+		xhttp.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the batch is authorized as a whole.
+	client, key, err := r.auth.authorize(req, req.URL.RequestURI(), body)
+	if err != nil {
+		r.log.Warnf("batch purge request %s key %q denied: %v", client, key, err)
+		r.record(&AuditEntry{
+			Time:   time.Now().Unix(),
+			Event:  AuditDenied,
+			Client: client,
+			Key:    key,
+			URL:    req.URL.RequestURI(),
+			Status: http.StatusForbidden,
+			Error:  err.Error(),
+		})
+		xhttp.WriteJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	items := make([]BatchItem, 0)
+	if err := json.Unmarshal(body, &items); err != nil {
+		xhttp.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(items) == 0 {
+		xhttp.WriteJSONError(w, http.StatusBadRequest, "empty purge items")
+		return
+	}
+	if len(items) > maxBatchItems {
+		xhttp.WriteJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("too many purge items, max %d", maxBatchItems))
+		return
+	}
+
+	concurrency, _ := strconv.Atoi(req.URL.Query().Get("concurrency"))
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	concurrency = min(concurrency, maxConcurrency)
+
+	resp := &batchResponse{
+		Total:   len(items),
+		Results: make([]*BatchResult, 0, len(items)),
+	}
+
+	// dedup, the results are in the order of the first appearance.
+	jobs := make([]*batchJob, 0, len(items))
+	seen := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		job := r.parseBatchItem(item)
+		if job.result.Status == "" {
+			k := job.dedupKey()
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			jobs = append(jobs, job)
+		}
+		resp.Results = append(resp.Results, job.result)
+	}
+	resp.Unique = len(jobs)
+
+	ctx := req.Context()
+	current := storage.Current()
+	sem := semaphore.NewWeighted(int64(concurrency))
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		if job.scan() {
+			r.enqueueBatchJob(req, job, client, key)
+			continue
+		}
+
+		if err := sem.Acquire(ctx, 1); err != nil {
+			// client gone, the rest are not purged.
+			job.result.Status, job.result.Error = BatchError, err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func(job *batchJob) {
+			defer wg.Done()
+			defer sem.Release(1)
+			r.runBatchJob(current, job)
+		}(job)
+	}
+	wg.Wait()
+
+	for _, job := range jobs {
+		entry := &AuditEntry{
+			Time:    time.Now().Unix(),
+			Event:   AuditPurged,
+			Client:  client,
+			Key:     key,
+			URL:     job.url,
+			Type:    job.result.Type,
+			Tag:     job.result.Tag,
+			Match:   job.result.Match,
+			Removed: job.result.Removed,
+			Error:   job.result.Error,
+		}
+		if job.result.Task != "" {
+			entry.Event, entry.Tasks = AuditQueued, []string{job.result.Task}
+		}
+		r.record(entry)
+	}
+
+	for _, res := range resp.Results {
+		switch res.Status {
+		case BatchRemoved:
+			resp.Removed += res.Removed
+		case BatchNotFound:
+			resp.NotFound++
+		case BatchQueued:
+			resp.Queued++
+		default:
+			resp.Failed++
+		}
+	}
+
+	xhttp.WriteJSON(w, http.StatusOK, resp)
+}
+
+// parseBatchItem validates the item, the invalid item has the error result.
+func (r *PurgePlugin) parseBatchItem(item BatchItem) *batchJob {
+	typ := parsePurgeType(item.Type)
+	job := &batchJob{
+		result:  &BatchResult{BatchItem: item},
+		url:     item.URL,
+		refresh: typ.soft && typ.refresh,
+		control: storagev1.PurgeControl{
+			Hard:        !typ.soft,
+			Dir:         typ.dir,
+			Domain:      typ.domain,
+			MarkExpired: typ.soft,
+			VirtualKey:  item.VKey,
+		},
+	}
+
+	fail := func(msg string) *batchJob {
+		job.result.Status, job.result.Error = BatchError, msg
+		return job
+	}
+
+	u, err := url.Parse(item.URL)
+	if err != nil || u.Host == "" {
+		return fail("invalid purge url")
+	}
+
+	switch {
+	case typ.domain:
+		job.control.Dir = false
+		job.url = fmt.Sprintf("%s://%s/", u.Scheme, u.Host)
+	case typ.tag:
+		if item.Tag == "" {
+			return fail("missing purge tag")
+		}
+		job.control.Dir = false
+		job.control.Tag = item.Tag
+	case typ.regex || typ.glob:
+		job.control.Dir = false
+		job.control.Match = item.Match
+		if typ.glob {
+			job.control.Match = globToRegexp(item.URL)
+		}
+		if _, err = regexp.Compile(job.control.Match); err != nil || job.control.Match == "" {
+			return fail(fmt.Sprintf("invalid purge pattern %q", job.control.Match))
+		}
+	}
+
+	if item.VKey != "" && (job.control.Dir || job.control.Domain || job.control.Tag != "" || job.control.Match != "") {
+		return fail("vkey only applies to the url purge")
+	}
+	return job
+}
+
+// enqueueBatchJob adds the scanning job to the purge queue, the soft purged objects are refreshed after the task.
+func (r *PurgePlugin) enqueueBatchJob(req *http.Request, job *batchJob, client, key string) {
+	c := job.control
+	task, _, err := r.queue.Enqueue(req.Context(), &Task{
+		URL:         job.url,
+		Dir:         c.Dir,
+		Domain:      c.Domain,
+		Hard:        c.Hard,
+		MarkExpired: c.MarkExpired,
+		Tag:         c.Tag,
+		Match:       c.Match,
+		Refresh:     job.refresh,
+		Client:      client,
+		Key:         key,
+	})
+	if err != nil {
+		job.result.Status, job.result.Error = BatchError, err.Error()
+		return
+	}
+	job.result.Status, job.result.Task = BatchQueued, task.ID
+}
+
+func (r *PurgePlugin) runBatchJob(current storagev1.Storage, job *batchJob) {
+	n, err := current.PURGE(job.url, job.control)
+	job.result.Removed = n
+
+	switch {
+	case err == nil:
+		job.result.Status = BatchRemoved
+	case errors.Is(err, storagev1.ErrKeyNotFound):
+		job.result.Status = BatchNotFound
+		return
+	default:
+		r.log.Errorf("batch purge %s failed: %v", job.url, err)
+		job.result.Status, job.result.Error = BatchError, err.Error()
+		return
+	}
+
+	if !job.refresh {
+		return
+	}
+
+	r.refresher.Refresh(job.url)
+}
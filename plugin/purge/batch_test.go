@@ -0,0 +1,244 @@
+package purge
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage/sharedkv"
+)
+
+// newTestPlugin returns the purge plugin allowing the loopback clients, the queue is not started.
+func newTestPlugin(t *testing.T) *PurgePlugin {
+	helper := log.NewHelper(log.GetLogger())
+	purge := func(string, storagev1.PurgeControl) (int, error) { return 0, nil }
+	return &PurgePlugin{
+		log:       helper,
+		opt:       &option{HeaderName: "Purge-Type", TagHeaderName: "Purge-Tag", MatchHeaderName: "Purge-Match"},
+		auth:      newTestAuthorizer(t, &option{AllowHosts: []string{"localhost"}}),
+		queue:     newQueue(sharedkv.NewMemSharedKV(), purge, 0, 0, helper),
+		refresher: newRefresher(helper),
+	}
+}
+
+func TestParseBatchItem(t *testing.T) {
+	r := &PurgePlugin{}
+
+	tests := []struct {
+		name    string
+		item    BatchItem
+		url     string
+		control storagev1.PurgeControl
+		refresh bool
+		err     string
+	}{
+		{
+			name:    "url",
+			item:    BatchItem{URL: "http://www.example.com/1.jpg"},
+			url:     "http://www.example.com/1.jpg",
+			control: storagev1.PurgeControl{Hard: true},
+		},
+		{
+			name:    "url vkey",
+			item:    BatchItem{URL: "http://www.example.com/1.jpg", VKey: "gzip"},
+			url:     "http://www.example.com/1.jpg",
+			control: storagev1.PurgeControl{Hard: true, VirtualKey: "gzip"},
+		},
+		{
+			name:    "soft dir",
+			item:    BatchItem{URL: "http://www.example.com/static/", Type: "dir,soft"},
+			url:     "http://www.example.com/static/",
+			control: storagev1.PurgeControl{Dir: true, MarkExpired: true},
+		},
+		{
+			name:    "soft refresh",
+			item:    BatchItem{URL: "http://www.example.com/1.jpg", Type: "soft, refresh"},
+			url:     "http://www.example.com/1.jpg",
+			control: storagev1.PurgeControl{MarkExpired: true},
+			refresh: true,
+		},
+		{
+			name:    "refresh of hard purge ignored",
+			item:    BatchItem{URL: "http://www.example.com/1.jpg", Type: "refresh"},
+			url:     "http://www.example.com/1.jpg",
+			control: storagev1.PurgeControl{Hard: true},
+		},
+		{
+			name:    "domain",
+			item:    BatchItem{URL: "https://www.example.com/path/1.jpg", Type: "domain,dir"},
+			url:     "https://www.example.com/",
+			control: storagev1.PurgeControl{Hard: true, Domain: true},
+		},
+		{
+			name:    "tag",
+			item:    BatchItem{URL: "http://www.example.com/", Type: "tag", Tag: "product-123"},
+			url:     "http://www.example.com/",
+			control: storagev1.PurgeControl{Hard: true, Tag: "product-123"},
+		},
+		{
+			name:    "regex",
+			item:    BatchItem{URL: "http://www.example.com/", Type: "regex", Match: "^http://www.example.com/v[0-9]+/"},
+			url:     "http://www.example.com/",
+			control: storagev1.PurgeControl{Hard: true, Match: "^http://www.example.com/v[0-9]+/"},
+		},
+		{
+			name:    "glob",
+			item:    BatchItem{URL: "http://www.example.com/*.css", Type: "glob"},
+			url:     "http://www.example.com/*.css",
+			control: storagev1.PurgeControl{Hard: true, Match: globToRegexp("http://www.example.com/*.css")},
+		},
+		{name: "invalid url", item: BatchItem{URL: "/1.jpg"}, err: "invalid purge url"},
+		{name: "missing tag", item: BatchItem{URL: "http://www.example.com/", Type: "tag"}, err: "missing purge tag"},
+		{name: "invalid regex", item: BatchItem{URL: "http://www.example.com/", Type: "regex", Match: "("}, err: `invalid purge pattern "("`},
+		{name: "empty regex", item: BatchItem{URL: "http://www.example.com/", Type: "regex"}, err: `invalid purge pattern ""`},
+		{name: "vkey of dir", item: BatchItem{URL: "http://www.example.com/", Type: "dir", VKey: "gzip"}, err: "vkey only applies to the url purge"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := r.parseBatchItem(tt.item)
+			if tt.err != "" {
+				assert.Equal(t, BatchError, job.result.Status)
+				assert.Equal(t, tt.err, job.result.Error)
+				return
+			}
+
+			assert.Empty(t, job.result.Status)
+			assert.Equal(t, tt.url, job.url)
+			assert.Equal(t, tt.control, job.control)
+			assert.Equal(t, tt.refresh, job.refresh)
+		})
+	}
+}
+
+func TestBatchItemUnmarshal(t *testing.T) {
+	items := make([]BatchItem, 0)
+	require.NoError(t, json.Unmarshal([]byte(`["http://www.example.com/1.jpg",{"url":"http://www.example.com/","type":"tag","tag":"a"}]`), &items))
+	assert.Equal(t, []BatchItem{
+		{URL: "http://www.example.com/1.jpg"},
+		{URL: "http://www.example.com/", Type: "tag", Tag: "a"},
+	}, items)
+}
+
+func TestBatchDedup(t *testing.T) {
+	r := &PurgePlugin{}
+	key := func(item BatchItem) string {
+		return r.parseBatchItem(item).dedupKey()
+	}
+
+	tests := []struct {
+		name string
+		a, b BatchItem
+		same bool
+	}{
+		{
+			name: "same url",
+			a:    BatchItem{URL: "http://www.example.com/1.jpg"},
+			b:    BatchItem{URL: "http://www.example.com/1.jpg", Type: "HARD"},
+			same: true,
+		},
+		{
+			name: "same domain of the other path",
+			a:    BatchItem{URL: "http://www.example.com/a/", Type: "domain"},
+			b:    BatchItem{URL: "http://www.example.com/b/", Type: "domain"},
+			same: true,
+		},
+		{
+			name: "soft and hard",
+			a:    BatchItem{URL: "http://www.example.com/1.jpg"},
+			b:    BatchItem{URL: "http://www.example.com/1.jpg", Type: "soft"},
+		},
+		{
+			name: "soft and soft refresh",
+			a:    BatchItem{URL: "http://www.example.com/1.jpg", Type: "soft"},
+			b:    BatchItem{URL: "http://www.example.com/1.jpg", Type: "soft,refresh"},
+		},
+		{
+			name: "vkey",
+			a:    BatchItem{URL: "http://www.example.com/1.jpg"},
+			b:    BatchItem{URL: "http://www.example.com/1.jpg", VKey: "gzip"},
+		},
+		{
+			name: "tag",
+			a:    BatchItem{URL: "http://www.example.com/", Type: "tag", Tag: "a"},
+			b:    BatchItem{URL: "http://www.example.com/", Type: "tag", Tag: "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.same, key(tt.a) == key(tt.b))
+		})
+	}
+}
+
+func TestHandleBatchQueued(t *testing.T) {
+	r := newTestPlugin(t)
+
+	body := []byte(`[
+		{"url":"http://www.example.com/static/","type":"dir,soft"},
+		{"url":"http://www.example.com/static/","type":"dir,soft,refresh"},
+		{"url":"http://www.example.com/static/","type":"dir,soft"},
+		{"url":"http://www.example.com/","type":"tag"}
+	]`)
+	req := httptest.NewRequest(http.MethodPost, "/plugin/purge/batch", bytes.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	r.handleBatch(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// BatchResult embeds the BatchItem unmarshaler, the results are decoded as is.
+	resp := &struct {
+		batchResponse
+		Results []struct {
+			Status string `json:"status"`
+			Task   string `json:"task"`
+		} `json:"results"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), resp))
+	assert.Equal(t, 4, resp.Total)
+	assert.Equal(t, 2, resp.Unique)
+	assert.Equal(t, 2, resp.Queued)
+	assert.Equal(t, 1, resp.Failed)
+
+	// the refresh is queued as its own task.
+	require.Len(t, resp.Results, 3)
+	assert.NotEmpty(t, resp.Results[0].Task)
+	assert.NotEqual(t, resp.Results[0].Task, resp.Results[1].Task)
+	tasks := r.queue.List(req.Context(), TaskPending)
+	require.Len(t, tasks, 2)
+	assert.False(t, tasks[0].Refresh)
+	assert.True(t, tasks[1].Refresh)
+}
+
+func TestHandleBatchInvalid(t *testing.T) {
+	r := newTestPlugin(t)
+
+	tests := []struct {
+		name   string
+		remote string
+		body   string
+		code   int
+	}{
+		{name: "forbidden", remote: "10.0.0.1:1234", body: `["http://www.example.com/1.jpg"]`, code: http.StatusForbidden},
+		{name: "invalid json", remote: "127.0.0.1:1234", body: `{`, code: http.StatusBadRequest},
+		{name: "empty", remote: "127.0.0.1:1234", body: `[]`, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/plugin/purge/batch", bytes.NewReader([]byte(tt.body)))
+			req.RemoteAddr = tt.remote
+			rec := httptest.NewRecorder()
+			r.handleBatch(rec, req)
+			assert.Equal(t, tt.code, rec.Code)
+		})
+	}
+}
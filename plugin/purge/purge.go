@@ -1,19 +1,24 @@
 package purge
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	configv1 "github.com/omalloc/tavern/api/defined/v1/plugin"
 	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
 	"github.com/omalloc/tavern/contrib/log"
 	"github.com/omalloc/tavern/internal/constants"
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
 	"github.com/omalloc/tavern/plugin"
 	"github.com/omalloc/tavern/storage"
 )
@@ -24,16 +29,36 @@ const PurgeKeyPrefix = "purge/"
 var _ configv1.Plugin = (*PurgePlugin)(nil)
 
 type option struct {
-	Threshold  int      `json:"threshold" yaml:"threshold"`
-	AllowHosts []string `json:"allow_hosts" yaml:"allow_hosts"`
-	HeaderName string   `json:"header_name" yaml:"header_name"` // default `Purge-Type`
-	LogPath    string   `json:"log_path" yaml:"log_path"`
+	Threshold       int      `json:"threshold" yaml:"threshold"`                 // max purge tasks executed per second
+	MaxQueueSize    int      `json:"max_queue_size" yaml:"max_queue_size"`       // max pending purge tasks
+	AllowHosts      []string `json:"allow_hosts" yaml:"allow_hosts"`             // ip or cidr, e.g. 10.0.0.0/8, ::1
+	TrustedProxies  []string `json:"trusted_proxies" yaml:"trusted_proxies"`     // trust the X-Forwarded-For from the ip or cidr
+	HeaderName      string   `json:"header_name" yaml:"header_name"`             // default `Purge-Type`
+	TagHeaderName   string   `json:"tag_header_name" yaml:"tag_header_name"`     // default `Purge-Tag`
+	MatchHeaderName string   `json:"match_header_name" yaml:"match_header_name"` // default `Purge-Match`
+	LogPath         string   `json:"log_path" yaml:"log_path"`                   // append-only audit log
+
+	// HMAC-SHA256 signed purge requests, see Sign.
+	Keys             map[string]string `json:"keys" yaml:"keys"`                           // key id -> secret
+	ReplayWindow     int               `json:"replay_window" yaml:"replay_window"`         // seconds, default 300
+	RequireSignature bool              `json:"require_signature" yaml:"require_signature"` // reject the unsigned requests even from allow_hosts
 }
 
 type PurgePlugin struct {
 	log       *log.Helper
 	opt       *option
-	allowAddr map[string]struct{}
+	auth      *authorizer
+	audit     *auditLog
+	queue     *queue
+	refresher *refresher
+}
+
+type taskList struct {
+	Pending int     `json:"pending"`
+	Running int     `json:"running"`
+	Done    int     `json:"done"`
+	Failed  int     `json:"failed"`
+	Tasks   []*Task `json:"tasks"`
 }
 
 func init() {
@@ -41,28 +66,120 @@ func init() {
 }
 
 func (r *PurgePlugin) Start(ctx context.Context) error {
+	// load purge queue of the last process.
+	if err := r.queue.load(ctx); err != nil {
+		return err
+	}
+	r.queue.start()
 	return nil
 }
 
 func (r *PurgePlugin) Stop(ctx context.Context) error {
-	return nil
+	r.queue.Close()
+	return r.audit.Close()
 }
 
 func (r *PurgePlugin) AddRouter(router *http.ServeMux) {
+	// e.g.
+	//
+	//	curl 'http://127.0.0.1:8080/plugin/purge/tasks?state=pending'
+	//	curl 'http://127.0.0.1:8080/plugin/purge/tasks?id=<task-id>'
 	router.Handle("/plugin/purge/tasks", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		// TODO: query sharedkv purge task list
+		w.Header().Set("X-Device-Plugin", "purger")
 
-		var payload []byte
+		query := req.URL.Query()
+		if id := query.Get("id"); id != "" {
+			task, err := r.queue.Get(req.Context(), id)
+			if err != nil {
+				xhttp.WriteJSONError(w, http.StatusNotFound, "task not found")
+				return
+			}
+			xhttp.WriteJSON(w, http.StatusOK, task)
+			return
+		}
 
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(payload)))
-		w.Header().Set("Content-Type", "application/json")
+		state := TaskState(query.Get("state"))
+		result := &taskList{
+			Tasks: make([]*Task, 0),
+		}
+		for _, task := range r.queue.List(req.Context(), "") {
+			switch task.State {
+			case TaskPending:
+				result.Pending++
+			case TaskRunning:
+				result.Running++
+			case TaskDone:
+				result.Done++
+			case TaskFailed:
+				result.Failed++
+			}
+			if state == "" || task.State == state {
+				result.Tasks = append(result.Tasks, task)
+			}
+		}
+
+		xhttp.WriteJSON(w, http.StatusOK, result)
+	}))
+
+	// e.g.
+	//
+	//	curl 'http://127.0.0.1:8080/plugin/purge/audit?limit=100&url=www.example.com&event=purged'
+	//	curl 'http://127.0.0.1:8080/plugin/purge/audit?task=<task-id>'
+	router.Handle("/plugin/purge/audit", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("X-Device-Plugin", "purger")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(payload)
+
+		query := req.URL.Query()
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		if limit <= 0 || limit > 1000 {
+			limit = 100
+		}
+		since, _ := strconv.ParseInt(query.Get("since"), 10, 64)
+
+		entries, err := r.audit.Query(&auditFilter{
+			Since:  since,
+			Event:  query.Get("event"),
+			Client: query.Get("client"),
+			Key:    query.Get("key"),
+			URL:    query.Get("url"),
+			Task:   query.Get("task"),
+		}, limit)
+		if err != nil {
+			r.log.Errorf("query purge audit log failed: %v", err)
+			xhttp.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		xhttp.WriteJSON(w, http.StatusOK, map[string]any{"entries": entries})
 	}))
+	router.Handle("POST /plugin/purge/batch", http.HandlerFunc(r.handleBatch))
+}
+
+// Guard authorizes the requests of the local api with the purge allowlist and signature,
+// the signed url is the request uri, e.g. `/cache/bans`, the body is signed too.
+func (r *PurgePlugin) Guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBatchBody))
+		if err != nil {
+			xhttp.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// the handler reads the same body as signed.
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		client, key, err := r.auth.authorize(req, req.URL.RequestURI(), body)
+		if err != nil {
+			r.log.Warnf("local api request %s key %q denied: %s %s %v", client, key, req.Method, req.URL.Path, err)
+			xhttp.WriteJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
 }
 
 func (r *PurgePlugin) HandleFunc(next http.HandlerFunc) http.HandlerFunc {
+	// refresh requests go through the rest of the handler chain.
+	r.refresher.next = next
+
 	return func(w http.ResponseWriter, req *http.Request) {
 		// skip not PURGE request. e.g. curl -X PURGE http://www.example.com/
 		if req.Method != Method {
@@ -70,110 +187,339 @@ func (r *PurgePlugin) HandleFunc(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		ipPort := strings.Split(req.RemoteAddr, ":")
-		if _, ok := r.allowAddr[ipPort[0]]; !ok {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-
 		// TODO: generate store-url and delete index
 		storeUrl := req.Header.Get(constants.InternalStoreUrl)
 		if storeUrl == "" {
 			storeUrl = req.URL.String()
 		}
-		r.log.Debugf("purge request %s received: %s", ipPort[0], storeUrl)
 
-		u, err1 := url.Parse(storeUrl)
-		if err1 != nil {
-			r.log.Errorf("failed to parse storeUrl %s: %s", storeUrl, err1)
+		entry := &AuditEntry{
+			Time:  time.Now().Unix(),
+			URL:   storeUrl,
+			Type:  req.Header.Get(r.opt.HeaderName),
+			Tag:   strings.Join(req.Header.Values(r.opt.TagHeaderName), " "),
+			Match: req.Header.Get(r.opt.MatchHeaderName),
+		}
+
+		client, key, err := r.auth.authorize(req, storeUrl, nil)
+		entry.Client, entry.Key = client, key
+		if err != nil {
+			r.log.Warnf("purge request %s key %q denied: %s %v", client, key, storeUrl, err)
+			entry.Event, entry.Status, entry.Error = AuditDenied, http.StatusForbidden, err.Error()
+			r.record(entry)
+			xhttp.WriteJSONError(w, http.StatusForbidden, err.Error())
 			return
 		}
+		r.log.Debugf("purge request %s key %q received: %s", client, key, storeUrl)
 
-		current := storage.Current()
+		rec := xhttp.NewResponseRecorder(w)
+		r.purge(rec, req, storeUrl, entry)
 
-		if log.Enabled(log.LevelDebug) {
-			_ = current.SharedKV().IteratePrefix(context.Background(), []byte("if/domain"), func(key, val []byte) error {
-				r.log.Debugf("kvstore domina=%s, cache-counter=%d", string(key), binary.BigEndian.Uint32(val))
-				return nil
-			})
+		entry.Status = rec.Status()
+		r.record(entry)
+	}
+}
+
+// purge handles the authorized purge request, the result is filled into the audit entry.
+func (r *PurgePlugin) purge(w http.ResponseWriter, req *http.Request, storeUrl string, entry *AuditEntry) {
+	u, err1 := url.Parse(storeUrl)
+	if err1 != nil {
+		r.log.Errorf("failed to parse storeUrl %s: %s", storeUrl, err1)
+		xhttp.WriteJSONError(w, http.StatusBadRequest, "invalid purge url")
+		return
+	}
+
+	current := storage.Current()
+
+	if log.Enabled(log.LevelDebug) {
+		_ = current.SharedKV().IteratePrefix(context.Background(), []byte("if/domain"), func(key, val []byte) error {
+			r.log.Debugf("kvstore domina=%s, cache-counter=%d", string(key), binary.BigEndian.Uint32(val))
+			return nil
+		})
+	}
+
+	typ := parsePurgeType(req.Header.Get(r.opt.HeaderName))
+	entry.Event = AuditPurged
+
+	// purge dir, tags or pattern, enqueue the tasks and run them async.
+	if typ.dir || typ.domain || typ.tag || typ.regex || typ.glob {
+		task := Task{
+			URL:         storeUrl,
+			Dir:         typ.dir,
+			Hard:        !typ.soft,
+			MarkExpired: typ.soft,
+			Refresh:     typ.soft && typ.refresh,
+			Client:      entry.Client,
+			Key:         entry.Key,
+		}
+
+		// e.g. curl -X PURGE 'http://www.example.com/' -H 'Purge-Type: domain'
+		if typ.domain {
+			task.Dir = false
+			task.Domain = true
+			task.URL = fmt.Sprintf("%s://%s/", u.Scheme, u.Host)
 		}
 
-		// purge dir
-		if typ := req.Header.Get(r.opt.HeaderName); strings.ToLower(typ) == "dir" {
-			// check if/domain exist
-			if _, err := current.SharedKV().Get(context.Background(),
-				[]byte(fmt.Sprintf("if/domain/%s", u.Host))); err != nil && errors.Is(err, storagev1.ErrKeyNotFound) {
-				r.log.Infof("purge dir %s but is not caching in the service", storeUrl)
+		// e.g. curl -X PURGE 'http://www.example.com/*/thumb_*.jpg' -H 'Purge-Type: glob'
+		//      curl -X PURGE 'http://www.example.com/' -H 'Purge-Type: regex' -H 'Purge-Match: ^http://www.example.com/v[0-9]+/'
+		if typ.regex || typ.glob {
+			task.Dir = false
+			task.Match = req.Header.Get(r.opt.MatchHeaderName)
+			if typ.glob {
+				task.Match = globToRegexp(storeUrl)
+			}
+			if _, err := regexp.Compile(task.Match); err != nil || task.Match == "" {
+				xhttp.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid purge pattern %q", task.Match))
 				return
 			}
+		}
 
-			if err := current.PURGE(storeUrl, storagev1.PurgeControl{
-				Hard: true,
-				Dir:  true,
-			}); err != nil {
-				if errors.Is(err, storagev1.ErrKeyNotFound) {
-					w.Header().Set("Content-Length", "0")
-					w.Header().Set("Content-Type", "application/json; charset=utf-8")
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
-
-				r.log.Errorf("purge dir %s failed: %v", storeUrl, err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+		// check if/domain exist, nothing of the host to purge.
+		if _, err := current.SharedKV().Get(context.Background(),
+			[]byte(fmt.Sprintf("if/domain/%s", u.Host))); err != nil && errors.Is(err, storagev1.ErrKeyNotFound) {
+			r.log.Infof("purge %s but is not caching in the service", storeUrl)
+			if typ.tag {
+				task.Tag = entry.Tag
 			}
+			task.State, task.FinishedAt = TaskDone, time.Now().Unix()
+			xhttp.WriteJSON(w, http.StatusOK, &task)
+			return
+		}
 
-			payload := []byte(`{"message":"success"}`)
-			w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write(payload)
+		entry.Event = AuditQueued
+		if !typ.tag {
+			entry.Tasks = r.enqueue(w, req, &task)
 			return
 		}
 
-		// purge single file.
-		if err := current.PURGE(storeUrl, storagev1.PurgeControl{
-			Hard: true,
-			Dir:  false,
-		}); err != nil {
-			// key not found.
-			if errors.Is(err, storagev1.ErrKeyNotFound) {
-				w.Header().Set("Content-Length", "0")
-				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
+		// one task per tag, e.g. `Purge-Tag: product-123 category-7`
+		tags := xhttp.ParseSurrogateKeys(req.Header.Values(r.opt.TagHeaderName))
+		if len(tags) == 0 {
+			xhttp.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("missing `%s` header", r.opt.TagHeaderName))
+			return
+		}
 
-			// others error
-			r.log.Errorf("purge %s failed: %v", storeUrl, err)
-			w.WriteHeader(http.StatusInternalServerError)
+		tasks := make([]*Task, 0, len(tags))
+		for _, tag := range tags {
+			t := task
+			t.Dir = false
+			t.Tag = tag
+			tasks = append(tasks, &t)
+		}
+		entry.Tasks = r.enqueue(w, req, tasks...)
+		return
+	}
+
+	// purge single file, soft purge marks it expired to revalidate.
+	n, err := current.PURGE(storeUrl, storagev1.PurgeControl{
+		Hard:        !typ.soft,
+		Dir:         false,
+		MarkExpired: typ.soft,
+	})
+	entry.Removed = n
+	if err != nil {
+		entry.Error = err.Error()
+
+		// key not found.
+		if errors.Is(err, storagev1.ErrKeyNotFound) {
+			w.Header().Set("Content-Length", "0")
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		payload := []byte(`{"message":"success"}`)
-		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(payload)
+		// others error
+		r.log.Errorf("purge %s failed: %v", storeUrl, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+
+	if typ.soft && typ.refresh {
+		r.refresher.Refresh(storeUrl)
+	}
+
+	payload := []byte(`{"message":"success"}`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(payload)
 }
 
 func NewPurgePlugin(opts configv1.Option, log *log.Helper) (configv1.Plugin, error) {
 	opt := &option{
-		HeaderName: "Purge-Type",
+		HeaderName:      "Purge-Type",
+		TagHeaderName:   "Purge-Tag",
+		MatchHeaderName: "Purge-Match",
 	}
 	if err := opts.Unmarshal(opt); err != nil {
 		return nil, err
 	}
 
-	allowAddr := make(map[string]struct{}, len(opt.AllowHosts))
-	for _, addr := range opt.AllowHosts {
-		allowAddr[addr] = struct{}{}
+	auth, err := newAuthorizer(opt)
+	if err != nil {
+		return nil, err
 	}
 
-	return &PurgePlugin{
+	audit, err := newAuditLog(opt.LogPath)
+	if err != nil {
+		return nil, fmt.Errorf("open purge audit log %s: %w", opt.LogPath, err)
+	}
+
+	current := storage.Current()
+
+	r := &PurgePlugin{
 		log:       log,
 		opt:       opt,
-		allowAddr: allowAddr,
-	}, nil
+		auth:      auth,
+		audit:     audit,
+		queue:     newQueue(current.SharedKV(), current.PURGE, opt.Threshold, opt.MaxQueueSize, log),
+		refresher: newRefresher(log),
+	}
+	r.queue.onFinish = r.onTaskFinish
+	return r, nil
+}
+
+// enqueue writes the queued tasks, a single task is written as the object, returns the queued task ids.
+func (r *PurgePlugin) enqueue(w http.ResponseWriter, req *http.Request, tasks ...*Task) []string {
+	queued := make([]*Task, 0, len(tasks))
+	for _, task := range tasks {
+		t, dup, err := r.queue.Enqueue(req.Context(), task)
+		if err != nil {
+			if errors.Is(err, ErrQueueFull) {
+				xhttp.WriteJSONError(w, http.StatusTooManyRequests, err.Error())
+				return nil
+			}
+
+			r.log.Errorf("enqueue purge %s failed: %v", task.URL, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil
+		}
+
+		if dup {
+			r.log.Debugf("purge %s is already queued by task %s", task.URL, t.ID)
+		}
+		queued = append(queued, t)
+	}
+
+	ids := make([]string, 0, len(queued))
+	for _, t := range queued {
+		ids = append(ids, t.ID)
+	}
+
+	if len(queued) == 1 {
+		xhttp.WriteJSON(w, http.StatusAccepted, queued[0])
+		return ids
+	}
+	xhttp.WriteJSON(w, http.StatusAccepted, map[string]any{"tasks": queued})
+	return ids
+}
+
+func (r *PurgePlugin) record(entry *AuditEntry) {
+	if err := r.audit.Record(entry); err != nil {
+		r.log.Errorf("write purge audit log failed: %v", err)
+	}
+}
+
+// onTaskFinish records the task result and refreshes the soft purged objects of the task in background.
+func (r *PurgePlugin) onTaskFinish(task *Task) {
+	r.record(&AuditEntry{
+		Time:    task.FinishedAt,
+		Event:   AuditFinished,
+		Client:  task.Client,
+		Key:     task.Key,
+		URL:     task.URL,
+		Tag:     task.Tag,
+		Match:   task.Match,
+		Tasks:   []string{task.ID},
+		Removed: task.Removed,
+		Error:   task.Error,
+	})
+
+	if !task.Refresh || task.State != TaskDone || task.Removed == 0 {
+		return
+	}
+
+	switch {
+	case task.Tag != "":
+		r.refresher.RefreshTag(task.URL, task.Tag)
+	case task.Match != "":
+		r.refresher.RefreshMatch(task.URL, task.Match)
+	default:
+		r.refresher.RefreshDir(task.URL)
+	}
+}
+
+// purgeType is parsed from the `Purge-Type` header, e.g. `dir`, `tag`, `soft`, `dir,soft,refresh`.
+//
+// `domain` purges all the objects of the host, both http and https.
+// `tag` purges the objects of the host with the surrogate keys in the `Purge-Tag` header.
+// `regex` purges the objects of the host whose url matches the RE2 pattern in the `Purge-Match` header,
+// `glob` uses the request url as the pattern, see globToRegexp.
+// `soft` marks the objects expired instead of deleting them, the next request revalidates
+// with If-None-Match / If-Modified-Since. `refresh` revalidates the soft purged objects immediately.
+type purgeType struct {
+	dir     bool
+	domain  bool
+	tag     bool
+	regex   bool
+	glob    bool
+	soft    bool
+	refresh bool
+}
+
+func parsePurgeType(v string) purgeType {
+	var typ purgeType
+	for _, token := range strings.Split(strings.ToLower(v), ",") {
+		switch strings.TrimSpace(token) {
+		case "dir":
+			typ.dir = true
+		case "domain":
+			typ.domain = true
+		case "tag":
+			typ.tag = true
+		case "regex":
+			typ.regex = true
+		case "glob":
+			typ.glob = true
+		case "soft":
+			typ.soft = true
+		case "refresh":
+			typ.refresh = true
+		}
+	}
+	return typ
+}
+
+// globToRegexp converts the glob url to the anchored RE2 pattern.
+//
+// `*` matches any characters except `/` in the path, and any characters in the query,
+// `**` matches any characters, e.g.
+//
+//	http://www.example.com/*/thumb_*.jpg  all the thumbnails of the second level dirs
+//	http://www.example.com/static/**.css  all the css files under /static/
+//	http://www.example.com/1.jpg?*        all the query variants of /1.jpg
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	query := false
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			sb.WriteString(".*")
+			i++
+		case c == '*' && query:
+			sb.WriteString(".*")
+		case c == '*':
+			sb.WriteString("[^/]*")
+		default:
+			if c == '?' {
+				query = true
+			}
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	sb.WriteString("$")
+	return sb.String()
 }
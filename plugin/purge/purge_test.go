@@ -0,0 +1,79 @@
+package purge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/omalloc/tavern/conf"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage"
+)
+
+func newTestStorage(t *testing.T) {
+	st, err := storage.New(&conf.Storage{
+		Driver:          "native",
+		DBType:          "pebble",
+		SelectionPolicy: "hashring",
+		EvictionPolicy:  "lru",
+		Buckets: []*conf.Bucket{
+			{Path: t.TempDir(), Type: "normal"},
+		},
+	}, log.GetLogger())
+	require.NoError(t, err)
+
+	storage.SetDefault(st)
+	t.Cleanup(func() { _ = st.Close() })
+}
+
+func TestPurgeNotCachedHost(t *testing.T) {
+	newTestStorage(t)
+	_, err := storage.Current().SharedKV().Incr(context.Background(), []byte("if/domain/www.example.com"), 1)
+	require.NoError(t, err)
+
+	r := newTestPlugin(t)
+	h := r.HandleFunc(nil)
+
+	tests := []struct {
+		name   string
+		url    string
+		header http.Header
+		code   int
+	}{
+		{name: "domain", url: "http://img.example.com/", header: http.Header{"Purge-Type": {"domain"}}, code: http.StatusOK},
+		{name: "dir", url: "http://img.example.com/static/", header: http.Header{"Purge-Type": {"dir,soft"}}, code: http.StatusOK},
+		{name: "tag", url: "http://img.example.com/", header: http.Header{"Purge-Type": {"tag"}, "Purge-Tag": {"a b"}}, code: http.StatusOK},
+		{name: "cached host queued", url: "http://www.example.com/", header: http.Header{"Purge-Type": {"domain"}}, code: http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(Method, tt.url, nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			require.Equal(t, tt.code, rec.Code)
+			assert.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+
+			task := &Task{}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), task))
+			assert.Zero(t, task.Removed)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, TaskDone, task.State)
+				assert.Empty(t, task.ID)
+			} else {
+				assert.Equal(t, TaskPending, task.State)
+				assert.NotEmpty(t, task.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/contrib/log"
+)
+
+// task key schema: purge/task/<uuid-v7>, value: json Task
+//
+// uuid v7 is time-ordered, so iterating the prefix returns the tasks in submit order.
+const taskKeyPrefix = PurgeKeyPrefix + "task/"
+
+var ErrQueueFull = errors.New("purge queue is full")
+
+type TaskState string
+
+const (
+	TaskPending TaskState = "pending"
+	TaskRunning TaskState = "running"
+	TaskDone    TaskState = "done"
+	TaskFailed  TaskState = "failed"
+)
+
+// Task is a purge request persisted in SharedKV.
+type Task struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Dir         bool      `json:"dir"`
+	Domain      bool      `json:"domain,omitempty"` // all the objects of the URL host
+	Hard        bool      `json:"hard"`
+	MarkExpired bool      `json:"mark_expired"`
+	Tag         string    `json:"tag,omitempty"`     // surrogate key of the URL host
+	Match       string    `json:"match,omitempty"`   // RE2 pattern of the URL host
+	Refresh     bool      `json:"refresh,omitempty"` // refresh the soft purged objects after done
+	Client      string    `json:"client,omitempty"`  // client address of the purge request
+	Key         string    `json:"key,omitempty"`     // key id of the signed purge request
+	State       TaskState `json:"state"`
+	Removed     int       `json:"removed"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   int64     `json:"created_at"`
+	StartedAt   int64     `json:"started_at,omitempty"`
+	FinishedAt  int64     `json:"finished_at,omitempty"`
+}
+
+func (t *Task) control() storagev1.PurgeControl {
+	return storagev1.PurgeControl{
+		Hard:        t.Hard,
+		Dir:         t.Dir,
+		Domain:      t.Domain,
+		MarkExpired: t.MarkExpired,
+		Tag:         t.Tag,
+		Match:       t.Match,
+	}
+}
+
+// dedupKey is the same for the purge requests with the same effect.
+func (t *Task) dedupKey() string {
+	return fmt.Sprintf("%t/%t/%t/%t/%t/%s/%s/%s", t.Dir, t.Domain, t.Hard, t.MarkExpired, t.Refresh, t.Tag, t.Match, t.URL)
+}
+
+type purgeFunc func(storeUrl string, typ storagev1.PurgeControl) (int, error)
+
+// queue runs the purge tasks one by one with rate limiting.
+type queue struct {
+	mu  sync.Mutex
+	log *log.Helper
+	kv  storagev1.SharedKV
+
+	purge    purgeFunc
+	interval time.Duration // min interval between two tasks
+	maxSize  int           // max pending tasks, also the finished tasks history
+	onFinish func(task *Task)
+
+	pending  []string          // pending task ids, oldest first
+	finished []string          // finished task ids, oldest first
+	dedup    map[string]string // dedupKey -> pending task id
+
+	started atomic.Bool
+	notify  chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newQueue(kv storagev1.SharedKV, purge purgeFunc, threshold, maxSize int, log *log.Helper) *queue {
+	if threshold <= 0 {
+		threshold = 10
+	}
+	if maxSize <= 0 {
+		maxSize = 1000
+	}
+
+	return &queue{
+		log:      log,
+		kv:       kv,
+		purge:    purge,
+		interval: time.Second / time.Duration(threshold),
+		maxSize:  maxSize,
+		pending:  make([]string, 0, maxSize),
+		finished: make([]string, 0, maxSize),
+		dedup:    make(map[string]string),
+		notify:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// load restores the tasks from SharedKV, the running tasks of the last process are requeued.
+func (q *queue) load(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.kv.IteratePrefix(ctx, []byte(taskKeyPrefix), func(key, val []byte) error {
+		task := &Task{}
+		if err := json.Unmarshal(val, task); err != nil {
+			q.log.Warnf("drop invalid purge task %s: %s", key, err)
+			_ = q.kv.Delete(ctx, key)
+			return nil
+		}
+
+		switch task.State {
+		case TaskPending, TaskRunning:
+			if task.State == TaskRunning {
+				task.State = TaskPending
+				task.StartedAt = 0
+				_ = q.save(ctx, task)
+			}
+			q.pending = append(q.pending, task.ID)
+			q.dedup[task.dedupKey()] = task.ID
+		default:
+			q.finished = append(q.finished, task.ID)
+		}
+		return nil
+	})
+}
+
+// Enqueue adds the task to the queue, returns the queued task if a same task is pending.
+//
+// the running task is not deduped, the objects stored behind its scan cursor are purged by the new one.
+func (q *queue) Enqueue(ctx context.Context, task *Task) (*Task, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if id, ok := q.dedup[task.dedupKey()]; ok {
+		if exist, err := q.get(ctx, id); err == nil {
+			return exist, true, nil
+		}
+	}
+
+	if len(q.pending) >= q.maxSize {
+		return nil, false, ErrQueueFull
+	}
+
+	task.ID = uuid.Must(uuid.NewV7()).String()
+	task.State = TaskPending
+	task.CreatedAt = time.Now().Unix()
+	if err := q.save(ctx, task); err != nil {
+		return nil, false, err
+	}
+
+	q.pending = append(q.pending, task.ID)
+	q.dedup[task.dedupKey()] = task.ID
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return task, false, nil
+}
+
+// List returns the tasks in submit order, empty state returns all tasks.
+func (q *queue) List(ctx context.Context, state TaskState) []*Task {
+	tasks := make([]*Task, 0)
+	_ = q.kv.IteratePrefix(ctx, []byte(taskKeyPrefix), func(key, val []byte) error {
+		task := &Task{}
+		if err := json.Unmarshal(val, task); err != nil {
+			return nil
+		}
+		if state == "" || task.State == state {
+			tasks = append(tasks, task)
+		}
+		return nil
+	})
+	return tasks
+}
+
+// Get returns the task of id.
+func (q *queue) Get(ctx context.Context, id string) (*Task, error) {
+	return q.get(ctx, id)
+}
+
+// start runs the queue worker in background.
+func (q *queue) start() {
+	q.started.Store(true)
+	go q.run()
+}
+
+func (q *queue) run() {
+	defer close(q.done)
+
+	ctx := context.Background()
+	for {
+		id, ok := q.next()
+		if !ok {
+			select {
+			case <-q.stop:
+				return
+			case <-q.notify:
+				continue
+			}
+		}
+
+		q.execute(ctx, id)
+
+		// rate limit, at most `threshold` tasks per second.
+		select {
+		case <-q.stop:
+			return
+		case <-time.After(q.interval):
+		}
+	}
+}
+
+func (q *queue) next() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return "", false
+	}
+
+	id := q.pending[0]
+	q.pending = q.pending[1:]
+	return id, true
+}
+
+func (q *queue) execute(ctx context.Context, id string) {
+	task, err := q.get(ctx, id)
+	if err != nil {
+		q.log.Warnf("purge task %s not found: %s", id, err)
+		return
+	}
+
+	q.mu.Lock()
+	if q.dedup[task.dedupKey()] == task.ID {
+		delete(q.dedup, task.dedupKey())
+	}
+	q.mu.Unlock()
+
+	task.State = TaskRunning
+	task.StartedAt = time.Now().Unix()
+	_ = q.save(ctx, task)
+
+	removed, err := q.purge(task.URL, task.control())
+
+	task.Removed = removed
+	task.State = TaskDone
+	task.FinishedAt = time.Now().Unix()
+	if err != nil && !errors.Is(err, storagev1.ErrKeyNotFound) {
+		task.State = TaskFailed
+		task.Error = err.Error()
+	}
+
+	q.log.Infof("purge task %s %s %s, %d objects removed", task.ID, task.URL, task.State, task.Removed)
+
+	if q.onFinish != nil {
+		q.onFinish(task)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_ = q.save(ctx, task)
+
+	q.finished = append(q.finished, task.ID)
+
+	// keep the latest `maxSize` finished tasks.
+	if n := len(q.finished) - q.maxSize; n > 0 {
+		for _, old := range q.finished[:n] {
+			_ = q.kv.Delete(ctx, []byte(taskKeyPrefix+old))
+		}
+		q.finished = slices.Delete(q.finished, 0, n)
+	}
+}
+
+func (q *queue) Close() {
+	close(q.stop)
+	if q.started.Load() {
+		<-q.done
+	}
+}
+
+func (q *queue) get(ctx context.Context, id string) (*Task, error) {
+	val, err := q.kv.Get(ctx, []byte(taskKeyPrefix+id))
+	if err != nil {
+		return nil, err
+	}
+
+	task := &Task{}
+	if err = json.Unmarshal(val, task); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+func (q *queue) save(ctx context.Context, task *Task) error {
+	val, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return q.kv.Set(ctx, []byte(taskKeyPrefix+task.ID), val)
+}
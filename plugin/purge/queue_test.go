@@ -0,0 +1,156 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage/sharedkv"
+)
+
+// recorder is the purgeFunc recording the purged urls.
+type recorder struct {
+	mu   sync.Mutex
+	urls []string
+	err  error
+}
+
+func (r *recorder) purge(storeUrl string, _ storagev1.PurgeControl) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.urls = append(r.urls, storeUrl)
+	return 1, r.err
+}
+
+func (r *recorder) purged() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.urls...)
+}
+
+func TestQueueDedup(t *testing.T) {
+	q := newQueue(sharedkv.NewMemSharedKV(), (&recorder{}).purge, 0, 3, log.NewHelper(log.GetLogger()))
+	ctx := context.Background()
+
+	a, dup, err := q.Enqueue(ctx, &Task{URL: "http://www.example.com/static/", Dir: true, MarkExpired: true})
+	require.NoError(t, err)
+	assert.False(t, dup)
+	assert.Equal(t, TaskPending, a.State)
+
+	same, dup, err := q.Enqueue(ctx, &Task{URL: "http://www.example.com/static/", Dir: true, MarkExpired: true})
+	require.NoError(t, err)
+	assert.True(t, dup)
+	assert.Equal(t, a.ID, same.ID)
+
+	// the refresh is not the same purge.
+	refresh, dup, err := q.Enqueue(ctx, &Task{URL: "http://www.example.com/static/", Dir: true, MarkExpired: true, Refresh: true})
+	require.NoError(t, err)
+	assert.False(t, dup)
+	assert.NotEqual(t, a.ID, refresh.ID)
+
+	_, _, err = q.Enqueue(ctx, &Task{URL: "http://www.example.com/", Domain: true, Hard: true})
+	require.NoError(t, err)
+
+	_, _, err = q.Enqueue(ctx, &Task{URL: "http://img.example.com/", Domain: true, Hard: true})
+	assert.ErrorIs(t, err, ErrQueueFull)
+}
+
+func TestQueuePersistence(t *testing.T) {
+	kv := sharedkv.NewMemSharedKV()
+	helper := log.NewHelper(log.GetLogger())
+	ctx := context.Background()
+
+	q := newQueue(kv, (&recorder{}).purge, 0, 0, helper)
+	urls := []string{"http://www.example.com/a/", "http://www.example.com/b/", "http://www.example.com/c/"}
+	ids := make([]string, 0, len(urls))
+	for _, u := range urls {
+		task, _, err := q.Enqueue(ctx, &Task{URL: u, Dir: true, Hard: true})
+		require.NoError(t, err)
+		ids = append(ids, task.ID)
+	}
+
+	// the process exits with the first task running and the last one done.
+	running, err := q.get(ctx, ids[0])
+	require.NoError(t, err)
+	running.State, running.StartedAt = TaskRunning, time.Now().Unix()
+	require.NoError(t, q.save(ctx, running))
+
+	done, err := q.get(ctx, ids[2])
+	require.NoError(t, err)
+	done.State = TaskDone
+	require.NoError(t, q.save(ctx, done))
+
+	require.NoError(t, kv.Set(ctx, []byte(taskKeyPrefix+"invalid"), []byte("{")))
+
+	// the restarted queue requeues the running task in the submit order.
+	rec := &recorder{}
+	q = newQueue(kv, rec.purge, 1000, 0, helper)
+	require.NoError(t, q.load(ctx))
+	assert.Equal(t, ids[:2], q.pending)
+	assert.Equal(t, ids[2:], q.finished)
+
+	requeued, err := q.get(ctx, ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, TaskPending, requeued.State)
+	assert.Zero(t, requeued.StartedAt)
+
+	_, err = kv.Get(ctx, []byte(taskKeyPrefix+"invalid"))
+	assert.ErrorIs(t, err, storagev1.ErrKeyNotFound)
+
+	// the pending tasks are deduped after restart.
+	task, dup, err := q.Enqueue(ctx, &Task{URL: urls[1], Dir: true, Hard: true})
+	require.NoError(t, err)
+	assert.True(t, dup)
+	assert.Equal(t, ids[1], task.ID)
+
+	q.start()
+	t.Cleanup(q.Close)
+
+	require.Eventually(t, func() bool {
+		return len(q.List(ctx, TaskDone)) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, urls[:2], rec.purged())
+
+	task, err = q.Get(ctx, ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, 1, task.Removed)
+	assert.NotZero(t, task.FinishedAt)
+}
+
+func TestQueueFailedTask(t *testing.T) {
+	rec := &recorder{err: errors.New("scan failed")}
+	q := newQueue(sharedkv.NewMemSharedKV(), rec.purge, 1000, 0, log.NewHelper(log.GetLogger()))
+	ctx := context.Background()
+
+	var finished []*Task
+	var mu sync.Mutex
+	q.onFinish = func(task *Task) {
+		mu.Lock()
+		defer mu.Unlock()
+		finished = append(finished, task)
+	}
+
+	q.start()
+	t.Cleanup(q.Close)
+
+	task, _, err := q.Enqueue(ctx, &Task{URL: "http://www.example.com/", Domain: true, Hard: true})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(finished) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	task, err = q.Get(ctx, task.ID)
+	require.NoError(t, err)
+	assert.Equal(t, TaskFailed, task.State)
+	assert.Equal(t, "scan failed", task.Error)
+}
@@ -0,0 +1,159 @@
+package purge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage"
+)
+
+const (
+	refreshConcurrency = 4
+	maxRefreshURLs     = 1000 // dir refresh upper bound
+)
+
+// refresher re-fetches the soft purged urls through the handler chain,
+// the expired objects are revalidated with the origin in background.
+type refresher struct {
+	log  *log.Helper
+	sem  *semaphore.Weighted
+	next http.HandlerFunc
+}
+
+func newRefresher(log *log.Helper) *refresher {
+	return &refresher{
+		log: log,
+		sem: semaphore.NewWeighted(refreshConcurrency),
+	}
+}
+
+// Refresh fetches the urls in background.
+func (f *refresher) Refresh(urls ...string) {
+	if f.next == nil || len(urls) == 0 {
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+		for _, u := range urls {
+			if err := f.sem.Acquire(ctx, 1); err != nil {
+				return
+			}
+			go func(u string) {
+				defer f.sem.Release(1)
+				f.fetch(ctx, u)
+			}(u)
+		}
+	}()
+}
+
+// RefreshDir fetches the cached urls of the dir, the vary variants are fetched once by the url.
+func (f *refresher) RefreshDir(storeUrl string) {
+	f.refreshIndex(storeUrl, func(bucketID string) string {
+		return fmt.Sprintf("ix/%s/%s", bucketID, storeUrl)
+	}, nil)
+}
+
+// RefreshTag fetches the cached urls of the storeUrl host with the tag.
+func (f *refresher) RefreshTag(storeUrl, tag string) {
+	u, err := url.Parse(storeUrl)
+	if err != nil {
+		return
+	}
+
+	f.refreshIndex(storeUrl+" tag "+tag, func(bucketID string) string {
+		return fmt.Sprintf("tg/%s/%s/%s/", bucketID, u.Host, tag)
+	}, nil)
+}
+
+// RefreshMatch fetches the cached urls of the storeUrl host matching the RE2 pattern.
+func (f *refresher) RefreshMatch(storeUrl, pattern string) {
+	u, err := url.Parse(storeUrl)
+	if err != nil {
+		return
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return
+	}
+
+	f.refreshIndex(u.Host+" match "+pattern, func(bucketID string) string {
+		return fmt.Sprintf("ix/%s/%s://%s/", bucketID, u.Scheme, u.Host)
+	}, re.MatchString)
+}
+
+// refreshIndex collects the urls from the inverted index of SharedKV and fetches them,
+// the urls are filtered by match if not nil.
+func (f *refresher) refreshIndex(name string, prefix func(bucketID string) string, match func(string) bool) {
+	current := storage.Current()
+	ctx := context.Background()
+
+	seen := make(map[string]struct{})
+	urls := make([]string, 0)
+	for _, b := range current.Buckets() {
+		_ = current.SharedKV().IteratePrefix(ctx, []byte(prefix(b.ID())), func(key, val []byte) error {
+			if len(urls) >= maxRefreshURLs || len(val) < object.IdHashSize {
+				return nil
+			}
+
+			var hash object.IDHash
+			copy(hash[:], val[:object.IdHashSize])
+			md, err := b.LookupWithHash(ctx, hash)
+			if err != nil {
+				return nil
+			}
+
+			u := md.ID.Path()
+			if _, ok := seen[u]; ok || (match != nil && !match(u)) {
+				return nil
+			}
+			seen[u] = struct{}{}
+			urls = append(urls, u)
+			return nil
+		})
+	}
+
+	f.log.Infof("refresh %s, %d urls", name, len(urls))
+	f.Refresh(urls...)
+}
+
+func (f *refresher) fetch(ctx context.Context, rawUrl string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		f.log.Warnf("refresh %s failed: %s", rawUrl, err)
+		return
+	}
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = "127.0.0.1:0"
+
+	w := &discardWriter{header: make(http.Header)}
+	f.next(w, req)
+
+	f.log.Debugf("refresh %s done, status %d x-cache %s", rawUrl, w.code, strings.Join(w.header.Values("X-Cache"), ","))
+}
+
+// discardWriter drops the response body of the refresh request.
+type discardWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardWriter) WriteHeader(code int) {
+	w.code = code
+}
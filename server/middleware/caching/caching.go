@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -45,18 +46,34 @@ func (r Duration) AsDuration() time.Duration {
 }
 
 type cachingOption struct {
-	IncludeQueryInCacheKey      bool     `json:"include_query_in_cache_key" yaml:"include_query_in_cache_key"`
-	FuzzyRefresh                bool     `json:"fuzzy_refresh" yaml:"fuzzy_refresh"`
-	FuzzyRefreshRate            float64  `json:"fuzzy_refresh_rate" yaml:"fuzzy_refresh_rate"`
-	CollapsedRequest            bool     `json:"collapsed_request" yaml:"collapsed_request"`
-	CollapsedRequestWaitTimeout Duration `json:"collapsed_request_wait_timeout" yaml:"collapsed_request_wait_timeout"`
-	ObjectPoolEnabled           bool     `json:"object_pool_enabled" yaml:"object_pool_enabled"`
-	ObjectPollSize              int      `json:"object_poll_size" yaml:"object_poll_size"`
-	SliceSize                   uint64   `json:"slice_size" yaml:"slice_size"`
-	FillRangePercent            uint64   `json:"fill_range_percent" yaml:"fill_range_percent"`
-	VaryLimit                   int      `json:"vary_limit" yaml:"vary_limit"`
-	VaryIgnoreKey               []string `json:"vary_ignore_key" yaml:"vary_ignore_key"`
-	Hostname                    string   `json:"hostname" yaml:"hostname"`
+	IncludeQueryInCacheKey      bool             `json:"include_query_in_cache_key" yaml:"include_query_in_cache_key"`
+	FuzzyRefresh                bool             `json:"fuzzy_refresh" yaml:"fuzzy_refresh"`
+	FuzzyRefreshRate            float64          `json:"fuzzy_refresh_rate" yaml:"fuzzy_refresh_rate"`
+	CollapsedRequest            bool             `json:"collapsed_request" yaml:"collapsed_request"`
+	CollapsedRequestWaitTimeout Duration         `json:"collapsed_request_wait_timeout" yaml:"collapsed_request_wait_timeout"`
+	ObjectPoolEnabled           bool             `json:"object_pool_enabled" yaml:"object_pool_enabled"`
+	ObjectPollSize              int              `json:"object_poll_size" yaml:"object_poll_size"`
+	SliceSize                   uint64           `json:"slice_size" yaml:"slice_size"`
+	FillRangePercent            uint64           `json:"fill_range_percent" yaml:"fill_range_percent"`
+	VaryLimit                   int              `json:"vary_limit" yaml:"vary_limit"`
+	VaryIgnoreKey               []string         `json:"vary_ignore_key" yaml:"vary_ignore_key"`
+	TagHeader                   string           `json:"tag_header" yaml:"tag_header"`               // surrogate keys header, e.g. Surrogate-Key, Cache-Tag
+	Quotas                      []*quotaRule     `json:"quotas" yaml:"quotas"`                       // per-domain storage quotas
+	TTLRules                    []*ttlRule       `json:"ttl_rules" yaml:"ttl_rules"`                 // per-host and per-path ttl override
+	BypassRules                 []*bypassRule    `json:"bypass_rules" yaml:"bypass_rules"`           // requests sent to the origin without caching
+	TrustedProxies              []string         `json:"trusted_proxies" yaml:"trusted_proxies"`     // ip or cidr, the client ip is taken from X-Forwarded-For of these proxies only
+	Admission                   admissionOption  `json:"admission" yaml:"admission"`                 // admission policy of the new objects
+	Completion                  completionOption `json:"completion" yaml:"completion"`               // background completion of the partially cached objects
+	ReadAhead                   readAheadOption  `json:"read_ahead" yaml:"read_ahead"`               // sequential read-ahead of the following chunks
+	ParallelFetch               parallelOption   `json:"parallel_fetch" yaml:"parallel_fetch"`       // concurrent range requests of the large cold objects
+	ResumeRetries               int              `json:"resume_retries" yaml:"resume_retries"`       // 回源中断后续传的最大重试次数, 0 关闭
+	ClientRevalidate            bool             `json:"client_revalidate" yaml:"client_revalidate"` // request no-cache revalidates the fresh objects, except immutable
+	Hostname                    string           `json:"hostname" yaml:"hostname"`
+
+	admission      []admissionFilter
+	trustedProxies []netip.Prefix
+	filler         *chunkFiller
+	readAhead      *readAhead
 }
 
 func init() {
@@ -77,11 +94,33 @@ func Middleware(c *configv1.Middleware) (middleware.Middleware, func(), error) {
 		ObjectPollSize:    20000,
 		SliceSize:         1048576, // 切片大小 默认1MB, 从配置文件 storage.slice_size 配置
 		FillRangePercent:  100,     // Range 默认填充百分比, 参考 fillRange 处理器对百分比的计算
+		TagHeader:         "Surrogate-Key",
+		ResumeRetries:     3,
 	}
 	if err := c.Unmarshal(opts); err != nil {
 		return nil, middleware.EmptyCleanup, err
 	}
 
+	if err := initTTLRules(opts.TTLRules); err != nil {
+		return nil, middleware.EmptyCleanup, err
+	}
+	trusted, err := parseTrustedProxies(opts.TrustedProxies)
+	if err != nil {
+		return nil, middleware.EmptyCleanup, err
+	}
+	opts.trustedProxies = trusted
+	if err := initBypassRules(opts.BypassRules, trusted); err != nil {
+		return nil, middleware.EmptyCleanup, err
+	}
+
+	opts.ParallelFetch.init(opts.SliceSize)
+
+	admission, err := newAdmissionFilters(&opts.Admission, opts.Quotas)
+	if err != nil {
+		return nil, middleware.EmptyCleanup, err
+	}
+	opts.admission = admission
+
 	log.Infof("middleware.caching inited %v", opts.SliceSize)
 
 	processor := NewProcessorChain(
@@ -105,6 +144,19 @@ func Middleware(c *configv1.Middleware) (middleware.Middleware, func(), error) {
 		),
 	).fill()
 
+	filler, err := newChunkFiller(opts, processor)
+	if err != nil {
+		return nil, middleware.EmptyCleanup, err
+	}
+	opts.filler = filler
+
+	readAhead, err := newReadAhead(opts, processor)
+	if err != nil {
+		filler.Close()
+		return nil, middleware.EmptyCleanup, err
+	}
+	opts.readAhead = readAhead
+
 	return func(origin http.RoundTripper) http.RoundTripper {
 
 		proxyClient := proxy.GetProxy()
@@ -139,6 +191,12 @@ func Middleware(c *configv1.Middleware) (middleware.Middleware, func(), error) {
 			if caching.hit {
 				caching.cacheStatus = storage.CacheHit
 
+				// client preconditions, 304 / 412 without body.
+				if resp = caching.conditionalRespond(); resp != nil {
+					resp, err = caching.processor.postCacheProcessor(caching, req, resp)
+					return
+				}
+
 				rng, err1 := xhttp.SingleRange(req.Header.Get("Range"), caching.md.Size)
 				if err1 != nil {
 					// 无效 Range 处理
@@ -150,31 +208,49 @@ func Middleware(c *configv1.Middleware) (middleware.Middleware, func(), error) {
 
 				// mark cache status with Range requests.
 				caching.markCacheStatus(rng.Start, rng.End)
+				// the popular partially cached object is completed in the background.
+				opts.filler.hit(caching)
+				// the sequential range access prefetches the following chunks.
+				opts.readAhead.observe(caching, req)
 
 				// find file seek(start, end)
-				resp, err = caching.lazilyRespond(req, rng.Start, rng.End)
-				if err != nil {
-					// fd leak
-					closeBody(resp)
+				if caching.needFullFetch(req) {
+					resp, err = caching.fullFetch(req, rng.Start, rng.End)
+				} else {
+					resp, err = caching.lazilyRespond(req, rng.Start, rng.End)
+				}
+				if err == nil {
+					// response now
+					resp, err = caching.processor.postCacheProcessor(caching, req, resp)
+					return
+				}
+
+				// fd leak
+				closeBody(resp)
+				if !errors.Is(err, errObjectChanged) {
 					return nil, err
 				}
 
-				// response now
-				resp, err = caching.processor.postCacheProcessor(caching, req, resp)
-				return
+				// the stale object is discarded, retry from the new version as the full MISS.
+				caching.log.Warnf("object %s changed, retry from the origin", caching.id.Key())
+				caching.md, caching.hit, caching.fileChanged = nil, false, false
+				caching.cacheStatus = storage.CacheMiss
 			}
 
 			// full MISS
-			resp, err = caching.doProxy(req, false)
+			resp, err = caching.doParallelProxy(req)
 			if err != nil {
 				return nil, err
 			}
+			// the origin ignored the Range, serve the client range from the full object.
+			resp = caching.rangeFromFull(req, resp)
+			opts.readAhead.observe(caching, req)
 
 			resp, err = processor.postCacheProcessor(caching, req, resp)
 			return
 		})
 
-	}, middleware.EmptyCleanup, nil
+	}, filler.Close, nil
 }
 
 func (c *Caching) lazilyRespond(req *http.Request, start, end int64) (*http.Response, error) {
@@ -186,6 +262,8 @@ func (c *Caching) lazilyRespond(req *http.Request, start, end int64) (*http.Resp
 	startOffset := start % int64(psize)
 
 	c.md.LastRefUnix = time.Now().Unix()
+	// the sub-requests of the missing chunks update the metadata in the background.
+	code, size := c.md.Code, c.md.Size
 
 	c.log.Debugf("lazilyRespond %s %s start %d end %d", req.Method, c.id.Key(), start, end)
 
@@ -201,7 +279,7 @@ func (c *Caching) lazilyRespond(req *http.Request, start, end int64) (*http.Resp
 		if count == -1 {
 			iobuf.AllCloser(readers).Close()
 			readers = []io.ReadCloser{
-				iobuf.RangeReader(reader, 0, int(c.md.Size-1), int(start), int(end)),
+				iobuf.RangeReader(reader, 0, int(size-1), int(start), int(end)),
 			}
 			break
 		}
@@ -224,6 +302,17 @@ func (c *Caching) lazilyRespond(req *http.Request, start, end int64) (*http.Resp
 		i += count
 	}
 
+	// the status of the sub-range requests are resolved before responding, the object changed
+	// in any of them is retried from the new version instead of the truncated response.
+	subRequests := c.subRequests
+	c.subRequests = nil
+	for _, r := range subRequests {
+		if err := iobuf.WaitAsync(r); err != nil {
+			iobuf.AllCloser(readers).Close()
+			return nil, err
+		}
+	}
+
 	in := iobuf.PartsReader(iobuf.AllCloser(readers), readers...)
 	if req.Method == http.MethodHead {
 		in = nil
@@ -232,8 +321,8 @@ func (c *Caching) lazilyRespond(req *http.Request, start, end int64) (*http.Resp
 
 	resp := &http.Response{
 		// 状态码可以统一在这里固定 200，由 PostRequest 阶段或 postCacheProcessor 统一处理
-		StatusCode:    c.md.Code, // http.StatusOK,
-		ContentLength: int64(c.md.Size),
+		StatusCode:    code, // http.StatusOK,
+		ContentLength: int64(size),
 		Header:        make(http.Header),
 		Body:          in,
 	}
@@ -243,11 +332,14 @@ func (c *Caching) lazilyRespond(req *http.Request, start, end int64) (*http.Resp
 	for k := range keyMap {
 		resp.Header.Del(k)
 	}
+	if c.opt.TagHeader != "" {
+		resp.Header.Del(c.opt.TagHeader)
+	}
 
 	// 206 Range 头处理
 	if req.Header.Get("Range") != "" {
 		resp.StatusCode = http.StatusPartialContent
-		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, c.md.Size))
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
 	}
 
 	// 计算真实 CL, 这里主要防止出现 0 body size 的情况
@@ -257,6 +349,40 @@ func (c *Caching) lazilyRespond(req *http.Request, start, end int64) (*http.Resp
 	return resp, nil
 }
 
+// conditionalRespond evaluates the client preconditions against the cached validators (RFC 9110 13),
+// returns the 304 / 412 response, or nil to serve the cached content.
+//
+// the Range of the client request is dropped if the If-Range validator not matched, the full 200 is served.
+func (c *Caching) conditionalRespond() *http.Response {
+	if c.md == nil || c.md.Code != http.StatusOK {
+		return nil
+	}
+
+	etag, lastModified := c.md.Headers.Get("ETag"), c.md.Headers.Get("Last-Modified")
+
+	switch xhttp.CheckPreconditions(c.req, etag, lastModified) {
+	case xhttp.PreconditionNotModified:
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Header:     xhttp.NotModifiedHeader(c.md.Headers),
+			Body:       http.NoBody,
+		}
+	case xhttp.PreconditionFailed:
+		header := make(http.Header)
+		header.Set("Content-Length", "0")
+		return &http.Response{
+			StatusCode: http.StatusPreconditionFailed,
+			Header:     header,
+			Body:       http.NoBody,
+		}
+	}
+
+	if c.req.Header.Get("Range") != "" && !xhttp.CheckIfRange(c.req, etag, lastModified) {
+		c.req.Header.Del("Range")
+	}
+	return nil
+}
+
 func (c *Caching) getUpstreamReader(fromByte, toByte uint64, async bool) (io.ReadCloser, error) {
 	// get from origin request header
 	rawRange := c.req.Header.Get("Range")
@@ -279,6 +405,10 @@ func (c *Caching) getUpstreamReader(fromByte, toByte uint64, async bool) (io.Rea
 		}
 		// 部分命中
 		c.cacheStatus = storage.CachePartHit
+		// 源站不支持 Range, 从完整响应中截取
+		if ignoredRange(req, resp) {
+			return c.sliceFullResponse(resp, fromByte, toByte), nil
+		}
 		// 发起的是 206 请求，但是返回的非 206
 		if resp.StatusCode != http.StatusPartialContent {
 			c.log.Warnf("getUpstreamReader doProxy[part]: status code: %d, bod size: %d", resp.StatusCode, resp.ContentLength)
@@ -306,11 +436,33 @@ func (c *Caching) doProxy(req *http.Request, subRequest bool) (*http.Response, e
 
 	c.log.Debugf("doProxy begin with %s", proxyReq.URL.String())
 
-	resp, err := c.proxyClient.Do(proxyReq, c.opt.CollapsedRequest, c.opt.CollapsedRequestWaitTimeout.AsDuration())
+	// the sub-range request is stitched with the stored chunks, the version must be the same.
+	ifRange := subRequest && c.setIfRange(proxyReq)
+
+	reqTime := time.Now()
+	// the bypassed request, e.g. logged-in user, never shares the upstream response.
+	collapsed := c.opt.CollapsedRequest && !c.bypass
+	resp, err := c.proxyClient.Do(proxyReq, collapsed, c.opt.CollapsedRequestWaitTimeout.AsDuration())
 	if err != nil {
 		return resp, err
 	}
 
+	if ifRange && resp.StatusCode == http.StatusOK {
+		// the mixed versions are never stitched, the stale object is discarded.
+		if !sameValidators(c.md.Headers, resp.Header) {
+			closeBody(resp)
+			c.log.Warnf("doProxy[part] object changed, etag %q lm %q, discard %s",
+				resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), c.id.Key())
+			_ = c.bucket.DiscardWithMessage(context.Background(), c.id, "file changed with if-range not match")
+			return nil, errObjectChanged
+		}
+		// the validator matched, the origin ignores the range.
+		markNoRange(c.req.Host)
+	} else if ignoredRange(proxyReq, resp) {
+		// the origin without range support, later requests go straight to the full-object fetch.
+		markNoRange(c.req.Host)
+	}
+
 	c.log.Debugf("doProxy upstream resp content-length %d content-range %s etag %q lm %q",
 		resp.ContentLength, resp.Header.Get("Content-Range"),
 		resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
@@ -322,6 +474,13 @@ func (c *Caching) doProxy(req *http.Request, subRequest bool) (*http.Response, e
 
 	var proxyErr error
 
+	// surrogate keys are indexed with the object and never sent to the client.
+	var tags []string
+	if c.opt.TagHeader != "" {
+		tags = xhttp.ParseSurrogateKeys(resp.Header.Values(c.opt.TagHeader))
+		resp.Header.Del(c.opt.TagHeader)
+	}
+
 	// handle redirect caching
 	if resp.StatusCode == http.StatusFound || resp.StatusCode == http.StatusMovedPermanently {
 		// origin response
@@ -358,9 +517,10 @@ func (c *Caching) doProxy(req *http.Request, subRequest bool) (*http.Response, e
 	}
 
 	// parsed cache-control header
-	expiredAt, cacheable := xhttp.ParseCacheTime("", resp.Header)
+	expiredAt, cacheable := c.cacheTime(resp.Header)
 
 	now := time.Now()
+	newObject := c.md == nil
 	if c.md == nil {
 		c.md = &object.Metadata{
 			ID:          c.id,
@@ -370,15 +530,24 @@ func (c *Caching) doProxy(req *http.Request, subRequest bool) (*http.Response, e
 			Size:        respRange.ObjSize,
 			Code:        http.StatusOK,
 			RespUnix:    now.Unix(),
+			CreatedUnix: now.Unix(),
 			LastRefUnix: now.Unix(),
 		}
 	}
 
+	// the age of the response when received, includes the upstream Age.
+	initialAge := xhttp.CorrectedInitialAge(resp.Header, reqTime, now)
+
 	c.cacheable = cacheable
-	// expire time
-	c.md.ExpiresAt = now.Add(expiredAt).Unix()
+	// expire time, the freshness lifetime minus the age.
+	c.md.ExpiresAt = now.Add(expiredAt - initialAge).Unix()
 	c.md.RespUnix = now.Unix()
+	c.md.InitialAge = int64(initialAge / time.Second)
 	c.md.LastRefUnix = now.Unix()
+	// 304 without the tag header keeps the stored surrogate keys.
+	if !notModified || len(tags) > 0 {
+		c.md.Tags = tags
+	}
 
 	// file changed.
 	if !notModified {
@@ -399,11 +568,22 @@ func (c *Caching) doProxy(req *http.Request, subRequest bool) (*http.Response, e
 			c.md.Headers = copiedHeaders
 		}
 
-		// flushbuffer 文件从这里写出到 bucket / disk
-		flushBuffer, cleanup := c.flushbufferSlice(respRange)
+		// the new object not admitted, e.g. not popular enough or over the domain quota, is proxied without caching.
+		if !c.bypass && newObject && !subRequest && !c.admit(int64(respRange.ObjSize)) {
+			c.bypass = true
+			c.cacheStatus = storage.BYPASS
+		}
+
+		// 回源连接中断时从已接收的位置续传
+		resp.Body = c.resumable(proxyReq, resp, respRange)
+
+		if !c.bypass {
+			// flushbuffer 文件从这里写出到 bucket / disk
+			flushBuffer, cleanup := c.flushbufferSlice(respRange)
 
-		// save body stream to bucket(disk).
-		resp.Body = iobuf.SavepartAsyncReader(resp.Body, c.md.BlockSize, uint(respRange.Start), flushBuffer, c.flushFailed, cleanup, 8)
+			// save body stream to bucket(disk).
+			resp.Body = iobuf.SavepartAsyncReader(resp.Body, c.md.BlockSize, uint(respRange.Start), flushBuffer, c.flushFailed, cleanup, 8)
+		}
 	}
 
 	resp, err = c.processor.PostRequest(c, proxyReq, resp)
@@ -580,6 +760,12 @@ func (c *Caching) flushbufferSlice(respRange xhttp.ContentRange) (iobuf.EventSuc
 
 // flushFailed flush cache file to bucket failed callback
 func (c *Caching) flushFailed(err error) {
+	// the upstream broken mid-body, the chunks fully written are kept and stored on close.
+	if errors.Is(err, errUpstreamInterrupted) && !c.noContentLen && c.md != nil && c.md.Size > 0 {
+		c.log.Warnf("flush body to disk interrupted: %v, keep %d chunks", err, c.md.Chunks.Count())
+		return
+	}
+
 	c.log.Errorf("flush body to disk failed: %v", err)
 	_ = c.bucket.DiscardWithMetadata(c.req.Context(), c.md)
 }
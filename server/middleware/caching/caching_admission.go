@@ -0,0 +1,228 @@
+package caching
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/pkg/algorithm/cmsketch"
+	"github.com/omalloc/tavern/storage"
+)
+
+const (
+	AdmissionPolicyNone     = ""          // admit all the new objects
+	AdmissionPolicyCountMin = "count-min" // in-memory count-min sketch, TinyLFU-style
+	AdmissionPolicySharedKV = "sharedkv"  // counters in the SharedKV, survive the restart
+
+	admissionKeyPrefix = "ad/"
+)
+
+var _metricAdmissionRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tr",
+	Subsystem: "tavern",
+	Name:      "admission_rejected_total",
+	Help:      "The total number of new objects rejected by the admission filter",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(_metricAdmissionRejected)
+}
+
+// admissionFilter decides whether the new object is stored, the rejected object is proxied as BYPASS.
+type admissionFilter interface {
+	admit(host string, hash object.IDHash, size int64) bool
+}
+
+// admissionOption e.g.
+//
+//	admission:
+//	  policy: count-min
+//	  min_hits: 2
+//	  decay: 1h
+//	  sizes:
+//	    - host: "*.example.com"
+//	      min_size: 1024
+//	      max_size: 1073741824
+type admissionOption struct {
+	Policy  string      `json:"policy" yaml:"policy"`     // "", count-min, sharedkv
+	MinHits int         `json:"min_hits" yaml:"min_hits"` // 缓存前需要的请求次数, 默认 2 (second-hit caching)
+	Decay   Duration    `json:"decay" yaml:"decay"`       // 计数衰减周期, 默认 1h
+	Width   int         `json:"width" yaml:"width"`       // count-min 每行计数器数量, 默认 1M
+	Sizes   []*sizeRule `json:"sizes" yaml:"sizes"`       // per-host object size limits
+}
+
+// sizeRule limits the object size of each host matched by the rule.
+type sizeRule struct {
+	Host    string `json:"host" yaml:"host"`         // exact host or pattern, e.g. www.example.com, *.example.com
+	MinSize int64  `json:"min_size" yaml:"min_size"` // 0 is unlimited
+	MaxSize int64  `json:"max_size" yaml:"max_size"` // 0 is unlimited
+}
+
+func (r *sizeRule) match(host string) bool {
+	if r.Host == host {
+		return true
+	}
+	ok, _ := path.Match(r.Host, host)
+	return ok
+}
+
+// newAdmissionFilters returns the filters in order: size, frequency, quota.
+func newAdmissionFilters(opt *admissionOption, quotas []*quotaRule) ([]admissionFilter, error) {
+	filters := make([]admissionFilter, 0, 3)
+
+	for _, r := range opt.Sizes {
+		if _, err := path.Match(r.Host, ""); err != nil || r.Host == "" {
+			return nil, fmt.Errorf("invalid admission size host %q", r.Host)
+		}
+		if r.MaxSize > 0 && r.MinSize > r.MaxSize {
+			return nil, fmt.Errorf("invalid admission size of %s, min_size > max_size", r.Host)
+		}
+	}
+	if len(opt.Sizes) > 0 {
+		filters = append(filters, sizeFilter(opt.Sizes))
+	}
+
+	if opt.MinHits <= 0 {
+		opt.MinHits = 2
+	}
+	decay := opt.Decay.AsDuration()
+	if decay <= 0 {
+		decay = time.Hour
+	}
+
+	switch opt.Policy {
+	case AdmissionPolicyNone:
+	case AdmissionPolicyCountMin:
+		if opt.MinHits > 255 {
+			return nil, fmt.Errorf("invalid admission min_hits %d, max 255 of count-min", opt.MinHits)
+		}
+		if opt.Width <= 0 {
+			opt.Width = 1 << 20
+		}
+		filters = append(filters, &sketchFilter{
+			sketch:  cmsketch.New(opt.Width),
+			minHits: uint8(opt.MinHits),
+			decay:   decay,
+			next:    time.Now().Add(decay).UnixNano(),
+		})
+	case AdmissionPolicySharedKV:
+		filters = append(filters, &counterFilter{
+			minHits: uint32(opt.MinHits),
+			decay:   decay,
+			next:    time.Now().Add(decay).UnixNano(),
+		})
+	default:
+		return nil, fmt.Errorf("invalid admission policy %q", opt.Policy)
+	}
+
+	quota, err := newQuotaEnforcer(quotas)
+	if err != nil {
+		return nil, err
+	}
+	if quota != nil {
+		filters = append(filters, quota)
+	}
+	return filters, nil
+}
+
+// admit reports whether the new object is admitted to the cache, the rejected object is proxied as BYPASS.
+func (c *Caching) admit(size int64) bool {
+	if len(c.opt.admission) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(c.id.Path())
+	if err != nil {
+		return true
+	}
+
+	hash := c.id.Hash()
+	for _, f := range c.opt.admission {
+		if !f.admit(u.Host, hash, size) {
+			return false
+		}
+	}
+	return true
+}
+
+// sizeFilter rejects the object out of the size range of the first matched rule,
+// the object of unknown size (e.g. chunked) is admitted.
+type sizeFilter []*sizeRule
+
+func (s sizeFilter) admit(host string, _ object.IDHash, size int64) bool {
+	idx := slices.IndexFunc(s, func(r *sizeRule) bool { return r.match(host) })
+	if idx < 0 || size <= 0 {
+		return true
+	}
+
+	r := s[idx]
+	if (r.MinSize > 0 && size < r.MinSize) || (r.MaxSize > 0 && size > r.MaxSize) {
+		_metricAdmissionRejected.WithLabelValues("size").Inc()
+		return false
+	}
+	return true
+}
+
+// sketchFilter admits the object requested `minHits` times within the decay period,
+// the counters are halved every period so the old popularity fades out.
+type sketchFilter struct {
+	sketch  *cmsketch.Sketch
+	minHits uint8
+	decay   time.Duration
+	next    int64 // unix nano of the next decay
+}
+
+func (f *sketchFilter) admit(_ string, hash object.IDHash, _ int64) bool {
+	if now, next := time.Now().UnixNano(), atomic.LoadInt64(&f.next); now >= next &&
+		atomic.CompareAndSwapInt64(&f.next, next, now+int64(f.decay)) {
+		f.sketch.Decay()
+	}
+
+	if f.sketch.Incr(binary.BigEndian.Uint64(hash[:8])) < f.minHits {
+		_metricAdmissionRejected.WithLabelValues("frequency").Inc()
+		return false
+	}
+	return true
+}
+
+// counterFilter is the sketchFilter with exact counters in the SharedKV,
+// the counters are dropped every decay period.
+type counterFilter struct {
+	minHits uint32
+	decay   time.Duration
+	next    int64 // unix nano of the next reset
+}
+
+func (f *counterFilter) admit(_ string, hash object.IDHash, _ int64) bool {
+	ctx := context.Background()
+	kv := storage.Current().SharedKV()
+
+	if now, next := time.Now().UnixNano(), atomic.LoadInt64(&f.next); now >= next &&
+		atomic.CompareAndSwapInt64(&f.next, next, now+int64(f.decay)) {
+		if err := kv.DropPrefix(ctx, []byte(admissionKeyPrefix)); err != nil {
+			log.Warnf("admission counters reset failed: %v", err)
+		}
+	}
+
+	hits, err := kv.Incr(ctx, []byte(admissionKeyPrefix+hex.EncodeToString(hash[:])), 1)
+	if err != nil {
+		// the counter is unavailable, fallback to admit.
+		return true
+	}
+
+	if hits < f.minHits {
+		_metricAdmissionRejected.WithLabelValues("frequency").Inc()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package caching
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecondHitAdmission(t *testing.T) {
+	origin := newMockOrigin()
+	rt := newTestCaching(t, origin, map[string]any{
+		"slice_size": 1024,
+		"admission": map[string]any{
+			"policy":   "count-min",
+			"min_hits": 2,
+		},
+	})
+
+	const rawUrl = "http://www.example.com/path/to/admission.bin"
+	data := makebuf(3000)
+	origin.set(rawUrl, data)
+
+	// the first request is not admitted, proxied without caching.
+	_, body, status := doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, BYPASS, status)
+	assert.Nil(t, lookup(t, rawUrl).md)
+
+	// the second request is admitted and stored.
+	_, body, status = doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "MISS", status)
+	if md := lookup(t, rawUrl).md; assert.NotNil(t, md) {
+		assert.True(t, md.HasComplete())
+	}
+
+	_, body, status = doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "HIT", status)
+	assert.Len(t, origin.requests(), 2)
+}
+
+func TestAdmissionSizeRules(t *testing.T) {
+	filters, err := newAdmissionFilters(&admissionOption{
+		Sizes: []*sizeRule{
+			{Host: "*.example.com", MinSize: 1024, MaxSize: 4096},
+		},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, filters, 1)
+
+	f := filters[0]
+	assert.False(t, f.admit("www.example.com", [20]byte{}, 100))
+	assert.True(t, f.admit("www.example.com", [20]byte{}, 2048))
+	assert.False(t, f.admit("www.example.com", [20]byte{}, 8192))
+	// unknown size and the other hosts are admitted.
+	assert.True(t, f.admit("www.example.com", [20]byte{}, 0))
+	assert.True(t, f.admit("www.example.org", [20]byte{}, 100))
+
+	_, err = newAdmissionFilters(&admissionOption{
+		Sizes: []*sizeRule{{Host: "www.example.com", MinSize: 2, MaxSize: 1}},
+	}, nil)
+	assert.Error(t, err)
+}
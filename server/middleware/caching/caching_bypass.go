@@ -0,0 +1,229 @@
+package caching
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _metricBypassed = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tr",
+	Subsystem: "tavern",
+	Name:      "bypass_total",
+	Help:      "The total number of requests bypassed the cache by the rules",
+}, []string{"rule"})
+
+func init() {
+	prometheus.MustRegister(_metricBypassed)
+}
+
+// bypassRule sends the matched request to the origin without the cache lookup and storing,
+// the conditions of a rule are all required, the first matched rule wins. e.g.
+//
+//	bypass_rules:
+//	  - name: logged-in
+//	    cookies: ["sessionid", "wordpress_logged_in_*"]
+//	  - name: authorization
+//	    headers: ["Authorization"]
+//	  - name: api-write
+//	    methods: ["POST", "PUT", "DELETE"]
+//	    path: "^/api/"
+//	  - name: office
+//	    client_ips: ["10.0.0.0/8"]
+//	    query: ["nocache"]
+//
+// the client ip is the remote address, the X-Forwarded-For is only trusted from the `trusted_proxies`.
+type bypassRule struct {
+	Name      string   `json:"name" yaml:"name"`             // metrics label, default `rule-<index>`
+	Methods   []string `json:"methods" yaml:"methods"`       // e.g. POST PUT
+	Path      string   `json:"path" yaml:"path"`             // regexp of the url path
+	Headers   []string `json:"headers" yaml:"headers"`       // any of the request headers presents, e.g. Authorization
+	Cookies   []string `json:"cookies" yaml:"cookies"`       // any of the cookie names or patterns presents
+	Query     []string `json:"query" yaml:"query"`           // any of the query parameters presents
+	ClientIPs []string `json:"client_ips" yaml:"client_ips"` // any of the client ip or cidr matches
+
+	path     *regexp.Regexp
+	prefixes []netip.Prefix
+	trusted  []netip.Prefix // trusted proxies of the caching option
+}
+
+func (r *bypassRule) init(idx int) error {
+	if r.Name == "" {
+		r.Name = "rule-" + strconv.Itoa(idx)
+	}
+
+	if r.Path != "" {
+		re, err := regexp.Compile(r.Path)
+		if err != nil {
+			return fmt.Errorf("invalid bypass rule %s path %q: %w", r.Name, r.Path, err)
+		}
+		r.path = re
+	}
+
+	for i, m := range r.Methods {
+		r.Methods[i] = strings.ToUpper(m)
+	}
+
+	for _, c := range r.Cookies {
+		if _, err := path.Match(c, ""); err != nil {
+			return fmt.Errorf("invalid bypass rule %s cookie %q", r.Name, c)
+		}
+	}
+
+	for _, raw := range r.ClientIPs {
+		prefix, ok := parseClientPrefix(raw)
+		if !ok {
+			return fmt.Errorf("invalid bypass rule %s client ip %q", r.Name, raw)
+		}
+		r.prefixes = append(r.prefixes, prefix)
+	}
+
+	if len(r.Methods) == 0 && r.path == nil && len(r.Headers) == 0 && len(r.Cookies) == 0 &&
+		len(r.Query) == 0 && len(r.prefixes) == 0 {
+		return fmt.Errorf("empty bypass rule %s", r.Name)
+	}
+	return nil
+}
+
+func (r *bypassRule) match(req *http.Request) bool {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, req.Method) {
+		return false
+	}
+
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if len(r.Headers) > 0 && !slices.ContainsFunc(r.Headers, func(h string) bool { return req.Header.Get(h) != "" }) {
+		return false
+	}
+
+	if len(r.Cookies) > 0 && !r.matchCookie(req) {
+		return false
+	}
+
+	if len(r.Query) > 0 {
+		query := req.URL.Query()
+		if !slices.ContainsFunc(r.Query, query.Has) {
+			return false
+		}
+	}
+
+	if len(r.prefixes) > 0 {
+		addr, ok := clientAddr(req, r.trusted)
+		if !ok || !slices.ContainsFunc(r.prefixes, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *bypassRule) matchCookie(req *http.Request) bool {
+	for _, cookie := range req.Cookies() {
+		for _, pattern := range r.Cookies {
+			if pattern == cookie.Name {
+				return true
+			}
+			if ok, _ := path.Match(pattern, cookie.Name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientAddr returns the client ip of the request, the X-Forwarded-For is only trusted
+// if the request comes from the trusted proxies, the rightmost untrusted hop wins.
+func clientAddr(req *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+
+	isTrusted := func(a netip.Addr) bool {
+		return slices.ContainsFunc(trusted, func(p netip.Prefix) bool { return p.Contains(a) })
+	}
+	if !isTrusted(addr) {
+		return addr, true
+	}
+
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		hopAddr, err1 := netip.ParseAddr(hop)
+		if err1 != nil {
+			// garbage from the untrusted client.
+			return addr, true
+		}
+		if addr = hopAddr.Unmap(); !isTrusted(addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// initBypassRules inits the rules, the client ips behind the `trusted` proxies are taken from the X-Forwarded-For.
+func initBypassRules(rules []*bypassRule, trusted []netip.Prefix) error {
+	for i, r := range rules {
+		if err := r.init(i); err != nil {
+			return err
+		}
+		r.trusted = trusted
+	}
+	return nil
+}
+
+// parseTrustedProxies parses the trusted proxies of the caching option.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, raw := range proxies {
+		prefix, ok := parseClientPrefix(raw)
+		if !ok {
+			return nil, fmt.Errorf("invalid trusted proxy %q", raw)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// parseClientPrefix parses the cidr or the single ip, e.g. `10.0.0.0/8`, `::1`.
+func parseClientPrefix(raw string) (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(raw)
+	if err != nil {
+		addr, err1 := netip.ParseAddr(raw)
+		if err1 != nil {
+			return netip.Prefix{}, false
+		}
+		addr = addr.Unmap()
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return prefix.Masked(), true
+}
+
+// bypassed returns the name of the first matched bypass rule.
+func (o *cachingOption) bypassed(req *http.Request) (string, bool) {
+	for _, r := range o.BypassRules {
+		if r.match(req) {
+			_metricBypassed.WithLabelValues(r.Name).Inc()
+			return r.Name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,192 @@
+package caching
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBypassRuleMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		rule       bypassRule
+		method     string
+		url        string
+		header     http.Header
+		remoteAddr string
+		trusted    []string
+		want       bool
+	}{
+		{name: "method", rule: bypassRule{Methods: []string{"post"}}, method: http.MethodPost, want: true},
+		{name: "other method", rule: bypassRule{Methods: []string{"POST"}}, want: false},
+		{name: "path", rule: bypassRule{Path: "^/api/"}, url: "http://www.example.com/api/users", want: true},
+		{name: "other path", rule: bypassRule{Path: "^/api/"}, url: "http://www.example.com/static/api/1.js", want: false},
+		{
+			name: "method and path",
+			rule: bypassRule{Methods: []string{"PUT"}, Path: "^/api/"},
+			url:  "http://www.example.com/api/users",
+			want: false,
+		},
+		{name: "header", rule: bypassRule{Headers: []string{"X-Debug", "Authorization"}}, header: http.Header{"Authorization": {"Bearer token"}}, want: true},
+		{name: "empty header", rule: bypassRule{Headers: []string{"Authorization"}}, header: http.Header{"Authorization": {""}}, want: false},
+		{name: "cookie", rule: bypassRule{Cookies: []string{"sessionid"}}, header: http.Header{"Cookie": {"lang=en; sessionid=1"}}, want: true},
+		{name: "cookie pattern", rule: bypassRule{Cookies: []string{"wordpress_logged_in_*"}}, header: http.Header{"Cookie": {"wordpress_logged_in_abc=1"}}, want: true},
+		{name: "other cookie", rule: bypassRule{Cookies: []string{"sessionid"}}, header: http.Header{"Cookie": {"lang=en"}}, want: false},
+		{name: "without cookie", rule: bypassRule{Cookies: []string{"*"}}, want: false},
+		{name: "query", rule: bypassRule{Query: []string{"nocache"}}, url: "http://www.example.com/1.jpg?nocache", want: true},
+		{name: "other query", rule: bypassRule{Query: []string{"nocache"}}, url: "http://www.example.com/1.jpg?v=nocache", want: false},
+		{name: "client cidr", rule: bypassRule{ClientIPs: []string{"192.168.0.0/16"}}, remoteAddr: "192.168.1.10:5000", want: true},
+		{name: "client ip", rule: bypassRule{ClientIPs: []string{"192.168.1.10"}}, remoteAddr: "192.168.1.10:5000", want: true},
+		{name: "other client", rule: bypassRule{ClientIPs: []string{"192.168.0.0/16"}}, remoteAddr: "172.16.0.1:5000", want: false},
+		{name: "client ipv4 mapped", rule: bypassRule{ClientIPs: []string{"192.168.0.0/16"}}, remoteAddr: "[::ffff:192.168.1.10]:5000", want: true},
+		{name: "client ipv6", rule: bypassRule{ClientIPs: []string{"2001:db8::/32"}}, remoteAddr: "[2001:db8::1]:5000", want: true},
+		{
+			name:       "client spoofed forwarded",
+			rule:       bypassRule{ClientIPs: []string{"192.168.0.0/16"}},
+			header:     http.Header{"X-Forwarded-For": {"192.168.1.10"}, "X-Real-Ip": {"192.168.1.10"}},
+			remoteAddr: "172.16.0.1:5000",
+			want:       false,
+		},
+		{
+			name:       "client forwarded by trusted proxy",
+			rule:       bypassRule{ClientIPs: []string{"192.168.0.0/16"}},
+			header:     http.Header{"X-Forwarded-For": {"192.168.1.10"}},
+			remoteAddr: "172.16.0.1:5000",
+			trusted:    []string{"172.16.0.0/12"},
+			want:       true,
+		},
+		{
+			name:       "client spoofed behind trusted proxy",
+			rule:       bypassRule{ClientIPs: []string{"192.168.0.0/16"}},
+			header:     http.Header{"X-Forwarded-For": {"192.168.1.10, 8.8.8.8, 172.16.0.2"}},
+			remoteAddr: "172.16.0.1:5000",
+			trusted:    []string{"172.16.0.0/12"},
+			want:       false,
+		},
+		{
+			name:       "client garbage behind trusted proxy",
+			rule:       bypassRule{ClientIPs: []string{"172.16.0.0/12"}},
+			header:     http.Header{"X-Forwarded-For": {"unknown"}},
+			remoteAddr: "172.16.0.1:5000",
+			trusted:    []string{"172.16.0.0/12"},
+			want:       true,
+		},
+		{name: "invalid client", rule: bypassRule{ClientIPs: []string{"0.0.0.0/0"}}, remoteAddr: "unknown", want: false},
+		{
+			name:       "all conditions",
+			rule:       bypassRule{ClientIPs: []string{"10.0.0.0/8"}, Query: []string{"nocache"}},
+			url:        "http://www.example.com/1.jpg?nocache=1",
+			remoteAddr: "10.1.2.3:5000",
+			want:       true,
+		},
+		{
+			name:       "one condition failed",
+			rule:       bypassRule{ClientIPs: []string{"10.0.0.0/8"}, Query: []string{"nocache"}},
+			url:        "http://www.example.com/1.jpg",
+			remoteAddr: "10.1.2.3:5000",
+			want:       false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := parseTrustedProxies(tt.trusted)
+			require.NoError(t, err)
+			require.NoError(t, initBypassRules([]*bypassRule{&tt.rule}, trusted))
+
+			method, rawUrl := tt.method, tt.url
+			if method == "" {
+				method = http.MethodGet
+			}
+			if rawUrl == "" {
+				rawUrl = "http://www.example.com/1.jpg"
+			}
+			req, err := http.NewRequest(method, rawUrl, nil)
+			require.NoError(t, err)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			req.RemoteAddr = tt.remoteAddr
+
+			assert.Equal(t, tt.want, tt.rule.match(req))
+		})
+	}
+}
+
+func TestBypassRuleInit(t *testing.T) {
+	for _, r := range []*bypassRule{
+		{},
+		{Name: "path", Path: "("},
+		{Name: "cookie", Cookies: []string{"["}},
+		{Name: "client", ClientIPs: []string{"10.0.0.0/33"}},
+		{Name: "client", ClientIPs: []string{"localhost"}},
+	} {
+		assert.Error(t, r.init(0))
+	}
+
+	rules := []*bypassRule{
+		{Methods: []string{"post"}},
+		{Name: "office", ClientIPs: []string{"10.1.2.3/8"}},
+	}
+	require.NoError(t, initBypassRules(rules, nil))
+	assert.Equal(t, "rule-0", rules[0].Name)
+	assert.Equal(t, []string{"POST"}, rules[0].Methods)
+	assert.Equal(t, "10.0.0.0/8", rules[1].prefixes[0].String())
+
+	_, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1", "proxy"})
+	assert.Error(t, err)
+}
+
+func TestBypassedFirstRuleWins(t *testing.T) {
+	opt := &cachingOption{
+		BypassRules: []*bypassRule{
+			{Name: "authorization", Headers: []string{"Authorization"}},
+			{Name: "api", Path: "^/api/"},
+		},
+	}
+	require.NoError(t, initBypassRules(opt.BypassRules, nil))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/api/users", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	name, ok := opt.bypassed(req)
+	assert.True(t, ok)
+	assert.Equal(t, "authorization", name)
+
+	req.Header.Del("Authorization")
+	name, ok = opt.bypassed(req)
+	assert.True(t, ok)
+	assert.Equal(t, "api", name)
+
+	req, _ = http.NewRequest(http.MethodGet, "http://www.example.com/1.jpg", nil)
+	_, ok = opt.bypassed(req)
+	assert.False(t, ok)
+}
+
+func TestBypassRuleNotStored(t *testing.T) {
+	origin := newMockOrigin()
+	rt := newTestCaching(t, origin, map[string]any{
+		"bypass_rules": []map[string]any{
+			{"name": "authorization", "headers": []string{"Authorization"}},
+		},
+	})
+
+	const rawUrl = "http://www.example.com/path/to/bypass.bin"
+	data := makebuf(2048)
+	origin.set(rawUrl, data)
+
+	auth := http.Header{"Authorization": {"Bearer token"}}
+	for range 2 {
+		_, body, status := doRequest(t, rt, rawUrl, auth)
+		assert.Equal(t, data, body)
+		assert.Equal(t, BYPASS, status)
+	}
+	assert.Nil(t, lookup(t, rawUrl).md)
+	assert.Len(t, origin.requests(), 2)
+
+	// the request without the header is cached.
+	_, body, status := doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "MISS", status)
+	assert.NotNil(t, lookup(t, rawUrl).md)
+}
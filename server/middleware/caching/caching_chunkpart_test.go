@@ -56,7 +56,8 @@ func Test_getContents(t *testing.T) {
 			BlockSize: 1048576, // 1MB 块大小
 			Chunks:    bitmap.Bitmap{},
 		},
-		bucket: emptyBucket,
+		bucket:      emptyBucket,
+		proxyClient: newMockOrigin(),
 	}
 
 	// 模拟已有的块：0, 2
@@ -87,4 +88,8 @@ func Test_getContents(t *testing.T) {
 	// 因找到首个 chunk1 时，会找到最近的一个 HIT chunk,并拼接成一个流
 	// 所以最终会返回一个流，包含 chunk1 和 chunk2 的数据
 	assert.Equal(t, 1, len(readers))
+
+	for _, r := range readers {
+		_ = r.Close()
+	}
 }
@@ -0,0 +1,265 @@
+package caching
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/internal/constants"
+	"github.com/omalloc/tavern/pkg/algorithm/cmsketch"
+	"github.com/omalloc/tavern/proxy"
+)
+
+// completionDecay the hits of the partial objects are halved every period.
+const completionDecay = time.Hour
+
+var _metricCompletion = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tr",
+	Subsystem: "tavern",
+	Name:      "completion_total",
+	Help:      "The total number of background completions of the partially cached objects",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(_metricCompletion)
+}
+
+// completionOption e.g.
+//
+//	completion:
+//	  enabled: true
+//	  min_hits: 3
+//	  concurrency: 2
+//	  queue_size: 1024
+type completionOption struct {
+	Enabled     bool `json:"enabled" yaml:"enabled"`
+	MinHits     int  `json:"min_hits" yaml:"min_hits"`       // 部分缓存对象的命中次数阈值, 默认 3
+	Concurrency int  `json:"concurrency" yaml:"concurrency"` // 并发补全的对象数, 默认 2
+	QueueSize   int  `json:"queue_size" yaml:"queue_size"`   // 待补全队列长度, 队列满时丢弃, 默认 1024
+}
+
+// fillTask is a partially cached object waiting for the completion.
+type fillTask struct {
+	id     *object.ID
+	bucket storagev1.Bucket
+	req    *http.Request
+}
+
+// chunkFiller fetches the missing chunks of the popular partially cached objects in the background,
+// the completed objects are served from the disk and revalidatable.
+type chunkFiller struct {
+	opt       *cachingOption
+	processor *ProcessorChain
+	sketch    *cmsketch.Sketch
+	minHits   uint8
+	next      int64 // unix nano of the next decay
+
+	queue    chan *fillTask
+	inflight sync.Map // object.IDHash -> struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newChunkFiller(opt *cachingOption, processor *ProcessorChain) (*chunkFiller, error) {
+	c := &opt.Completion
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	if c.MinHits <= 0 {
+		c.MinHits = 3
+	}
+	if c.MinHits > 255 {
+		return nil, fmt.Errorf("invalid completion min_hits %d, max 255", c.MinHits)
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 2
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 1024
+	}
+
+	f := &chunkFiller{
+		opt:       opt,
+		processor: processor,
+		sketch:    cmsketch.New(c.QueueSize * 64),
+		minHits:   uint8(c.MinHits),
+		next:      time.Now().Add(completionDecay).UnixNano(),
+		queue:     make(chan *fillTask, c.QueueSize),
+		stop:      make(chan struct{}),
+	}
+
+	for i := 0; i < c.Concurrency; i++ {
+		f.wg.Add(1)
+		go f.worker()
+	}
+	return f, nil
+}
+
+// Close stops the workers, the queued tasks are dropped.
+func (f *chunkFiller) Close() {
+	if f == nil {
+		return
+	}
+	close(f.stop)
+	f.wg.Wait()
+}
+
+// hit counts the hit of the partially cached object, the object reached the threshold is queued.
+func (f *chunkFiller) hit(c *Caching) {
+	if f == nil || c.prefetch || c.md == nil || !completable(c.md) {
+		return
+	}
+
+	if now, next := time.Now().UnixNano(), atomic.LoadInt64(&f.next); now >= next &&
+		atomic.CompareAndSwapInt64(&f.next, next, now+int64(completionDecay)) {
+		f.sketch.Decay()
+	}
+
+	hash := c.id.Hash()
+	if f.sketch.Incr(binary.BigEndian.Uint64(hash[:8])) < f.minHits {
+		return
+	}
+
+	if _, loaded := f.inflight.LoadOrStore(hash, struct{}{}); loaded {
+		return
+	}
+
+	select {
+	case f.queue <- &fillTask{id: c.id, bucket: c.bucket, req: backgroundRequest(c.req)}:
+	default:
+		// low priority, drop the task when the queue is full.
+		f.inflight.Delete(hash)
+		_metricCompletion.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (f *chunkFiller) worker() {
+	defer f.wg.Done()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case t := <-f.queue:
+			result := "completed"
+			if err := f.fill(t); err != nil {
+				result = "failed"
+				log.Warnf("completion of %s failed: %v", t.id.Key(), err)
+			}
+			_metricCompletion.WithLabelValues(result).Inc()
+			f.inflight.Delete(t.id.Hash())
+		}
+	}
+}
+
+// fill fetches the missing chunks of the object range by range, one sub-request at a time.
+func (f *chunkFiller) fill(t *fillTask) error {
+	md, err := t.bucket.Lookup(context.Background(), t.id)
+	if err != nil || md == nil || !completable(md) {
+		return err
+	}
+
+	c := &Caching{
+		log:         log.NewHelper(log.GetLogger()),
+		processor:   f.processor,
+		opt:         f.opt,
+		req:         t.req,
+		id:          t.id,
+		md:          md,
+		bucket:      t.bucket,
+		proxyClient: proxy.GetProxy(),
+		cacheStatus: storagev1.CachePartMiss,
+	}
+
+	for _, rng := range missingRanges(md) {
+		select {
+		case <-f.stop:
+			return nil
+		default:
+		}
+
+		full, err := c.fetchRange(t.req, rng[0], rng[1])
+		if err != nil {
+			return err
+		}
+		if full || c.fileChanged {
+			return nil
+		}
+	}
+
+	c.log.Debugf("completion of %s done, chunks %d", t.id.Key(), md.Chunks.Count())
+	return nil
+}
+
+// backgroundRequest clones the client request for the background fetch, without the range and preconditions.
+func backgroundRequest(req *http.Request) *http.Request {
+	req = req.Clone(context.Background())
+	for _, k := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		req.Header.Del(k)
+	}
+	req.Header.Del(constants.PrefetchCacheKey)
+	return req
+}
+
+// fetchRange stores the chunks of [from, to] from the origin without responding to any client,
+// full reports the origin without range support sent the full object, all the chunks are stored.
+func (c *Caching) fetchRange(req *http.Request, from, to uint64) (full bool, err error) {
+	req = req.Clone(context.Background())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to))
+
+	resp, err := c.doProxy(req, true)
+	if err != nil {
+		closeBody(resp)
+		return false, err
+	}
+
+	full = resp.StatusCode == http.StatusOK
+	if resp.StatusCode != http.StatusPartialContent && !full {
+		closeBody(resp)
+		return false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	closeBody(resp)
+	return full, err
+}
+
+// completable reports whether the object is partially cached with the known size.
+func completable(md *object.Metadata) bool {
+	return md.Code == http.StatusOK && md.Size > 0 && md.BlockSize > 0 &&
+		!md.IsVary() && !md.IsChunked() && !md.HasComplete()
+}
+
+// missingRanges returns the byte ranges of the consecutive missing chunks.
+func missingRanges(md *object.Metadata) [][2]uint64 {
+	var (
+		ranges [][2]uint64
+		last   = uint32((md.Size - 1) / md.BlockSize)
+	)
+
+	for idx := uint32(0); idx <= last; idx++ {
+		if md.Chunks.Contains(idx) {
+			continue
+		}
+
+		from := uint64(idx) * md.BlockSize
+		to := min(uint64(idx+1)*md.BlockSize, md.Size) - 1
+		if n := len(ranges); n > 0 && ranges[n-1][1]+1 == from {
+			ranges[n-1][1] = to
+			continue
+		}
+		ranges = append(ranges, [2]uint64{from, to})
+	}
+	return ranges
+}
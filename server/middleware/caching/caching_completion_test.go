@@ -0,0 +1,55 @@
+package caching
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompletionFillsPartialObject(t *testing.T) {
+	origin := newMockOrigin()
+	rt := newTestCaching(t, origin, map[string]any{
+		"slice_size": 1024,
+		"completion": map[string]any{
+			"enabled":     true,
+			"min_hits":    2,
+			"concurrency": 1,
+		},
+	})
+
+	const rawUrl = "http://www.example.com/path/to/completion.bin"
+	data := makebuf(4096 + 100)
+	origin.set(rawUrl, data)
+
+	firstChunk := http.Header{"Range": {"bytes=0-1023"}}
+	_, body, status := doRequest(t, rt, rawUrl, firstChunk)
+	assert.Equal(t, data[:1024], body)
+	assert.Equal(t, "MISS", status)
+
+	md := lookup(t, rawUrl).md
+	require.NotNil(t, md)
+	assert.False(t, md.HasComplete())
+	assert.Equal(t, 1, md.Chunks.Count())
+
+	// the partial object reached the hits is completed in the background.
+	for range 2 {
+		_, body, status = doRequest(t, rt, rawUrl, firstChunk)
+		assert.Equal(t, data[:1024], body)
+		assert.Equal(t, "HIT", status)
+	}
+
+	require.Eventually(t, func() bool {
+		md := lookup(t, rawUrl).md
+		return md != nil && md.HasComplete()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, []string{"bytes=0-1023", "bytes=1024-4195"}, origin.requests())
+
+	_, body, status = doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "HIT", status)
+	assert.Len(t, origin.requests(), 2)
+}
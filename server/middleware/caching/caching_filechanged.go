@@ -9,6 +9,9 @@ import (
 	xhttp "github.com/omalloc/tavern/pkg/x/http"
 )
 
+// errObjectChanged the origin object changed since the chunks stored, the sub-range request If-Range not matched.
+var errObjectChanged = errors.New("object changed with if-range not match")
+
 // _ is a compile-time assertion to ensure FileChangedProcessor implements the Processor interface.
 var _ Processor = (*FileChangedProcessor)(nil)
 
@@ -96,3 +99,34 @@ func parseLastModified(header string) (time.Time, error) {
 	}
 	return lm, nil
 }
+
+// setIfRange sets the stored strong ETag or Last-Modified to the If-Range of the sub-range request,
+// the origin sends the full 200 of the new version instead of the range. (RFC 9110 13.1.5)
+func (c *Caching) setIfRange(req *http.Request) bool {
+	// the client If-Range is evaluated against the cache already.
+	req.Header.Del("If-Range")
+	if c.md == nil || req.Header.Get("Range") == "" {
+		return false
+	}
+
+	if etag := c.md.Headers.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		req.Header.Set("If-Range", etag)
+		return true
+	}
+	if lm := c.md.Headers.Get("Last-Modified"); lm != "" {
+		req.Header.Set("If-Range", lm)
+		return true
+	}
+	return false
+}
+
+// sameValidators reports whether the response is the stored version by the validator of the If-Range.
+func sameValidators(stored, header http.Header) bool {
+	if etag := stored.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return header.Get("ETag") == etag
+	}
+
+	oldLm, err1 := http.ParseTime(stored.Get("Last-Modified"))
+	newLm, err2 := http.ParseTime(header.Get("Last-Modified"))
+	return err1 == nil && err2 == nil && oldLm.Equal(newLm)
+}
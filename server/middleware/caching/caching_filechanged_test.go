@@ -0,0 +1,44 @@
+package caching
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectChangedAfterCachedChunk(t *testing.T) {
+	origin := newMockOrigin()
+	rt := newTestCaching(t, origin, map[string]any{
+		"slice_size": 1024,
+	})
+
+	const rawUrl = "http://www.example.com/path/to/changed.bin"
+	data := makebuf(4096)
+	origin.set(rawUrl, data)
+
+	_, body, status := doRequest(t, rt, rawUrl, http.Header{"Range": {"bytes=0-1023"}})
+	assert.Equal(t, data[:1024], body)
+	assert.Equal(t, "MISS", status)
+
+	// the new version on the origin, the chunk 0 in the cache is stale.
+	changed := bytes.Repeat([]byte{'x'}, 4096)
+	origin.mu.Lock()
+	origin.etag = `"v2"`
+	origin.mu.Unlock()
+	origin.set(rawUrl, changed)
+
+	// the first chunk is served from the cache, the If-Range of the chunk 1 is not matched,
+	// the request is retried from the new version instead of the truncated response.
+	resp, body, status := doRequest(t, rt, rawUrl, http.Header{"Range": {"bytes=0-2047"}})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, changed[:2048], body)
+	assert.Equal(t, "MISS", status)
+	assert.Equal(t, `"v2"`, resp.Header.Get("ETag"))
+
+	md := lookup(t, rawUrl).md
+	require.NotNil(t, md)
+	assert.Equal(t, `"v2"`, md.Headers.Get("ETag"))
+}
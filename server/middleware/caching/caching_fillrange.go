@@ -50,7 +50,8 @@ func (f *fillRange) Lookup(c *Caching, req *http.Request) (bool, error) {
 // PreRequest implements [Processor].
 func (f *fillRange) PreRequest(c *Caching, req *http.Request) (*http.Request, error) {
 	rawRange := req.Header.Get("Range")
-	if rawRange == "" || f.fillRangePercent == 0 {
+	// the bypassed request is not stored, no need to fill.
+	if rawRange == "" || f.fillRangePercent == 0 || c.bypass {
 		return req, nil
 	}
 
@@ -145,6 +146,10 @@ func (f *fillRange) fill(c *Caching, req *http.Request, rawRange string) *http.R
 	if fill.newEnd-fill.rawEnd > int(maxFillSize) {
 		fill.newEnd = fill.rawEnd
 	}
+	// 已知文件大小时不超出文件末尾, 否则尾部分片读不到 EOF 无法落盘
+	if c.md != nil && c.md.Size > 0 && fill.newEnd >= int(objSize) {
+		fill.newEnd = int(objSize) - 1
+	}
 
 	// check validity
 	if fill.rawStart < 0 || fill.rawEnd < 0 {
@@ -0,0 +1,154 @@
+package caching
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/pkg/iobuf"
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
+)
+
+// noRangeTTL the origin host answered the range request with 200 is probed again after.
+const noRangeTTL = 24 * time.Hour
+
+var _metricNoRangeFill = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tr",
+	Subsystem: "tavern",
+	Name:      "norange_fill_total",
+	Help:      "The total number of full-object fetches for the origins without range support",
+}, []string{"host"})
+
+func init() {
+	prometheus.MustRegister(_metricNoRangeFill)
+}
+
+// noRangeHosts remembers the origin hosts ignoring the Range header, host -> expires unix.
+var noRangeHosts sync.Map
+
+func markNoRange(host string) {
+	if _, loaded := noRangeHosts.Swap(host, time.Now().Add(noRangeTTL).Unix()); !loaded {
+		log.Warnf("origin %s does not support range requests, fallback to full-object fetch", host)
+	}
+}
+
+func rangeUnsupported(host string) bool {
+	v, ok := noRangeHosts.Load(host)
+	if !ok {
+		return false
+	}
+	if time.Now().Unix() >= v.(int64) {
+		noRangeHosts.CompareAndDelete(host, v)
+		return false
+	}
+	return true
+}
+
+// ignoredRange reports whether the origin answers the range request with the full object,
+// the 200 of the mismatched If-Range is expected and not counted.
+func ignoredRange(proxyReq *http.Request, resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK &&
+		proxyReq.Header.Get("Range") != "" &&
+		proxyReq.Header.Get("If-Range") == ""
+}
+
+// needFullFetch reports whether the uncached chunks of the request are filled by the full-object fetch.
+func (c *Caching) needFullFetch(req *http.Request) bool {
+	if req.Method == http.MethodHead || c.md.HasComplete() {
+		return false
+	}
+	if c.cacheStatus != storage.CachePartHit && c.cacheStatus != storage.CachePartMiss {
+		return false
+	}
+	return rangeUnsupported(c.req.Host)
+}
+
+// fullFetch fetches the full object once for the origin without range support,
+// all the chunks are stored through the slice writer and the client range is served from the stream.
+func (c *Caching) fullFetch(req *http.Request, start, end int64) (*http.Response, error) {
+	proxyReq := c.req.Clone(context.Background())
+	for _, k := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		proxyReq.Header.Del(k)
+	}
+
+	_metricNoRangeFill.WithLabelValues(c.req.Host).Inc()
+
+	resp, err := c.doProxy(proxyReq, true)
+	if err != nil {
+		closeBody(resp)
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		c.log.Warnf("fullFetch: status code: %d, body size: %d", resp.StatusCode, resp.ContentLength)
+		closeBody(resp)
+		return nil, xhttp.NewBizError(resp.StatusCode, resp.Header)
+	}
+
+	if req.Header.Get("Range") == "" {
+		return resp, nil
+	}
+	return c.sliceFullResponse(resp, uint64(start), uint64(end)), nil
+}
+
+// rangeFromFull serves the client range from the full 200 response of the origin ignoring the Range,
+// the response of unknown size is sent as is.
+func (c *Caching) rangeFromFull(req *http.Request, resp *http.Response) *http.Response {
+	rawRange := req.Header.Get("Range")
+	if rawRange == "" || resp == nil || resp.StatusCode != http.StatusOK ||
+		c.bypass || c.noContentLen || c.md == nil || c.md.Size == 0 {
+		return resp
+	}
+
+	rng, err := xhttp.SingleRange(rawRange, c.md.Size)
+	if err != nil {
+		return resp
+	}
+	return c.sliceFullResponse(resp, uint64(rng.Start), uint64(rng.End))
+}
+
+// sliceFullResponse converts the full 200 response to the 206 of [from, to].
+func (c *Caching) sliceFullResponse(resp *http.Response, from, to uint64) *http.Response {
+	length := to - from + 1
+
+	resp.Body = sliceFullBody(resp.Body, from, length, !c.bypass)
+	resp.StatusCode = http.StatusPartialContent
+	resp.ContentLength = int64(length)
+	resp.Header.Set("Content-Range", xhttp.BuildHeaderRange(from, to, c.md.Size))
+	resp.Header.Set("Content-Length", strconv.FormatUint(length, 10))
+	return resp
+}
+
+// sliceFullBody returns `length` bytes from the offset of the full body,
+// the rest of the body is read in the background on Close when `drain`, so all the chunks are stored.
+func sliceFullBody(body io.ReadCloser, offset, length uint64, drain bool) io.ReadCloser {
+	r := iobuf.LimitReadCloser(iobuf.SkipReadCloser(body, int64(offset)), int64(length))
+	if !drain {
+		return r
+	}
+	return &drainReadCloser{Reader: r, R: body}
+}
+
+type drainReadCloser struct {
+	io.Reader
+
+	R    io.ReadCloser
+	once sync.Once
+}
+
+func (d *drainReadCloser) Close() error {
+	d.once.Do(func() {
+		go func() {
+			_, _ = io.Copy(io.Discard, d.R)
+			_ = d.R.Close()
+		}()
+	})
+	return nil
+}
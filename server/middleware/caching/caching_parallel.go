@@ -0,0 +1,258 @@
+package caching
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/omalloc/tavern/internal/constants"
+	"github.com/omalloc/tavern/pkg/iobuf"
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
+)
+
+var _metricParallelFetch = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tr",
+	Subsystem: "tavern",
+	Name:      "parallel_fetch_parts_total",
+	Help:      "The total number of parts fetched by the parallel origin fetch",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(_metricParallelFetch)
+}
+
+// parallelOption e.g.
+//
+//	parallel_fetch:
+//	  enabled: true
+//	  min_size: 67108864 # 64MB
+//	  part_size: 8388608 # 8MB
+//	  connections: 4
+//	  max_per_origin: 16
+type parallelOption struct {
+	Enabled      bool   `json:"enabled" yaml:"enabled"`
+	MinSize      uint64 `json:"min_size" yaml:"min_size"`             // 对象大小达到后并发回源, 默认 64MB
+	PartSize     uint64 `json:"part_size" yaml:"part_size"`           // 每个回源请求的大小, 按分片大小对齐, 默认 8MB
+	Connections  int    `json:"connections" yaml:"connections"`       // 单个对象的并发回源连接数, 默认 4
+	MaxPerOrigin int    `json:"max_per_origin" yaml:"max_per_origin"` // 单个源站域名的并发回源连接数, 默认 16
+}
+
+func (o *parallelOption) init(sliceSize uint64) {
+	if o.MinSize == 0 {
+		o.MinSize = 64 << 20
+	}
+	if o.PartSize == 0 {
+		o.PartSize = 8 << 20
+	}
+	if sliceSize > 0 {
+		o.PartSize = (o.PartSize + sliceSize - 1) / sliceSize * sliceSize
+	}
+	if o.Connections <= 0 {
+		o.Connections = 4
+	}
+	if o.MaxPerOrigin <= 0 {
+		o.MaxPerOrigin = 16
+	}
+}
+
+// originSlots bounds the parallel part requests of each origin host, host -> chan struct{}.
+var originSlots sync.Map
+
+func originSlot(host string, limit int) chan struct{} {
+	v, _ := originSlots.LoadOrStore(host, make(chan struct{}, limit))
+	return v.(chan struct{})
+}
+
+// doParallelProxy fetches the cold object, the first part is requested as a range probe to learn the size,
+// the rest of the large object is split into the chunk-aligned parts fetched concurrently and stored
+// through the slice writer, the parts are stitched in order to the client.
+//
+// the request not applicable, e.g. with the client Range, falls back to the single stream doProxy.
+func (c *Caching) doParallelProxy(req *http.Request) (*http.Response, error) {
+	opt := &c.opt.ParallelFetch
+	if !opt.Enabled || c.bypass || c.md != nil || req.Method != http.MethodGet ||
+		req.Header.Get("Range") != "" || req.Header.Get(constants.PrefetchCacheKey) != "" ||
+		rangeUnsupported(c.req.Host) {
+		return c.doProxy(req, false)
+	}
+
+	probe := req.Clone(req.Context())
+	probe.Header.Set("Range", fmt.Sprintf("bytes=0-%d", opt.PartSize-1))
+
+	resp, err := c.doProxy(probe, false)
+	if err != nil {
+		// the empty object is not satisfiable.
+		if resp != nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && c.md == nil {
+			closeBody(resp)
+			return c.doProxy(req, false)
+		}
+		return resp, err
+	}
+
+	// the origin ignored the range or the error response, sent as is.
+	if resp.StatusCode != http.StatusPartialContent {
+		return resp, nil
+	}
+
+	respRange, err := xhttp.ParseContentRange(resp.Header)
+	if err != nil || respRange.Start != 0 || respRange.ObjSize == 0 {
+		closeBody(resp)
+		return nil, fmt.Errorf("parallel fetch probe invalid Content-Range %q", resp.Header.Get("Content-Range"))
+	}
+
+	size := respRange.ObjSize
+	resp.StatusCode = http.StatusOK
+	resp.ContentLength = int64(size)
+	for _, h := range []http.Header{resp.Header, c.md.Headers} {
+		h.Del("Content-Range")
+		h.Set("Content-Length", strconv.FormatUint(size, 10))
+	}
+
+	// the whole object is in the probe.
+	from := uint64(respRange.Length) + 1
+	if from >= size {
+		return resp, nil
+	}
+
+	bgReq := backgroundRequest(c.req)
+	blockSize := c.md.BlockSize
+
+	// the small object, not stored (e.g. not admitted) or the probe not chunk-aligned,
+	// the rest is fetched in a single stream.
+	if size < opt.MinSize || c.bypass || from%blockSize != 0 {
+		rest := bgReq.Clone(context.Background())
+		rest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, size-1))
+		pc := c.partCaching(bgReq)
+		resp.Body = iobuf.PartsReader(nil, resp.Body, iobuf.AsyncReadCloser(func() (*http.Response, error) {
+			resp, err := pc.doProxy(rest, true)
+			if err == nil && resp.StatusCode != http.StatusPartialContent {
+				closeBody(resp)
+				return nil, xhttp.NewBizError(resp.StatusCode, resp.Header)
+			}
+			return resp, err
+		}))
+		return resp, nil
+	}
+
+	parts := make([]*partReader, 0, (size-from)/opt.PartSize+1)
+	for ; from < size; from += opt.PartSize {
+		parts = append(parts, &partReader{
+			c:         c,
+			blockSize: blockSize,
+			from:      from,
+			to:        min(from+opt.PartSize, size) - 1,
+			done:      make(chan struct{}),
+		})
+	}
+
+	c.log.Debugf("parallel fetch %s size %d parts %d", c.id.Key(), size, len(parts))
+
+	queue := make(chan *partReader, len(parts))
+	for _, p := range parts {
+		queue <- p
+	}
+	close(queue)
+
+	slot := originSlot(c.req.Host, opt.MaxPerOrigin)
+	for i := 0; i < min(opt.Connections, len(parts)); i++ {
+		pc := c.partCaching(bgReq)
+		go func() {
+			// the parts are taken in order, the earlier parts are fetched first.
+			for p := range queue {
+				slot <- struct{}{}
+				_, p.err = pc.fetchRange(bgReq, p.from, p.to)
+				<-slot
+
+				result := "fetched"
+				if p.err != nil {
+					result = "failed"
+					c.log.Warnf("parallel fetch part %d-%d of %s failed: %v", p.from, p.to, c.id.Key(), p.err)
+				}
+				_metricParallelFetch.WithLabelValues(result).Inc()
+				close(p.done)
+			}
+		}()
+	}
+
+	readers := make([]io.ReadCloser, 0, len(parts)+1)
+	readers = append(readers, resp.Body)
+	for _, p := range parts {
+		readers = append(readers, p)
+	}
+	resp.Body = iobuf.PartsReader(nil, readers...)
+	return resp, nil
+}
+
+// partCaching returns the Caching of the part requests with its own copy of the metadata,
+// the part requests never race with the client stream, the chunks are merged by the bucket on store.
+//
+// called before the probe body is read, the metadata is not updated by the slice writer yet.
+func (c *Caching) partCaching(req *http.Request) *Caching {
+	return &Caching{
+		log:         c.log,
+		processor:   c.processor,
+		opt:         c.opt,
+		req:         req,
+		id:          c.id,
+		md:          c.md.Clone(),
+		bucket:      c.bucket,
+		proxyClient: c.proxyClient,
+		cacheStatus: c.cacheStatus,
+		bypass:      c.bypass,
+	}
+}
+
+// partReader reads the part from the chunk files once the part is fetched and stored.
+type partReader struct {
+	c         *Caching
+	blockSize uint64
+	from, to  uint64
+	done      chan struct{}
+	err       error
+	r         io.ReadCloser
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	if p.r == nil {
+		<-p.done
+		if p.err != nil {
+			return 0, p.err
+		}
+
+		r, err := p.open()
+		if err != nil {
+			return 0, err
+		}
+		p.r = r
+	}
+	return p.r.Read(b)
+}
+
+func (p *partReader) open() (io.ReadCloser, error) {
+	readers := make([]io.ReadCloser, 0, (p.to-p.from)/p.blockSize+1)
+
+	for idx := p.from / p.blockSize; idx <= p.to/p.blockSize; idx++ {
+		f, err := getSliceChunkFile(p.c, uint32(idx))
+		if err == nil && f == nil {
+			err = fmt.Errorf("chunk %d of part %d-%d not stored", idx, p.from, p.to)
+		}
+		if err != nil {
+			iobuf.AllCloser(readers).Close()
+			return nil, err
+		}
+		readers = append(readers, f)
+	}
+	return iobuf.PartsReader(nil, readers...), nil
+}
+
+func (p *partReader) Close() error {
+	if p.r != nil {
+		return p.r.Close()
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package caching
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelFetchStoresAllParts(t *testing.T) {
+	origin := newMockOrigin()
+	rt := newTestCaching(t, origin, map[string]any{
+		"slice_size": 1024,
+		"parallel_fetch": map[string]any{
+			"enabled":     true,
+			"min_size":    4096,
+			"part_size":   1024,
+			"connections": 4,
+		},
+	})
+
+	const rawUrl = "http://www.example.com/path/to/parallel.bin"
+	data := makebuf(16*1024 + 100)
+	origin.set(rawUrl, data)
+
+	_, body, status := doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "MISS", status)
+
+	// the probe and the parts are stored by the different writers.
+	require.Eventually(t, func() bool {
+		md := lookup(t, rawUrl).md
+		return md != nil && md.HasComplete()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, origin.requests(), 17)
+
+	_, body, status = doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "HIT", status)
+	assert.Len(t, origin.requests(), 17)
+}
+
+func TestParallelFetchSingleRest(t *testing.T) {
+	origin := newMockOrigin()
+	rt := newTestCaching(t, origin, map[string]any{
+		"slice_size": 1024,
+		"parallel_fetch": map[string]any{
+			"enabled":   true,
+			"min_size":  1 << 20,
+			"part_size": 1024,
+		},
+	})
+
+	const rawUrl = "http://www.example.com/path/to/rest.bin"
+	data := makebuf(8*1024 + 100)
+	origin.set(rawUrl, data)
+
+	// the small object, the rest is fetched in a single stream.
+	_, body, status := doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "MISS", status)
+	assert.Equal(t, []string{"bytes=0-1023", "bytes=1024-8291"}, origin.requests())
+
+	require.Eventually(t, func() bool {
+		md := lookup(t, rawUrl).md
+		return md != nil && md.HasComplete()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, body, status = doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "HIT", status)
+}
@@ -58,7 +58,7 @@ func (r *PrefetchProcessor) PostRequest(c *Caching, req *http.Request, resp *htt
 			c.log.Warnf("parsed content-length error: %s, maybe a chunked response", err)
 		}
 
-		rawRange := req.Context().Value(prefetchRangeKey{}).(string)
+		rawRange, _ := req.Context().Value(prefetchRangeKey{}).(string)
 		if rawRange != "" {
 			rng, _ := xhttp.SingleRange(rawRange, uint64(sizeof))
 			resp.Body = iobuf.RangeReader(resp.Body, 0, sizeof, int(rng.Start), int(rng.End))
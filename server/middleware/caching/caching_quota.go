@@ -0,0 +1,180 @@
+package caching
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage"
+	"github.com/omalloc/tavern/storage/accounting"
+)
+
+const (
+	QuotaActionEvict  = "evict"  // admit the object and evict the domain's own objects in background
+	QuotaActionBypass = "bypass" // refuse to admit the new objects, proxied as BYPASS
+
+	quotaLowWatermark = 0.9 // evict to 90% of the quota
+)
+
+var (
+	_metricQuotaExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tr",
+		Subsystem: "tavern",
+		Name:      "quota_exceeded_total",
+		Help:      "The total number of new objects exceeding the domain quota",
+	}, []string{"rule", "action"})
+	_metricQuotaEvicted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tr",
+		Subsystem: "tavern",
+		Name:      "quota_evicted_objects_total",
+		Help:      "The total number of objects evicted by the domain quota",
+	}, []string{"rule"})
+)
+
+func init() {
+	prometheus.MustRegister(_metricQuotaExceeded)
+	prometheus.MustRegister(_metricQuotaEvicted)
+}
+
+// quotaRule limits the stored bytes and objects of each host matched by the rule.
+type quotaRule struct {
+	Host       string `json:"host" yaml:"host"`               // exact host or pattern, e.g. www.example.com, *.example.com
+	MaxBytes   int64  `json:"max_bytes" yaml:"max_bytes"`     // 0 is unlimited
+	MaxObjects int64  `json:"max_objects" yaml:"max_objects"` // 0 is unlimited
+	Action     string `json:"action" yaml:"action"`           // evict (default), bypass
+}
+
+func (r *quotaRule) match(host string) bool {
+	if r.Host == host {
+		return true
+	}
+	ok, _ := path.Match(r.Host, host)
+	return ok
+}
+
+// exceeded reports whether the usage with the incoming object is over the quota.
+func (r *quotaRule) exceeded(u accounting.Usage, incoming int64) bool {
+	return (r.MaxBytes > 0 && u.Bytes+incoming > r.MaxBytes) ||
+		(r.MaxObjects > 0 && u.Objects+1 > r.MaxObjects)
+}
+
+// quotaEnforcer checks the domain quota of the new objects, the first matched rule wins.
+type quotaEnforcer struct {
+	rules    []*quotaRule
+	usage    *accounting.Tracker
+	evicting sync.Map // host -> struct{}, one eviction per host at a time
+}
+
+func newQuotaEnforcer(rules []*quotaRule) (*quotaEnforcer, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	for _, r := range rules {
+		if _, err := path.Match(r.Host, ""); err != nil || r.Host == "" {
+			return nil, fmt.Errorf("invalid quota host %q", r.Host)
+		}
+		switch r.Action {
+		case "":
+			r.Action = QuotaActionEvict
+		case QuotaActionEvict, QuotaActionBypass:
+		default:
+			return nil, fmt.Errorf("invalid quota action %q of %s", r.Action, r.Host)
+		}
+	}
+
+	return &quotaEnforcer{
+		rules: rules,
+		usage: accounting.Default(),
+	}, nil
+}
+
+// admit reports whether the new object of the host can be stored.
+func (q *quotaEnforcer) admit(host string, _ object.IDHash, size int64) bool {
+	idx := slices.IndexFunc(q.rules, func(r *quotaRule) bool { return r.match(host) })
+	if idx < 0 {
+		return true
+	}
+	rule := q.rules[idx]
+
+	usage, _ := q.usage.Get(host)
+	if !rule.exceeded(usage, max(size, 0)) {
+		return true
+	}
+
+	_metricQuotaExceeded.WithLabelValues(rule.Host, rule.Action).Inc()
+
+	if rule.Action == QuotaActionBypass {
+		return false
+	}
+
+	if _, running := q.evicting.LoadOrStore(host, struct{}{}); !running {
+		go func() {
+			defer q.evicting.Delete(host)
+			q.evict(host, rule)
+		}()
+	}
+	return true
+}
+
+// evict discards the least recently used objects of the host until the usage is under the low watermark.
+func (q *quotaEnforcer) evict(host string, rule *quotaRule) {
+	ctx := context.Background()
+	current := storage.Current()
+
+	type candidate struct {
+		bucket storagev1.Bucket
+		md     *object.Metadata
+	}
+
+	candidates := make([]candidate, 0)
+	for _, b := range current.Buckets() {
+		for _, scheme := range []string{"http", "https"} {
+			prefix := fmt.Sprintf("ix/%s/%s://%s/", b.ID(), scheme, host)
+			_ = current.SharedKV().IteratePrefix(ctx, []byte(prefix), func(key, val []byte) error {
+				if len(val) < object.IdHashSize {
+					return nil
+				}
+				var h object.IDHash
+				copy(h[:], val[:object.IdHashSize])
+				if md, err := b.LookupWithHash(ctx, h); err == nil {
+					candidates = append(candidates, candidate{bucket: b, md: md})
+				}
+				return nil
+			})
+		}
+	}
+
+	// least valuable first: oldest access, then fewest refs.
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		if c := cmp.Compare(a.md.LastRefUnix, b.md.LastRefUnix); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.md.Refs, b.md.Refs)
+	})
+
+	lowBytes := int64(float64(rule.MaxBytes) * quotaLowWatermark)
+	lowObjects := int64(float64(rule.MaxObjects) * quotaLowWatermark)
+
+	evicted := 0
+	for _, c := range candidates {
+		usage, _ := q.usage.Get(host)
+		if (rule.MaxBytes <= 0 || usage.Bytes <= lowBytes) && (rule.MaxObjects <= 0 || usage.Objects <= lowObjects) {
+			break
+		}
+		if err := c.bucket.DiscardWithMessage(ctx, c.md.ID, "quota"); err == nil {
+			evicted++
+		}
+	}
+
+	_metricQuotaEvicted.WithLabelValues(rule.Host).Add(float64(evicted))
+	log.Infof("quota %s of %s exceeded, evicted %d objects", rule.Host, host, evicted)
+}
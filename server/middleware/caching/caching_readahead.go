@@ -0,0 +1,313 @@
+package caching
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/contrib/log"
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
+	"github.com/omalloc/tavern/proxy"
+)
+
+const (
+	readAheadStreamTTL  = time.Minute // the idle stream is forgotten after
+	readAheadMaxStreams = 65536       // tracked streams and prefetched chunks, swept when reached
+)
+
+var (
+	_metricReadAhead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tr",
+		Subsystem: "tavern",
+		Name:      "readahead_chunks_total",
+		Help:      "The total number of chunks prefetched by the read-ahead",
+	}, []string{"result"})
+
+	_metricReadAheadHit = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tr",
+		Subsystem: "tavern",
+		Name:      "readahead_hits_total",
+		Help:      "The total number of the read-ahead chunks requested by the clients",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(_metricReadAhead, _metricReadAheadHit)
+}
+
+// readAheadOption e.g.
+//
+//	read_ahead:
+//	  concurrency: 8
+//	  rules:
+//	    - host: "*.example.com"
+//	      content_types: ["video/", "application/octet-stream"]
+//	      chunks: 4
+//	      trigger: 2
+type readAheadOption struct {
+	Concurrency int              `json:"concurrency" yaml:"concurrency"` // 全局并发预读的分片数, 默认 8, 超出时放弃
+	Rules       []*readAheadRule `json:"rules" yaml:"rules"`             // the first matched rule wins
+}
+
+type readAheadRule struct {
+	Host         string   `json:"host" yaml:"host"`                   // exact host or pattern, empty matches all
+	ContentTypes []string `json:"content_types" yaml:"content_types"` // prefix of the object Content-Type, empty matches all
+	Chunks       int      `json:"chunks" yaml:"chunks"`               // 预读的后续分片数, 默认 4
+	Trigger      int      `json:"trigger" yaml:"trigger"`             // 连续顺序请求次数达到后开始预读, 默认 2
+}
+
+func (r *readAheadRule) match(host, contentType string) bool {
+	if r.Host != "" && r.Host != host {
+		if ok, _ := path.Match(r.Host, host); !ok {
+			return false
+		}
+	}
+
+	if len(r.ContentTypes) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if !slices.ContainsFunc(r.ContentTypes, func(ct string) bool { return strings.HasPrefix(mediaType, ct) }) {
+			return false
+		}
+	}
+	return true
+}
+
+type streamKey struct {
+	hash   object.IDHash
+	client netip.Addr
+}
+
+// stream is the last range requested by a client of the object.
+type stream struct {
+	start, end int64
+	seq        int   // consecutive sequential requests
+	at         int64 // unix of the last request
+}
+
+type chunkKey struct {
+	hash object.IDHash
+	idx  uint32
+}
+
+// readAhead detects the sequential range access of each object and client, e.g. video playing,
+// and prefetches the following chunks into the bucket before they are requested.
+type readAhead struct {
+	opt       *cachingOption
+	processor *ProcessorChain
+	sem       chan struct{}
+
+	mu         sync.Mutex
+	streams    map[streamKey]*stream
+	prefetched map[chunkKey]int64 // the read-ahead chunks not requested yet
+	inflight   sync.Map           // chunkKey -> struct{}
+}
+
+func newReadAhead(opt *cachingOption, processor *ProcessorChain) (*readAhead, error) {
+	o := &opt.ReadAhead
+	if len(o.Rules) == 0 {
+		return nil, nil
+	}
+
+	for _, r := range o.Rules {
+		if _, err := path.Match(r.Host, ""); err != nil {
+			return nil, fmt.Errorf("invalid read-ahead rule host %q", r.Host)
+		}
+		if r.Chunks <= 0 {
+			r.Chunks = 4
+		}
+		if r.Trigger <= 0 {
+			r.Trigger = 2
+		}
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 8
+	}
+
+	return &readAhead{
+		opt:        opt,
+		processor:  processor,
+		sem:        make(chan struct{}, o.Concurrency),
+		streams:    make(map[streamKey]*stream),
+		prefetched: make(map[chunkKey]int64),
+	}, nil
+}
+
+// observe tracks the range request of the client, the following chunks are prefetched
+// asynchronously once the access is sequential.
+func (r *readAhead) observe(c *Caching, req *http.Request) {
+	if r == nil || c.bypass || c.prefetch || c.md == nil || req.Method != http.MethodGet {
+		return
+	}
+
+	rawRange := req.Header.Get("Range")
+	md := c.md
+	if rawRange == "" || md.Size == 0 || md.BlockSize == 0 || md.IsChunked() {
+		return
+	}
+
+	rng, err := xhttp.SingleRange(rawRange, md.Size)
+	if err != nil {
+		return
+	}
+
+	hash := c.id.Hash()
+	first, last := uint32(rng.Start/int64(md.BlockSize)), uint32(rng.End/int64(md.BlockSize))
+	r.countHits(hash, first, last)
+
+	idx := slices.IndexFunc(r.opt.ReadAhead.Rules, func(rule *readAheadRule) bool {
+		return rule.match(c.req.Host, md.Headers.Get("Content-Type"))
+	})
+	if idx < 0 {
+		return
+	}
+	rule := r.opt.ReadAhead.Rules[idx]
+
+	client, _ := clientAddr(c.req, r.opt.trustedProxies)
+	if r.track(streamKey{hash: hash, client: client}, rng.Start, rng.End, int64(md.BlockSize)) < rule.Trigger {
+		return
+	}
+
+	end := uint32((md.Size - 1) / md.BlockSize)
+	for i := last + 1; i <= min(last+uint32(rule.Chunks), end); i++ {
+		if md.Chunks.Contains(i) {
+			continue
+		}
+		r.fetch(c, i)
+	}
+}
+
+// track returns the consecutive sequential requests of the stream, the request starts
+// after the last one and within a chunk of its end is sequential.
+func (r *readAhead) track(key streamKey, start, end, blockSize int64) int {
+	now := time.Now().Unix()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.streams[key]
+	if !ok || now-s.at > int64(readAheadStreamTTL/time.Second) {
+		if len(r.streams) >= readAheadMaxStreams {
+			r.sweep(now)
+		}
+		s = &stream{}
+		r.streams[key] = s
+	}
+
+	if s.seq > 0 && start > s.start && start <= s.end+1+blockSize {
+		s.seq++
+	} else {
+		s.seq = 1
+	}
+	s.start, s.end, s.at = start, end, now
+	return s.seq
+}
+
+// sweep drops the idle streams and the stale prefetched chunks, everything is dropped if still full.
+func (r *readAhead) sweep(now int64) {
+	ttl := int64(readAheadStreamTTL / time.Second)
+	for k, s := range r.streams {
+		if now-s.at > ttl {
+			delete(r.streams, k)
+		}
+	}
+	for k, at := range r.prefetched {
+		if now-at > ttl {
+			delete(r.prefetched, k)
+		}
+	}
+
+	if len(r.streams) >= readAheadMaxStreams {
+		clear(r.streams)
+	}
+	if len(r.prefetched) >= readAheadMaxStreams {
+		clear(r.prefetched)
+	}
+}
+
+// countHits counts the read-ahead chunks requested by the client.
+func (r *readAhead) countHits(hash object.IDHash, first, last uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.prefetched) == 0 {
+		return
+	}
+	for idx := first; idx <= last; idx++ {
+		key := chunkKey{hash: hash, idx: idx}
+		if _, ok := r.prefetched[key]; ok {
+			delete(r.prefetched, key)
+			_metricReadAheadHit.Inc()
+		}
+	}
+}
+
+// fetch prefetches the chunk, the chunk request is collapsed with the same client chunk request.
+func (r *readAhead) fetch(c *Caching, idx uint32) {
+	key := chunkKey{hash: c.id.Hash(), idx: idx}
+	if _, loaded := r.inflight.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	select {
+	case r.sem <- struct{}{}:
+	default:
+		// all the slots are busy, the read-ahead is dropped.
+		r.inflight.Delete(key)
+		_metricReadAhead.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	req := backgroundRequest(c.req)
+	id, bucket := c.id, c.bucket
+
+	go func() {
+		defer func() {
+			<-r.sem
+			r.inflight.Delete(key)
+		}()
+
+		md, err := bucket.Lookup(context.Background(), id)
+		if err != nil || md == nil || md.Chunks.Contains(idx) {
+			return
+		}
+
+		rc := &Caching{
+			log:         log.NewHelper(log.GetLogger()),
+			processor:   r.processor,
+			opt:         r.opt,
+			req:         req,
+			id:          id,
+			md:          md,
+			bucket:      bucket,
+			proxyClient: proxy.GetProxy(),
+			cacheStatus: storagev1.CachePartMiss,
+		}
+
+		from := uint64(idx) * md.BlockSize
+		to := min(from+md.BlockSize, md.Size) - 1
+		if _, err = rc.fetchRange(req, from, to); err != nil {
+			_metricReadAhead.WithLabelValues("failed").Inc()
+			rc.log.Warnf("read-ahead chunk %d of %s failed: %v", idx, id.Key(), err)
+			return
+		}
+		_metricReadAhead.WithLabelValues("fetched").Inc()
+
+		r.mu.Lock()
+		if len(r.prefetched) >= readAheadMaxStreams {
+			r.sweep(time.Now().Unix())
+		}
+		r.prefetched[key] = time.Now().Unix()
+		r.mu.Unlock()
+	}()
+}
@@ -0,0 +1,46 @@
+package caching
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAheadKeepsClientChunks(t *testing.T) {
+	origin := newMockOrigin()
+	rt := newTestCaching(t, origin, map[string]any{
+		"slice_size": 1024,
+		"read_ahead": map[string]any{
+			"rules": []map[string]any{
+				{"host": "*.example.com", "chunks": 2, "trigger": 2},
+			},
+		},
+	})
+
+	const rawUrl = "http://www.example.com/path/to/readahead.bin"
+	data := makebuf(8192)
+	origin.set(rawUrl, data)
+
+	// the second sequential request prefetches the chunks 2 and 3, while the client
+	// is still storing the chunk 1 from its own metadata.
+	_, body, status := doRequest(t, rt, rawUrl, http.Header{"Range": {"bytes=0-1023"}})
+	assert.Equal(t, data[:1024], body)
+	assert.Equal(t, "MISS", status)
+
+	_, body, status = doRequest(t, rt, rawUrl, http.Header{"Range": {"bytes=1024-2047"}})
+	assert.Equal(t, data[1024:2048], body)
+	assert.Equal(t, "PART_MISS", status)
+
+	require.Eventually(t, func() bool {
+		md := lookup(t, rawUrl).md
+		return md != nil && md.Chunks.Count() == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, body, status = doRequest(t, rt, rawUrl, http.Header{"Range": {"bytes=0-4095"}})
+	assert.Equal(t, data[:4096], body)
+	assert.Equal(t, "HIT", status)
+	assert.Len(t, origin.requests(), 4)
+}
@@ -0,0 +1,170 @@
+package caching
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
+)
+
+// resumeBackoff the delay before the n-th resume is n * resumeBackoff.
+const resumeBackoff = 100 * time.Millisecond
+
+// errUpstreamInterrupted the upstream body is broken and can not be resumed,
+// the chunks fully written are kept.
+var errUpstreamInterrupted = errors.New("upstream interrupted")
+
+var _metricResume = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tr",
+	Subsystem: "tavern",
+	Name:      "resume_total",
+	Help:      "The total number of resumes of the interrupted upstream bodies",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(_metricResume)
+}
+
+// resumeReader re-requests the rest of the body from the received offset when the upstream
+// connection drops mid-body, the resumed body is spliced into the stream seamlessly.
+type resumeReader struct {
+	c         *Caching
+	req       *http.Request // the proxy request, cloned for the resume
+	R         io.ReadCloser
+	offset    uint64 // absolute offset of the next byte
+	end       uint64 // absolute offset of the last byte
+	validator string // If-Range of the resume, the same version only
+	retries   int
+	err       error
+}
+
+// resumable wraps the upstream body of the known size, the interrupted body is resumed
+// with the range request up to `ResumeRetries` times.
+func (c *Caching) resumable(proxyReq *http.Request, resp *http.Response, respRange xhttp.ContentRange) io.ReadCloser {
+	if c.opt.ResumeRetries <= 0 || proxyReq.Method != http.MethodGet || c.noContentLen || respRange.ObjSize == 0 {
+		return resp.Body
+	}
+
+	end := respRange.ObjSize - 1
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		end = uint64(respRange.Length)
+	default:
+		return resp.Body
+	}
+
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	return &resumeReader{
+		c:         c,
+		req:       proxyReq,
+		R:         resp.Body,
+		offset:    uint64(respRange.Start),
+		end:       end,
+		validator: validator,
+	}
+}
+
+func (r *resumeReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	for {
+		n, err := r.R.Read(p)
+		r.offset += uint64(n)
+		if err == nil || (errors.Is(err, io.EOF) && r.offset > r.end) {
+			return n, err
+		}
+
+		// the read error, or EOF before the end, the error of the failed resume is returned
+		// by the next Read so the bytes read are not lost.
+		if r.err = r.resume(err); r.err != nil && n == 0 {
+			return 0, r.err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumeReader) resume(cause error) error {
+	_ = r.R.Close()
+
+	// the client gone or the request canceled, the chunks fully written are kept.
+	if err := r.req.Context().Err(); err != nil || !resumableError(cause) {
+		_metricResume.WithLabelValues("aborted").Inc()
+		return fmt.Errorf("%w at %d: %w", errUpstreamInterrupted, r.offset, cause)
+	}
+
+	if r.validator == "" {
+		_metricResume.WithLabelValues("failed").Inc()
+		return fmt.Errorf("%w at %d without validator: %v", errUpstreamInterrupted, r.offset, cause)
+	}
+
+	for r.retries < r.c.opt.ResumeRetries {
+		r.retries++
+		select {
+		case <-r.req.Context().Done():
+			_metricResume.WithLabelValues("aborted").Inc()
+			return fmt.Errorf("%w at %d: %w", errUpstreamInterrupted, r.offset, r.req.Context().Err())
+		case <-time.After(time.Duration(r.retries) * resumeBackoff):
+		}
+
+		req := r.req.Clone(context.Background())
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, r.end))
+		req.Header.Set("If-Range", r.validator)
+
+		resp, err := r.c.proxyClient.Do(req, false, 0)
+		if err == nil && resp.StatusCode == http.StatusPartialContent {
+			if cr, err1 := xhttp.ParseContentRange(resp.Header); err1 == nil && uint64(cr.Start) == r.offset {
+				r.c.log.Warnf("upstream interrupted at %d/%d: %v, resumed %d", r.offset, r.end+1, cause, r.retries)
+				_metricResume.WithLabelValues("resumed").Inc()
+				r.R = resp.Body
+				return nil
+			}
+		}
+		closeBody(resp)
+
+		if err == nil {
+			err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		r.c.log.Warnf("resume upstream at %d/%d failed %d: %v", r.offset, r.end+1, r.retries, err)
+	}
+
+	_metricResume.WithLabelValues("failed").Inc()
+	return fmt.Errorf("%w at %d after %d retries: %v", errUpstreamInterrupted, r.offset, r.retries, cause)
+}
+
+// resumableError reports whether the body is broken by the upstream connection, e.g. reset or closed early.
+func resumableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+func (r *resumeReader) Close() error {
+	return r.R.Close()
+}
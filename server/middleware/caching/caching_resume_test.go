@@ -0,0 +1,93 @@
+package caching
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeInterruptedBody(t *testing.T) {
+	origin := newMockOrigin()
+	rt := newTestCaching(t, origin, map[string]any{
+		"slice_size":     1024,
+		"resume_retries": 2,
+	})
+
+	const rawUrl = "http://www.example.com/path/to/resume.bin"
+	data := makebuf(4096)
+	origin.set(rawUrl, data)
+	origin.cutAt, origin.cuts = 1500, 1
+
+	// the origin cut mid-body, the rest is resumed from the received offset.
+	_, body, status := doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "MISS", status)
+	assert.Equal(t, []string{"", "bytes=1500-4095"}, origin.requests())
+
+	require.Eventually(t, func() bool {
+		md := lookup(t, rawUrl).md
+		return md != nil && md.HasComplete()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, body, status = doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "HIT", status)
+	assert.Len(t, origin.requests(), 2)
+}
+
+func TestResumeNotOnCanceled(t *testing.T) {
+	origin := newMockOrigin()
+	rt := newTestCaching(t, origin, map[string]any{
+		"slice_size":     1024,
+		"resume_retries": 2,
+	})
+
+	const rawUrl = "http://www.example.com/path/to/canceled.bin"
+	data := makebuf(4096)
+	origin.set(rawUrl, data)
+	origin.cutAt, origin.cuts, origin.cutErr = 1500, 1, context.Canceled
+
+	req, err := http.NewRequest(http.MethodGet, rawUrl, nil)
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	// the canceled body is not resumed, the error is sent to the client.
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, data[:1500], body)
+	assert.Equal(t, []string{""}, origin.requests())
+}
+
+func TestResumableError(t *testing.T) {
+	opErr := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{io.ErrUnexpectedEOF, true},
+		{io.EOF, true},
+		{syscall.ECONNRESET, true},
+		{opErr, true},
+		{fmt.Errorf("read body: %w", opErr), true},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: context.Canceled}, false},
+		{errors.New("processor failed"), false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, resumableError(tt.err), "%v", tt.err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/omalloc/tavern/api/defined/v1/storage/object"
 	"github.com/omalloc/tavern/contrib/log"
 	xhttp "github.com/omalloc/tavern/pkg/x/http"
+	"github.com/omalloc/tavern/pkg/x/http/cachecontrol"
 )
 
 var _ Processor = (*RevalidateProcessor)(nil)
@@ -25,6 +26,13 @@ func (r *RevalidateProcessor) Lookup(c *Caching, req *http.Request) (bool, error
 	}
 	// check if metadata is expired.
 	if !hasExpired(c.md) {
+		// client reload, the immutable object is not revalidated while fresh. (RFC 8246)
+		if c.opt.ClientRevalidate && requestNoCache(req) && !isImmutable(c.md.Headers) &&
+			c.md.HasComplete() && hasConditionHeader(c.md.Headers) {
+			c.revalidate = true
+			c.cacheStatus = storagev1.CacheRevalidateHit
+			return false, nil
+		}
 		return true, nil
 	}
 
@@ -106,8 +114,13 @@ func (r *RevalidateProcessor) revalidate(c *Caching, resp *http.Response, req *h
 	// freshness metadata
 	_ = r.freshness(c, resp)
 
-	// lazilyRespond
-	if raw := req.Context().Value(rawRangeKey{}); raw != nil {
+	// client preconditions against the refreshed validators.
+	if condResp := c.conditionalRespond(); condResp != nil {
+		return condResp, nil
+	}
+
+	// lazilyRespond, the Range is dropped by the mismatched If-Range.
+	if raw := req.Context().Value(rawRangeKey{}); raw != nil && c.req.Header.Get("Range") != "" {
 		rawRange := raw.(string)
 		rng, err := xhttp.SingleRange(rawRange, c.md.Size)
 		if err != nil {
@@ -126,25 +139,22 @@ func (r *RevalidateProcessor) revalidate(c *Caching, resp *http.Response, req *h
 	return c.lazilyRespond(req, 0, end)
 }
 
+// freshness updates the stored headers with the 304 response and freshens the metadata. (RFC 9111 4.3.4)
 func (r *RevalidateProcessor) freshness(c *Caching, resp *http.Response) bool {
-	expiredAt, cacheable := xhttp.ParseCacheTime("", resp.Header)
+	metadata := c.md.Clone()
+	xhttp.UpdateStoredHeader(metadata.Headers, resp.Header, c.opt.TagHeader)
+
+	expiredAt, cacheable := c.cacheTime(metadata.Headers)
 	if !cacheable {
 		return false
 	}
 
 	now := time.Now()
-	metadata := c.md.Clone()
-	metadata.ExpiresAt = now.Add(expiredAt).Unix()
+	// the age of the 304 is set by doProxy.
+	metadata.ExpiresAt = now.Add(expiredAt - time.Duration(c.md.InitialAge)*time.Second).Unix()
 	metadata.RespUnix = now.Unix()
 	metadata.LastRefUnix = now.Unix()
 
-	cloneHeaders := []string{"Last-Modified", "ETag", "Cache-Control"}
-	for _, name := range cloneHeaders {
-		value := resp.Header.Get(name)
-		if value != "" {
-			metadata.Headers.Set(name, value)
-		}
-	}
 	c.cacheable = true
 	c.md = metadata
 
@@ -163,6 +173,24 @@ func hasExpired(md *object.Metadata) bool {
 	return time.Unix(md.ExpiresAt, 0).Before(time.Now())
 }
 
+// requestNoCache reports whether the client asks for the validated response, e.g. browser reload.
+func requestNoCache(req *http.Request) bool {
+	ctrl := cachecontrol.Parse(req.Header.Get("Cache-Control"))
+	if ok, _ := ctrl.NoCache(); ok || ctrl.MaxAge() == 0 {
+		return true
+	}
+	return req.Header.Get("Cache-Control") == "" && req.Header.Get("Pragma") == "no-cache"
+}
+
+// isImmutable reports whether the stored response has the `immutable` directive.
+func isImmutable(header http.Header) bool {
+	ctrl, targeted := xhttp.EdgeCacheControl(header)
+	if targeted && ctrl.Immutable() {
+		return true
+	}
+	return cachecontrol.Parse(header.Get("Cache-Control")).Immutable()
+}
+
 // hasConditionHeader checks if the HTTP header contains either an ETag or Last-Modified field.
 // It returns true if either of these fields is present, indicating that the header has a condition.
 func hasConditionHeader(header http.Header) bool {
@@ -1,6 +1,29 @@
 package caching
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omalloc/proxy/selector"
+	"github.com/stretchr/testify/require"
+
+	configv1 "github.com/omalloc/tavern/api/defined/v1/middleware"
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/conf"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/internal/constants"
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
+	"github.com/omalloc/tavern/proxy"
+	"github.com/omalloc/tavern/storage"
+)
 
 func BenchmarkWithPooling(b *testing.B) {
 	for i := 0; i < b.N; i++ {
@@ -8,3 +31,164 @@ func BenchmarkWithPooling(b *testing.B) {
 		c.reset()
 	}
 }
+
+// mockOrigin is the origin serving the objects from memory, the single Range and If-Range are honored.
+type mockOrigin struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	header  http.Header // the extra response headers, e.g. Cache-Control
+	etag    string
+	noRange bool  // answers the Range with the full object
+	cutAt   int   // the body of the next responses is cut after `cutAt` bytes, 0 is never cut
+	cuts    int   // the number of the responses to cut
+	cutErr  error // the read error of the cut body, default io.ErrUnexpectedEOF
+	ranges  []string
+}
+
+func newMockOrigin() *mockOrigin {
+	return &mockOrigin{
+		objects: make(map[string][]byte),
+		header:  http.Header{"Cache-Control": {"max-age=3600"}},
+		etag:    `"v1"`,
+	}
+}
+
+func (o *mockOrigin) set(rawUrl string, body []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.objects[rawUrl] = body
+}
+
+// requests returns the Range header of the origin requests, empty for the full request.
+func (o *mockOrigin) requests() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string{}, o.ranges...)
+}
+
+func (o *mockOrigin) Do(req *http.Request, _ bool, _ time.Duration) (*http.Response, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	rawRange := req.Header.Get("Range")
+	o.ranges = append(o.ranges, rawRange)
+
+	body, ok := o.objects[req.URL.String()]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	}
+
+	header := o.header.Clone()
+	header.Set("ETag", o.etag)
+	header.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	header.Set("Content-Type", "application/octet-stream")
+
+	status, size := http.StatusOK, uint64(len(body))
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" && ifRange != o.etag {
+		rawRange = ""
+	}
+	if rawRange != "" && !o.noRange {
+		rng, err := xhttp.SingleRange(rawRange, size)
+		if err != nil {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return &http.Response{StatusCode: http.StatusRequestedRangeNotSatisfiable, Header: header, Body: http.NoBody, Request: req}, nil
+		}
+		status = http.StatusPartialContent
+		header.Set("Content-Range", xhttp.BuildHeaderRange(uint64(rng.Start), uint64(rng.End), size))
+		body = body[rng.Start : rng.End+1]
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	var r io.Reader = bytes.NewReader(body)
+	if o.cuts > 0 && o.cutAt < len(body) {
+		o.cuts--
+		cutErr := o.cutErr
+		if cutErr == nil {
+			cutErr = io.ErrUnexpectedEOF
+		}
+		r = io.MultiReader(bytes.NewReader(body[:o.cutAt]), errReader{cutErr})
+	}
+
+	return &http.Response{
+		StatusCode:    status,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(r),
+		Request:       req,
+	}, nil
+}
+
+func (o *mockOrigin) DoLoopback(req *http.Request) (*http.Response, error) {
+	return o.Do(req, false, 0)
+}
+
+func (o *mockOrigin) Apply(nodes []selector.Node) {}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+// newTestStorage sets the default storage of a pebble bucket in the temp dir.
+func newTestStorage(t *testing.T) storagev1.Storage {
+	st, err := storage.New(&conf.Storage{
+		Driver:          "native",
+		DBType:          "pebble",
+		SelectionPolicy: "hashring",
+		EvictionPolicy:  "lru",
+		Buckets: []*conf.Bucket{
+			{Path: t.TempDir(), Type: "normal"},
+		},
+	}, log.GetLogger())
+	require.NoError(t, err)
+
+	storage.SetDefault(st)
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+// newTestCaching returns the caching middleware over the mock origin and a new storage.
+func newTestCaching(t *testing.T, origin *mockOrigin, options map[string]any) http.RoundTripper {
+	proxy.SetDefault(origin)
+	newTestStorage(t)
+
+	mw, cleanup, err := Middleware(&configv1.Middleware{Name: "caching", Options: options})
+	require.NoError(t, err)
+	t.Cleanup(cleanup)
+	return mw(nil)
+}
+
+// doRequest sends the request through the middleware and reads the whole body,
+// returns the response, the body and the cache status, e.g. HIT.
+func doRequest(t *testing.T, rt http.RoundTripper, rawUrl string, header http.Header) (*http.Response, []byte, string) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, rawUrl, nil)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	status, _, _ := strings.Cut(resp.Header.Get(constants.ProtocolCacheStatusKey), " ")
+	return resp, body, status
+}
+
+// lookup returns the stored metadata of the url.
+func lookup(t *testing.T, rawUrl string) *Caching {
+	req, err := http.NewRequest(http.MethodGet, rawUrl, nil)
+	require.NoError(t, err)
+
+	id, err := newObjectIDFromRequest(req, "", false)
+	require.NoError(t, err)
+
+	bucket := storage.Select(context.Background(), id)
+	md, _ := bucket.Lookup(context.Background(), id)
+	return &Caching{id: id, bucket: bucket, md: md}
+}
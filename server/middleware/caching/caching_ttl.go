@@ -0,0 +1,190 @@
+package caching
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
+)
+
+// ttlRule overrides the freshness lifetime of the matched objects, the first matched rule wins, e.g.
+//
+//	ttl_rules:
+//	  - host: "static.example.com"
+//	    path_prefix: /assets/
+//	    min_ttl: 24h       # origin sends max-age=0 on the immutable assets
+//	  - host: "*.example.com"
+//	    header: X-Accel-Expires
+//	  - extensions: [".jpg", ".png"]
+//	    content_types: ["image/"]
+//	    default_ttl: 1h
+//	    max_ttl: 168h
+type ttlRule struct {
+	Host         string   `json:"host" yaml:"host"`                   // exact host or pattern, empty matches all
+	PathPrefix   string   `json:"path_prefix" yaml:"path_prefix"`     // empty matches all
+	Extensions   []string `json:"extensions" yaml:"extensions"`       // e.g. .js .css, empty matches all
+	ContentTypes []string `json:"content_types" yaml:"content_types"` // prefix of the response Content-Type, e.g. image/
+	TTL          Duration `json:"ttl" yaml:"ttl"`                     // force the ttl, the origin cache-control is ignored
+	Header       string   `json:"header" yaml:"header"`               // read the ttl (seconds) from the origin header, e.g. X-Accel-Expires
+	DefaultTTL   Duration `json:"default_ttl" yaml:"default_ttl"`     // the ttl of the response without explicit expiration
+	MinTTL       Duration `json:"min_ttl" yaml:"min_ttl"`             // clamp the origin ttl
+	MaxTTL       Duration `json:"max_ttl" yaml:"max_ttl"`
+
+	ttl, defaultTTL, minTTL, maxTTL time.Duration
+}
+
+func (r *ttlRule) init() error {
+	if r.Host != "" {
+		if _, err := path.Match(r.Host, ""); err != nil {
+			return fmt.Errorf("invalid ttl rule host %q", r.Host)
+		}
+	}
+
+	for _, d := range []struct {
+		name string
+		raw  Duration
+		dst  *time.Duration
+	}{
+		{"ttl", r.TTL, &r.ttl},
+		{"default_ttl", r.DefaultTTL, &r.defaultTTL},
+		{"min_ttl", r.MinTTL, &r.minTTL},
+		{"max_ttl", r.MaxTTL, &r.maxTTL},
+	} {
+		if d.raw == "" {
+			continue
+		}
+		v, err := time.ParseDuration(string(d.raw))
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid ttl rule %s %q", d.name, d.raw)
+		}
+		*d.dst = v
+	}
+
+	if r.maxTTL > 0 && r.minTTL > r.maxTTL {
+		return fmt.Errorf("invalid ttl rule of %q, min_ttl > max_ttl", r.Host+r.PathPrefix)
+	}
+
+	for i, ext := range r.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		r.Extensions[i] = ext
+	}
+	return nil
+}
+
+func (r *ttlRule) match(host, urlPath string, header http.Header) bool {
+	if r.Host != "" && r.Host != host {
+		if ok, _ := path.Match(r.Host, host); !ok {
+			return false
+		}
+	}
+
+	if r.PathPrefix != "" && !strings.HasPrefix(urlPath, r.PathPrefix) {
+		return false
+	}
+
+	if len(r.Extensions) > 0 && !slices.Contains(r.Extensions, strings.ToLower(path.Ext(urlPath))) {
+		return false
+	}
+
+	if len(r.ContentTypes) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		if !slices.ContainsFunc(r.ContentTypes, func(ct string) bool { return strings.HasPrefix(mediaType, ct) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the freshness lifetime of the response by the rule.
+func (r *ttlRule) apply(header http.Header) (time.Duration, bool) {
+	if r.ttl > 0 {
+		return r.ttl, true
+	}
+
+	var (
+		ttl       time.Duration
+		cacheable bool
+	)
+
+	switch raw := header.Get(r.Header); {
+	case r.Header != "" && raw != "":
+		ttl, cacheable = parseTTLHeader(raw)
+	default:
+		ttl, cacheable = xhttp.ParseCacheTime("", header)
+		if r.defaultTTL > 0 && !hasExplicitExpiration(header) {
+			ttl = r.defaultTTL
+		}
+	}
+
+	if !cacheable {
+		return 0, false
+	}
+
+	if r.minTTL > 0 {
+		ttl = max(ttl, r.minTTL)
+	}
+	if r.maxTTL > 0 {
+		ttl = min(ttl, r.maxTTL)
+	}
+	return ttl, true
+}
+
+// parseTTLHeader parses the seconds, or the unix time with the `@` prefix like X-Accel-Expires, 0 is not cacheable.
+func parseTTLHeader(raw string) (time.Duration, bool) {
+	raw = strings.TrimSpace(raw)
+	if unix, ok := strings.CutPrefix(raw, "@"); ok {
+		sec, err := strconv.ParseInt(unix, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return max(time.Until(time.Unix(sec, 0)), 0), true
+	}
+
+	sec, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || sec <= 0 {
+		return 0, false
+	}
+	return time.Duration(sec) * time.Second, true
+}
+
+// hasExplicitExpiration reports whether the origin sets the freshness lifetime or `no-cache` explicitly.
+func hasExplicitExpiration(header http.Header) bool {
+	ctrl, targeted := xhttp.EdgeCacheControl(header)
+	if noCache, _ := ctrl.NoCache(); noCache || ctrl.SMaxAge() >= 0 || ctrl.MaxAge() >= 0 {
+		return true
+	}
+	return !targeted && header.Get("Expires") != ""
+}
+
+func initTTLRules(rules []*ttlRule) error {
+	for _, r := range rules {
+		if err := r.init(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheTime returns the freshness lifetime of the response, the first matched ttl rule overrides the origin.
+func (c *Caching) cacheTime(header http.Header) (time.Duration, bool) {
+	if len(c.opt.TTLRules) > 0 {
+		if u, err := url.Parse(c.id.Path()); err == nil {
+			for _, r := range c.opt.TTLRules {
+				if r.match(u.Host, u.Path, header) {
+					return r.apply(header)
+				}
+			}
+		}
+	}
+	return xhttp.ParseCacheTime("", header)
+}
@@ -0,0 +1,255 @@
+package caching
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLRuleMatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        ttlRule
+		host        string
+		path        string
+		contentType string
+		want        bool
+	}{
+		{name: "empty rule", rule: ttlRule{}, host: "www.example.com", path: "/1.jpg", want: true},
+		{name: "exact host", rule: ttlRule{Host: "www.example.com"}, host: "www.example.com", path: "/1.jpg", want: true},
+		{name: "other host", rule: ttlRule{Host: "www.example.com"}, host: "img.example.com", path: "/1.jpg", want: false},
+		{name: "host pattern", rule: ttlRule{Host: "*.example.com"}, host: "img.example.com", path: "/1.jpg", want: true},
+		{name: "host pattern other domain", rule: ttlRule{Host: "*.example.com"}, host: "www.example.org", path: "/1.jpg", want: false},
+		{name: "path prefix", rule: ttlRule{PathPrefix: "/assets/"}, host: "www.example.com", path: "/assets/app.js", want: true},
+		{name: "other path", rule: ttlRule{PathPrefix: "/assets/"}, host: "www.example.com", path: "/api/app.js", want: false},
+		{name: "extension", rule: ttlRule{Extensions: []string{"JPG", ".png"}}, host: "www.example.com", path: "/1.JPG", want: true},
+		{name: "other extension", rule: ttlRule{Extensions: []string{".png"}}, host: "www.example.com", path: "/1.jpg", want: false},
+		{name: "content type", rule: ttlRule{ContentTypes: []string{"image/"}}, host: "www.example.com", path: "/1", contentType: "image/jpeg; charset=binary", want: true},
+		{name: "other content type", rule: ttlRule{ContentTypes: []string{"image/"}}, host: "www.example.com", path: "/1", contentType: "text/html", want: false},
+		{
+			name:        "all conditions",
+			rule:        ttlRule{Host: "*.example.com", PathPrefix: "/static/", Extensions: []string{".jpg"}, ContentTypes: []string{"image/"}},
+			host:        "img.example.com",
+			path:        "/static/1.jpg",
+			contentType: "image/jpeg",
+			want:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.rule.init())
+			header := make(http.Header)
+			if tt.contentType != "" {
+				header.Set("Content-Type", tt.contentType)
+			}
+			assert.Equal(t, tt.want, tt.rule.match(tt.host, tt.path, header))
+		})
+	}
+}
+
+func TestTTLRuleApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   ttlRule
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{
+			name:   "origin ttl",
+			rule:   ttlRule{},
+			header: http.Header{"Cache-Control": {"max-age=60"}},
+			want:   time.Minute,
+			ok:     true,
+		},
+		{
+			name:   "forced ttl",
+			rule:   ttlRule{TTL: "1h", MaxTTL: "1m"},
+			header: http.Header{"Cache-Control": {"no-store"}},
+			want:   time.Hour,
+			ok:     true,
+		},
+		{
+			name:   "min ttl",
+			rule:   ttlRule{MinTTL: "24h"},
+			header: http.Header{"Cache-Control": {"max-age=0"}},
+			want:   24 * time.Hour,
+			ok:     true,
+		},
+		{
+			name:   "max ttl",
+			rule:   ttlRule{MaxTTL: "1h"},
+			header: http.Header{"Cache-Control": {"max-age=86400"}},
+			want:   time.Hour,
+			ok:     true,
+		},
+		{
+			name:   "within min and max",
+			rule:   ttlRule{MinTTL: "1m", MaxTTL: "1h"},
+			header: http.Header{"Cache-Control": {"max-age=600"}},
+			want:   10 * time.Minute,
+			ok:     true,
+		},
+		{
+			name:   "min ttl does not make it cacheable",
+			rule:   ttlRule{MinTTL: "1h"},
+			header: http.Header{"Cache-Control": {"no-store"}},
+			want:   0,
+			ok:     false,
+		},
+		{
+			name:   "default ttl without explicit expiration",
+			rule:   ttlRule{DefaultTTL: "1h"},
+			header: http.Header{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}},
+			want:   time.Hour,
+			ok:     true,
+		},
+		{
+			name:   "default ttl with explicit expiration",
+			rule:   ttlRule{DefaultTTL: "1h"},
+			header: http.Header{"Cache-Control": {"max-age=60"}},
+			want:   time.Minute,
+			ok:     true,
+		},
+		{
+			name:   "default ttl clamped",
+			rule:   ttlRule{DefaultTTL: "2h", MaxTTL: "1h"},
+			header: http.Header{},
+			want:   time.Hour,
+			ok:     true,
+		},
+		{
+			name:   "x-accel-expires over cache-control",
+			rule:   ttlRule{Header: "X-Accel-Expires"},
+			header: http.Header{"Cache-Control": {"no-store"}, "X-Accel-Expires": {"120"}},
+			want:   2 * time.Minute,
+			ok:     true,
+		},
+		{
+			name:   "x-accel-expires zero is not cacheable",
+			rule:   ttlRule{Header: "X-Accel-Expires"},
+			header: http.Header{"Cache-Control": {"max-age=60"}, "X-Accel-Expires": {"0"}},
+			want:   0,
+			ok:     false,
+		},
+		{
+			name:   "x-accel-expires clamped",
+			rule:   ttlRule{Header: "X-Accel-Expires", MaxTTL: "1m"},
+			header: http.Header{"X-Accel-Expires": {"3600"}},
+			want:   time.Minute,
+			ok:     true,
+		},
+		{
+			name:   "without x-accel-expires",
+			rule:   ttlRule{Header: "X-Accel-Expires"},
+			header: http.Header{"Cache-Control": {"max-age=60"}},
+			want:   time.Minute,
+			ok:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.rule.init())
+			got, ok := tt.rule.apply(tt.header)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.ok, ok)
+		})
+	}
+}
+
+func TestParseTTLHeader(t *testing.T) {
+	ttl, ok := parseTTLHeader(" 60 ")
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, ttl)
+
+	for _, raw := range []string{"0", "-1", "abc", "@abc", ""} {
+		_, ok = parseTTLHeader(raw)
+		assert.False(t, ok, raw)
+	}
+
+	// the unix time with the `@` prefix.
+	ttl, ok = parseTTLHeader("@" + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	assert.True(t, ok)
+	assert.InDelta(t, time.Hour, ttl, float64(2*time.Second))
+
+	ttl, ok = parseTTLHeader("@" + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	assert.True(t, ok)
+	assert.Zero(t, ttl)
+}
+
+func TestTTLRuleInit(t *testing.T) {
+	for _, r := range []*ttlRule{
+		{Host: "[www.example.com"},
+		{TTL: "forever"},
+		{MaxTTL: "-1h"},
+		{MinTTL: "2h", MaxTTL: "1h"},
+	} {
+		assert.Error(t, r.init())
+	}
+
+	r := &ttlRule{Extensions: []string{"JPG", ".Png"}}
+	assert.NoError(t, r.init())
+	assert.Equal(t, []string{".jpg", ".png"}, r.Extensions)
+}
+
+func TestCacheTimeFirstRuleWins(t *testing.T) {
+	rules := []*ttlRule{
+		{Host: "static.example.com", PathPrefix: "/assets/", MinTTL: "24h"},
+		{Host: "*.example.com", TTL: "1m"},
+	}
+	require.NoError(t, initTTLRules(rules))
+
+	cacheTime := func(rawUrl string, header http.Header) (time.Duration, bool) {
+		req, err := http.NewRequest(http.MethodGet, rawUrl, nil)
+		require.NoError(t, err)
+		id, err := newObjectIDFromRequest(req, "", false)
+		require.NoError(t, err)
+
+		c := &Caching{id: id, opt: &cachingOption{TTLRules: rules}}
+		return c.cacheTime(header)
+	}
+
+	ttl, ok := cacheTime("http://static.example.com/assets/app.js", http.Header{"Cache-Control": {"max-age=0"}})
+	assert.True(t, ok)
+	assert.Equal(t, 24*time.Hour, ttl)
+
+	ttl, ok = cacheTime("http://static.example.com/index.html", http.Header{"Cache-Control": {"max-age=0"}})
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, ttl)
+
+	// no rule matched, the origin ttl.
+	ttl, ok = cacheTime("http://www.example.org/index.html", http.Header{"Cache-Control": {"max-age=600"}})
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Minute, ttl)
+}
+
+func TestTTLRuleXAccelExpires(t *testing.T) {
+	origin := newMockOrigin()
+	origin.header = http.Header{"Cache-Control": {"no-store"}, "X-Accel-Expires": {"3600"}}
+	rt := newTestCaching(t, origin, map[string]any{
+		"ttl_rules": []map[string]any{
+			{"host": "*.example.com", "header": "X-Accel-Expires"},
+		},
+	})
+
+	const rawUrl = "http://www.example.com/path/to/accel.bin"
+	data := makebuf(2048)
+	origin.set(rawUrl, data)
+
+	_, body, status := doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "MISS", status)
+
+	if md := lookup(t, rawUrl).md; assert.NotNil(t, md) {
+		assert.InDelta(t, time.Now().Add(time.Hour).Unix(), md.ExpiresAt, 5)
+	}
+
+	_, body, status = doRequest(t, rt, rawUrl, nil)
+	assert.Equal(t, data, body)
+	assert.Equal(t, "HIT", status)
+	assert.Len(t, origin.requests(), 1)
+}
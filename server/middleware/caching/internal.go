@@ -48,8 +48,10 @@ type Caching struct {
 	prefetch     bool
 	revalidate   bool
 	fileChanged  bool
-	noContentLen bool // noContentLen indicates whether the content length is omitted in the HTTP response.
-	migration    bool // cache migration
+	noContentLen bool            // noContentLen indicates whether the content length is omitted in the HTTP response.
+	migration    bool            // cache migration
+	bypass       bool            // not admitted to the cache, the response is not stored
+	subRequests  []io.ReadCloser // the sub-range requests of the missing chunks, resolved before responding
 }
 
 func (c *Caching) markCacheStatus(start, end int64) {
@@ -110,6 +112,8 @@ func (c *Caching) reset() {
 	c.fileChanged = false
 	c.noContentLen = false
 	c.migration = false
+	c.bypass = false
+	c.subRequests = nil
 }
 
 func (c *Caching) getAvailableChunks() (available []uint32) {
@@ -173,9 +177,13 @@ func getContents(c *Caching, reqChunks []uint32, from uint32) (reader io.ReadClo
 			resp, err1 := c.doProxy(req, true)
 			c.log.Debugf("doProxy[middle]: timeCost: %s, Range: %s, from index%d", time.Since(now), newRange, index)
 			if err1 != nil {
-				return nil, err
+				return nil, err1
 			}
 
+			// 源站不支持 Range, 从完整响应中截取
+			if ignoredRange(req, resp) {
+				return c.sliceFullResponse(resp, fromByte, toByte), nil
+			}
 			// 发起的是 206 请求，但是返回的非 206
 			if resp.StatusCode != http.StatusPartialContent {
 				c.log.Warnf("doProxy[middle]: status code: %d, bod size: %d", resp.StatusCode, resp.ContentLength)
@@ -183,8 +191,10 @@ func getContents(c *Caching, reqChunks []uint32, from uint32) (reader io.ReadClo
 			}
 			return resp, err1
 		})
+		c.subRequests = append(c.subRequests, reader)
 
-		return iobuf.PartsReader(chunkFile /* io */, reader, chunkFile), int(availableChunks[index]-availableChunks[from]) + 1, nil
+		// the chunk file is closed as the last part, not closed again by the closer.
+		return iobuf.PartsReader(nil, reader, chunkFile), int(availableChunks[index]-reqChunks[from]) + 1, nil
 	}
 
 	// no more hit block, fill
@@ -206,10 +216,15 @@ func getContents(c *Caching, reqChunks []uint32, from uint32) (reader io.ReadClo
 		c.log.Debugf("doProxy[tail]: timeCost: %s, rawRange: %s, newRange: %s", time.Since(now), rawRange, newRange)
 
 		if err1 != nil {
-			return nil, err
+			return nil, err1
+		}
+		// 源站不支持 Range, 从完整响应中截取
+		if ignoredRange(req, resp) {
+			return c.sliceFullResponse(resp, fromByte, toByte), nil
 		}
 		return resp, err1
 	})
+	c.subRequests = append(c.subRequests, reader)
 
 	return reader, len(reqChunks) - int(from), nil
 }
@@ -12,8 +12,10 @@ import (
 
 	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
 	"github.com/omalloc/tavern/contrib/log"
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
 	"github.com/omalloc/tavern/proxy"
 	"github.com/omalloc/tavern/storage"
+	"github.com/omalloc/tavern/storage/ban"
 )
 
 // Processor defines the interface for caching processor middleware.
@@ -91,9 +93,35 @@ func (pc *ProcessorChain) preCacheProcessor(proxyClient proxy.Proxy, opt *cachin
 	// Select storage bucket by object ID
 	// hashring or diskhash
 	bucket := storage.Select(req.Context(), objectID)
+
+	// bypass rules, the request is neither looked up nor stored.
+	if rule, ok := opt.bypassed(req); ok {
+		caching := &Caching{
+			log:         log.Context(req.Context()),
+			proxyClient: proxyClient,
+			opt:         opt,
+			id:          objectID,
+			bucket:      bucket,
+			req:         req,
+			processor:   pc,
+			bypass:      true,
+			cacheStatus: storagev1.BYPASS,
+		}
+		caching.log.Debugf("bypass cache %s by rule %s", objectID.Key(), rule)
+		return caching, nil
+	}
+
 	// lookup cache with cache-key
 	md, _ := bucket.Lookup(req.Context(), objectID)
 
+	// lazy ban, the banned object is treated as cache miss.
+	if b := ban.Current().Banned(md); b != nil {
+		if err := bucket.DiscardWithMessage(req.Context(), objectID, "banned"); err == nil {
+			b.Discarded()
+		}
+		md = nil
+	}
+
 	// TODO: object pool.
 	//caching := cachingPool.Get().(*Caching)
 	//caching.log = log.Context(req.Context())
@@ -130,10 +158,25 @@ func (pc *ProcessorChain) preCacheProcessor(proxyClient proxy.Proxy, opt *cachin
 func (pc *ProcessorChain) postCacheProcessor(caching *Caching, _ *http.Request, resp *http.Response) (*http.Response, error) {
 	caching.setXCache(resp)
 
-	if resp != nil && resp.Header != nil && caching.md != nil {
-		resp.Header.Set("Age", strconv.FormatInt(time.Now().Unix()-caching.md.RespUnix, 10))
-		resp.Header.Set("Date", time.Unix(caching.md.RespUnix, 0).Local().UTC().Format(http.TimeFormat))
-		resp.Header.Set("Expires", time.Unix(caching.md.ExpiresAt, 0).Local().UTC().Format(http.TimeFormat))
+	// the surrogate directives are for the cache only, the edge ttl is not exposed to the clients.
+	targeted := false
+	if resp != nil && resp.Header != nil {
+		_, targeted = xhttp.EdgeCacheControl(resp.Header)
+		xhttp.RemoveEdgeCacheControl(resp.Header)
+	}
+
+	if resp != nil && resp.Header != nil && caching.md != nil && !caching.bypass {
+		// current_age = corrected_initial_age + resident_time (RFC 9111 4.2.3)
+		age := caching.md.InitialAge + max(time.Now().Unix()-caching.md.RespUnix, 0)
+		resp.Header.Set("Age", strconv.FormatInt(age, 10))
+		// the origin Date is kept, the cache only adds the missing one.
+		if resp.Header.Get("Date") == "" {
+			resp.Header.Set("Date", time.Unix(caching.md.RespUnix, 0).UTC().Format(http.TimeFormat))
+		}
+		// the explicit expiration of the origin is kept for the downstream caches.
+		if !targeted && resp.Header.Get("Expires") == "" && resp.Header.Get("Cache-Control") == "" {
+			resp.Header.Set("Expires", time.Unix(caching.md.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+		}
 	}
 
 	// FETCH request
@@ -141,7 +184,10 @@ func (pc *ProcessorChain) postCacheProcessor(caching *Caching, _ *http.Request,
 		_, _ = io.Copy(io.Discard, resp.Body)
 	}
 
-	// TODO: incr index ref count.
+	// incr index ref count, flushed to the indexdb in batches by the bucket.
+	if caching.hit && caching.md != nil && !caching.prefetch {
+		caching.bucket.Touch(caching.req.Context(), caching.id)
+	}
 
 	return resp, nil
 }
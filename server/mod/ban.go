@@ -0,0 +1,92 @@
+package mod
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/goccy/go-json"
+
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
+	"github.com/omalloc/tavern/storage/ban"
+)
+
+// Guard authorizes the requests of the local api, e.g. the purge plugin authorizer.
+type Guard func(next http.Handler) http.Handler
+
+// LoopbackOnly is the Guard allows the loopback clients only, used without the purge plugin.
+func LoopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		if addr, err1 := netip.ParseAddr(host); err1 != nil || !addr.Unmap().IsLoopback() {
+			xhttp.WriteJSONError(w, http.StatusForbidden, "not allowed from the address")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// HandleBan registers the ban list handlers to the local api, authorized by the guard.
+//
+// e.g.
+//
+//	curl -X POST http://127.0.0.1:8080/cache/bans -d '{"host":"www.example.com","url":"\\.jpg$"}'
+//	curl -X POST http://127.0.0.1:8080/cache/bans -d '{"host":"www.example.com","header_name":"Content-Type","header_value":"^image/"}'
+//	curl http://127.0.0.1:8080/cache/bans
+//	curl -X DELETE http://127.0.0.1:8080/cache/bans/<ban-id>
+func HandleBan(r *http.ServeMux, guard Guard) {
+	if guard == nil {
+		guard = LoopbackOnly
+	}
+
+	r.Handle("POST /cache/bans", guard(http.HandlerFunc(handleBanAdd)))
+	r.Handle("GET /cache/bans", guard(http.HandlerFunc(handleBanList)))
+	r.Handle("DELETE /cache/bans/{id}", guard(http.HandlerFunc(handleBanRemove)))
+}
+
+func handleBanAdd(w http.ResponseWriter, req *http.Request) {
+	bans := ban.Current()
+	if bans == nil {
+		xhttp.WriteJSONError(w, http.StatusServiceUnavailable, "ban list not initialized")
+		return
+	}
+
+	b := &ban.Ban{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(b); err != nil {
+		xhttp.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	added, err := bans.Add(req.Context(), b)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, ban.ErrTooManyBans) {
+			code = http.StatusTooManyRequests
+		}
+		xhttp.WriteJSONError(w, code, err.Error())
+		return
+	}
+
+	xhttp.WriteJSON(w, http.StatusCreated, added)
+}
+
+func handleBanList(w http.ResponseWriter, req *http.Request) {
+	bans := ban.Current().List()
+	if bans == nil {
+		bans = make([]*ban.Ban, 0)
+	}
+	xhttp.WriteJSON(w, http.StatusOK, map[string]any{"bans": bans})
+}
+
+func handleBanRemove(w http.ResponseWriter, req *http.Request) {
+	bans := ban.Current()
+	if bans == nil || !bans.Remove(req.Context(), req.PathValue("id")) {
+		xhttp.WriteJSONError(w, http.StatusNotFound, "ban not found")
+		return
+	}
+	xhttp.WriteJSON(w, http.StatusOK, map[string]string{"message": "success"})
+}
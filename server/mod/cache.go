@@ -0,0 +1,322 @@
+package mod
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
+	"github.com/omalloc/tavern/storage"
+	"github.com/omalloc/tavern/storage/accounting"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// errPageFull skips the rest of the index once the page is filled.
+var errPageFull = errors.New("page full")
+
+// CacheObject is the local api view of object.Metadata.
+type CacheObject struct {
+	URL         string      `json:"url"`
+	VirtualKey  string      `json:"virtual_key,omitempty"`
+	CacheKey    string      `json:"cache_key"`
+	Hash        string      `json:"hash"`
+	Bucket      string      `json:"bucket"`
+	Flags       []string    `json:"flags,omitempty"`
+	Code        int         `json:"code"`
+	Size        uint64      `json:"size"`
+	BlockSize   uint64      `json:"block_size"`
+	Chunks      ChunkState  `json:"chunks"`
+	Refs        int64       `json:"refs"`
+	RespUnix    int64       `json:"resp_unix"`
+	LastRefUnix int64       `json:"last_ref_unix"`
+	ExpiresAt   int64       `json:"expires_at"`
+	TTL         int64       `json:"ttl"` // seconds left, negative if expired
+	Expired     bool        `json:"expired"`
+	Headers     http.Header `json:"headers,omitempty"`
+}
+
+// ChunkState describes the chunk completeness of an object.
+type ChunkState struct {
+	Count    int     `json:"count"`
+	Total    uint64  `json:"total"`
+	Percent  float64 `json:"percent"`
+	Complete bool    `json:"complete"`
+}
+
+type lookupResult struct {
+	CacheObject
+	Found    bool           `json:"found"`
+	VaryKeys []string       `json:"vary_keys,omitempty"`
+	Variants []*CacheObject `json:"variants,omitempty"`
+}
+
+type listResult struct {
+	Prefix     string         `json:"prefix"`
+	Count      int            `json:"count"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	Objects    []*CacheObject `json:"objects"`
+}
+
+type domainResult struct {
+	Total   int64              `json:"total"` // total objects
+	Bytes   int64              `json:"bytes"` // total stored bytes
+	Domains []accounting.Usage `json:"domains"`
+}
+
+// HandleCacheAPI registers the cache inspection handlers to the local api.
+//
+// e.g.
+//
+//	curl 'http://127.0.0.1:8080/cache/lookup?url=http://www.example.com/path/to/1M.bin'
+//	curl 'http://127.0.0.1:8080/cache/lookup?hash=87d369091ed21e2b7c515e09486299966644ce46'
+//	curl 'http://127.0.0.1:8080/cache/objects?prefix=http://www.example.com/path/&limit=100'
+//	curl 'http://127.0.0.1:8080/cache/domains?limit=10'
+//	curl 'http://127.0.0.1:8080/cache/domains/www.example.com'
+func HandleCacheAPI(r *http.ServeMux) {
+	r.HandleFunc("GET /cache/lookup", handleCacheLookup)
+	r.HandleFunc("GET /cache/objects", handleCacheObjects)
+	r.HandleFunc("GET /cache/domains", handleCacheDomains)
+	r.HandleFunc("GET /cache/domains/{domain}", handleCacheDomain)
+}
+
+// handleCacheLookup returns the cache key, bucket, metadata and vary variants of the url.
+func handleCacheLookup(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	storeUrl := query.Get("url")
+	ctx := req.Context()
+
+	// lookup with the object hash, e.g. the `i-x-swapfile` debug header.
+	if raw := query.Get("hash"); raw != "" && storeUrl == "" {
+		hash, ok := parseHash(raw)
+		if !ok {
+			xhttp.WriteJSONError(w, http.StatusBadRequest, "invalid `hash` query")
+			return
+		}
+		for _, b := range storage.Current().Buckets() {
+			if md, err := b.LookupWithHash(ctx, hash); err == nil {
+				storeUrl = md.ID.Path()
+				query.Set("vkey", md.ID.Ext())
+				break
+			}
+		}
+		if storeUrl == "" {
+			xhttp.WriteJSON(w, http.StatusNotFound, &lookupResult{CacheObject: CacheObject{Hash: raw}})
+			return
+		}
+	}
+
+	if storeUrl == "" {
+		xhttp.WriteJSONError(w, http.StatusBadRequest, "missing `url` or `hash` query")
+		return
+	}
+
+	id := object.NewVirtualID(storeUrl, query.Get("vkey"))
+	bucket := storage.Current().Select(ctx, id)
+	if bucket == nil {
+		xhttp.WriteJSONError(w, http.StatusServiceUnavailable, "bucket not found")
+		return
+	}
+
+	result := &lookupResult{
+		CacheObject: CacheObject{
+			URL:        id.Path(),
+			VirtualKey: id.Ext(),
+			CacheKey:   id.String(),
+			Hash:       id.HashStr(),
+			Bucket:     bucket.ID(),
+		},
+	}
+
+	md, err := bucket.Lookup(ctx, id)
+	if err != nil {
+		xhttp.WriteJSON(w, http.StatusNotFound, result)
+		return
+	}
+
+	result.Found = true
+	result.CacheObject = *NewCacheObject(bucket.ID(), md, true)
+
+	// vary index, the variants live in the same bucket.
+	if md.IsVary() {
+		result.VaryKeys = md.VirtualKey
+		for _, vkey := range md.VirtualKey {
+			vmd, err1 := bucket.Lookup(ctx, object.NewVirtualID(md.ID.Path(), vkey))
+			if err1 != nil {
+				continue
+			}
+			result.Variants = append(result.Variants, NewCacheObject(bucket.ID(), vmd, false))
+		}
+	}
+
+	xhttp.WriteJSON(w, http.StatusOK, result)
+}
+
+// handleCacheObjects lists objects by url prefix with the `ix/` inverted index.
+//
+// the objects are sorted by url, `cursor` is the `next_cursor` of the previous page.
+func handleCacheObjects(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	prefix := query.Get("prefix")
+	cursor := query.Get("cursor")
+	limit := parseLimit(query.Get("limit"))
+
+	current := storage.Current()
+	ctx := req.Context()
+
+	type entry struct {
+		key    string
+		hash   object.IDHash
+		bucket storagev1.Bucket
+	}
+
+	// every bucket keeps at most `limit+1` sorted keys after the cursor,
+	// then merged to one page.
+	entries := make([]entry, 0, limit)
+	for _, b := range current.Buckets() {
+		indexPrefix := "ix/" + b.ID() + "/"
+		n := 0
+		err := current.SharedKV().IteratePrefix(ctx, []byte(indexPrefix+prefix), func(key, val []byte) error {
+			if n > limit {
+				return errPageFull
+			}
+			if len(val) < object.IdHashSize {
+				return nil
+			}
+
+			k := strings.TrimPrefix(string(key), indexPrefix)
+			if cursor != "" && k <= cursor {
+				return nil
+			}
+
+			e := entry{key: k, bucket: b}
+			copy(e.hash[:], val[:object.IdHashSize])
+			entries = append(entries, e)
+			n++
+			return nil
+		})
+		if err != nil && !errors.Is(err, errPageFull) {
+			xhttp.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int {
+		return strings.Compare(a.key, b.key)
+	})
+
+	result := &listResult{
+		Prefix:  prefix,
+		Objects: make([]*CacheObject, 0, min(limit, len(entries))),
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		result.NextCursor = entries[limit-1].key
+	}
+
+	for _, e := range entries {
+		md, err := e.bucket.LookupWithHash(ctx, e.hash)
+		if err != nil {
+			continue
+		}
+		result.Objects = append(result.Objects, NewCacheObject(e.bucket.ID(), md, false))
+	}
+	result.Count = len(result.Objects)
+
+	xhttp.WriteJSON(w, http.StatusOK, result)
+}
+
+// handleCacheDomains returns the objects and stored bytes of the domains, sorted by bytes desc.
+func handleCacheDomains(w http.ResponseWriter, req *http.Request) {
+	domains := accounting.Default().List()
+
+	result := &domainResult{
+		Domains: domains,
+	}
+	for _, u := range domains {
+		result.Total += u.Objects
+		result.Bytes += u.Bytes
+	}
+
+	if raw := req.URL.Query().Get("limit"); raw != "" {
+		result.Domains = domains[:min(parseLimit(raw), len(domains))]
+	}
+
+	xhttp.WriteJSON(w, http.StatusOK, result)
+}
+
+// handleCacheDomain returns the objects and stored bytes of the domain.
+func handleCacheDomain(w http.ResponseWriter, req *http.Request) {
+	usage, ok := accounting.Default().Get(req.PathValue("domain"))
+	if !ok {
+		xhttp.WriteJSON(w, http.StatusNotFound, usage)
+		return
+	}
+	xhttp.WriteJSON(w, http.StatusOK, usage)
+}
+
+// NewCacheObject converts object.Metadata to the local api view.
+func NewCacheObject(bucketID string, md *object.Metadata, withHeaders bool) *CacheObject {
+	now := time.Now().Unix()
+	obj := &CacheObject{
+		URL:         md.ID.Path(),
+		VirtualKey:  md.ID.Ext(),
+		CacheKey:    md.ID.String(),
+		Hash:        md.ID.HashStr(),
+		Bucket:      bucketID,
+		Flags:       md.Flags.Names(),
+		Code:        md.Code,
+		Size:        md.Size,
+		BlockSize:   md.BlockSize,
+		Refs:        md.Refs,
+		RespUnix:    md.RespUnix,
+		LastRefUnix: md.LastRefUnix,
+		ExpiresAt:   md.ExpiresAt,
+		TTL:         md.ExpiresAt - now,
+		Expired:     md.ExpiresAt < now,
+		Chunks: ChunkState{
+			Count:    md.Chunks.Count(),
+			Complete: md.HasComplete(),
+		},
+	}
+
+	if md.BlockSize > 0 {
+		obj.Chunks.Total = (md.Size + md.BlockSize - 1) / md.BlockSize
+	}
+	if obj.Chunks.Total > 0 {
+		obj.Chunks.Percent = float64(obj.Chunks.Count) * 100 / float64(obj.Chunks.Total)
+	}
+	if withHeaders {
+		obj.Headers = md.Headers
+	}
+	return obj
+}
+
+func parseLimit(s string) int {
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 {
+		return defaultListLimit
+	}
+	return min(limit, maxListLimit)
+}
+
+// parseHash parses the 40 chars hex object hash.
+func parseHash(s string) (object.IDHash, bool) {
+	var hash object.IDHash
+	if len(s) != object.IdHashSize*2 {
+		return hash, false
+	}
+	if _, err := hex.Decode(hash[:], []byte(s)); err != nil {
+		return hash, false
+	}
+	return hash, true
+}
@@ -0,0 +1,180 @@
+package mod
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/conf"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage"
+)
+
+// newTestStorage sets the default storage of two pebble buckets in the temp dir.
+func newTestStorage(t *testing.T) storagev1.Storage {
+	st, err := storage.New(&conf.Storage{
+		Driver:          "native",
+		DBType:          "pebble",
+		SelectionPolicy: "hashring",
+		EvictionPolicy:  "lru",
+		Buckets: []*conf.Bucket{
+			{Path: t.TempDir(), Type: "normal"},
+			{Path: t.TempDir(), Type: "normal"},
+		},
+	}, log.GetLogger())
+	require.NoError(t, err)
+
+	storage.SetDefault(st)
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func storeObject(t *testing.T, st storagev1.Storage, rawUrl string) *object.Metadata {
+	now := time.Now().Unix()
+	md := &object.Metadata{
+		Flags:       object.FlagCache,
+		ID:          object.NewID(rawUrl),
+		Code:        http.StatusOK,
+		Size:        1,
+		BlockSize:   1024,
+		RespUnix:    now,
+		LastRefUnix: now,
+		Refs:        1,
+		ExpiresAt:   now + 3600,
+		Headers:     http.Header{"Content-Type": {"image/jpeg"}},
+	}
+	require.NoError(t, st.Select(context.Background(), md.ID).Store(context.Background(), md))
+	return md
+}
+
+// getJSON requests the cache api and decodes the json response.
+func getJSON(t *testing.T, rawUrl string, v any) int {
+	mux := http.NewServeMux()
+	HandleCacheAPI(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, rawUrl, nil))
+	if v != nil {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	return rec.Code
+}
+
+func TestCacheObjectsCursor(t *testing.T) {
+	st := newTestStorage(t)
+	for i := 0; i < 25; i++ {
+		storeObject(t, st, fmt.Sprintf("http://www.example.com/path/%02d.jpg", i))
+	}
+	storeObject(t, st, "http://www.example.com/other/1.jpg")
+	storeObject(t, st, "http://img.example.com/path/1.jpg")
+
+	prefix := "http://www.example.com/path/"
+	urls := make([]string, 0, 25)
+	cursor, pages := "", 0
+	for {
+		result := &listResult{}
+		code := getJSON(t, "/cache/objects?limit=10&prefix="+url.QueryEscape(prefix)+"&cursor="+url.QueryEscape(cursor), result)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, len(result.Objects), result.Count)
+
+		for _, obj := range result.Objects {
+			urls = append(urls, obj.URL)
+		}
+		if pages++; result.NextCursor == "" {
+			break
+		}
+		assert.Len(t, result.Objects, 10)
+		cursor = result.NextCursor
+	}
+
+	// the objects of both buckets are merged in order, no duplicate and no gap.
+	assert.Equal(t, 3, pages)
+	require.Len(t, urls, 25)
+	for i, u := range urls {
+		assert.Equal(t, fmt.Sprintf("%s%02d.jpg", prefix, i), u)
+	}
+}
+
+func TestCacheObjectsExactPage(t *testing.T) {
+	st := newTestStorage(t)
+	for i := 0; i < 10; i++ {
+		storeObject(t, st, fmt.Sprintf("http://www.example.com/%d.jpg", i))
+	}
+
+	result := &listResult{}
+	require.Equal(t, http.StatusOK, getJSON(t, "/cache/objects?limit=10&prefix=http://www.example.com/", result))
+	assert.Equal(t, 10, result.Count)
+	assert.Empty(t, result.NextCursor)
+}
+
+func TestCacheLookup(t *testing.T) {
+	st := newTestStorage(t)
+	md := storeObject(t, st, "http://www.example.com/1.jpg")
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		found bool
+	}{
+		{name: "url", query: "url=" + url.QueryEscape(md.ID.Path()), code: http.StatusOK, found: true},
+		{name: "hash", query: "hash=" + md.ID.HashStr(), code: http.StatusOK, found: true},
+		{name: "url not found", query: "url=" + url.QueryEscape("http://www.example.com/2.jpg"), code: http.StatusNotFound},
+		{name: "hash not found", query: "hash=" + object.NewID("http://www.example.com/2.jpg").HashStr(), code: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &lookupResult{}
+			assert.Equal(t, tt.code, getJSON(t, "/cache/lookup?"+tt.query, result))
+			assert.Equal(t, tt.found, result.Found)
+			if tt.found {
+				assert.Equal(t, md.ID.Path(), result.URL)
+				assert.Equal(t, md.ID.HashStr(), result.Hash)
+				assert.Equal(t, "image/jpeg", result.Headers.Get("Content-Type"))
+			}
+		})
+	}
+
+	assert.Equal(t, http.StatusBadRequest, getJSON(t, "/cache/lookup?hash=xyz", nil))
+	assert.Equal(t, http.StatusBadRequest, getJSON(t, "/cache/lookup", nil))
+}
+
+func TestCacheDomains(t *testing.T) {
+	st := newTestStorage(t)
+	for i := 0; i < 3; i++ {
+		storeObject(t, st, fmt.Sprintf("http://www.example.com/%d.jpg", i))
+	}
+	storeObject(t, st, "http://img.example.com/1.jpg")
+
+	result := &domainResult{}
+	require.Equal(t, http.StatusOK, getJSON(t, "/cache/domains", result))
+	assert.Equal(t, int64(4), result.Total)
+	assert.Len(t, result.Domains, 2)
+
+	// the totals are of all the domains.
+	result = &domainResult{}
+	require.Equal(t, http.StatusOK, getJSON(t, "/cache/domains?limit=1", result))
+	assert.Equal(t, int64(4), result.Total)
+	assert.Len(t, result.Domains, 1)
+
+	var usage struct {
+		Domain  string `json:"domain"`
+		Objects int64  `json:"objects"`
+	}
+	require.Equal(t, http.StatusOK, getJSON(t, "/cache/domains/www.example.com", &usage))
+	assert.Equal(t, "www.example.com", usage.Domain)
+	assert.Equal(t, int64(3), usage.Objects)
+
+	assert.Equal(t, http.StatusNotFound, getJSON(t, "/cache/domains/unknown.example.com", nil))
+}
@@ -0,0 +1,403 @@
+package mod
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/omalloc/tavern/conf"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/internal/constants"
+	xhttp "github.com/omalloc/tavern/pkg/x/http"
+)
+
+type PushState string
+
+const (
+	PushPending  PushState = "pending"
+	PushRunning  PushState = "running"
+	PushDone     PushState = "done"
+	PushFailed   PushState = "failed"
+	PushCanceled PushState = "canceled"
+)
+
+// PushItem is one url of the push job.
+type PushItem struct {
+	URL     string            `json:"url"`
+	Range   string            `json:"range,omitempty"`   // e.g. bytes=0-1048575, only warm-up the range
+	Headers map[string]string `json:"headers,omitempty"` // extra request headers, e.g. Accept-Encoding for Vary
+
+	State       PushState `json:"state"`
+	Code        int       `json:"code,omitempty"`
+	CacheStatus string    `json:"cache_status,omitempty"`
+	Bytes       int64     `json:"bytes"`
+	Cost        int64     `json:"cost_ms"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// PushJob is a batch of urls warmed up through the caching middleware.
+type PushJob struct {
+	ID          string      `json:"id"`
+	State       PushState   `json:"state"`
+	Total       int         `json:"total"`
+	Finished    int         `json:"finished"`
+	Failed      int         `json:"failed"`
+	Progress    float64     `json:"progress"`
+	Concurrency int         `json:"concurrency"`
+	CreatedAt   int64       `json:"created_at"`
+	FinishedAt  int64       `json:"finished_at,omitempty"`
+	Items       []*PushItem `json:"items,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+type pushRequest struct {
+	URLs        []string    `json:"urls"`
+	Items       []*PushItem `json:"items"`
+	Concurrency int         `json:"concurrency"`
+}
+
+// Pusher queues push jobs and fetches them through the caching middleware
+// as prefetch requests.
+type Pusher struct {
+	mu      sync.RWMutex
+	log     *log.Helper
+	opt     *conf.ServerPush
+	tripper http.RoundTripper
+	sem     *semaphore.Weighted // global upstream concurrency of all jobs
+	jobs    map[string]*PushJob
+	order   []string // job ids, oldest first
+	ctx     context.Context
+	stop    context.CancelFunc
+}
+
+// NewPusher creates a Pusher, tripper is the caching middleware chain.
+func NewPusher(opt *conf.ServerPush, tripper http.RoundTripper) *Pusher {
+	if opt == nil {
+		opt = &conf.ServerPush{}
+	}
+	if opt.MaxConcurrency <= 0 {
+		opt.MaxConcurrency = 16
+	}
+	if opt.MaxURLs <= 0 {
+		opt.MaxURLs = 10000
+	}
+	if opt.History <= 0 {
+		opt.History = 100
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	return &Pusher{
+		log:     log.NewHelper(log.GetLogger()),
+		opt:     opt,
+		tripper: tripper,
+		sem:     semaphore.NewWeighted(int64(opt.MaxConcurrency)),
+		jobs:    make(map[string]*PushJob),
+		order:   make([]string, 0, opt.History),
+		ctx:     ctx,
+		stop:    stop,
+	}
+}
+
+// HandlePush registers the push handlers to the local api, authorized by the guard.
+//
+// e.g.
+//
+//	curl -X POST http://127.0.0.1:8080/cache/push -d '{"urls":["http://www.example.com/1.apk"],"concurrency":4}'
+//	curl -X POST http://127.0.0.1:8080/cache/push -d '{"items":[{"url":"http://www.example.com/1.mp4","range":"bytes=0-1048575"}]}'
+//	curl http://127.0.0.1:8080/cache/push/<job-id>
+//	curl -X DELETE http://127.0.0.1:8080/cache/push/<job-id>
+func HandlePush(r *http.ServeMux, p *Pusher, guard Guard) {
+	if guard == nil {
+		guard = LoopbackOnly
+	}
+
+	r.Handle("POST /cache/push", guard(http.HandlerFunc(p.handleSubmit)))
+	r.Handle("GET /cache/push", guard(http.HandlerFunc(p.handleList)))
+	r.Handle("GET /cache/push/{id}", guard(http.HandlerFunc(p.handleGet)))
+	r.Handle("DELETE /cache/push/{id}", guard(http.HandlerFunc(p.handleCancel)))
+}
+
+// Submit validates the items and starts a new push job.
+func (p *Pusher) Submit(items []*PushItem, concurrency int) (*PushJob, error) {
+	if len(items) == 0 {
+		return nil, errors.New("empty push urls")
+	}
+	if len(items) > p.opt.MaxURLs {
+		return nil, fmt.Errorf("too many push urls %d, max %d", len(items), p.opt.MaxURLs)
+	}
+
+	for _, item := range items {
+		u, err := url.Parse(item.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid push url %q", item.URL)
+		}
+		if item.Range != "" {
+			if _, err = xhttp.SingleRange(item.Range, 1<<62); err != nil {
+				return nil, fmt.Errorf("invalid push range %q of %s", item.Range, item.URL)
+			}
+		}
+		item.State = PushPending
+	}
+
+	if concurrency <= 0 || concurrency > p.opt.MaxConcurrency {
+		concurrency = p.opt.MaxConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	job := &PushJob{
+		ID:          uuid.NewString(),
+		State:       PushRunning,
+		Total:       len(items),
+		Concurrency: concurrency,
+		CreatedAt:   time.Now().Unix(),
+		Items:       items,
+		cancel:      cancel,
+	}
+
+	p.mu.Lock()
+	p.jobs[job.ID] = job
+	p.order = append(p.order, job.ID)
+	p.gc()
+	p.mu.Unlock()
+
+	p.log.Infof("push job %s submitted, %d urls, concurrency %d", job.ID, job.Total, concurrency)
+
+	go p.run(ctx, job)
+	return job, nil
+}
+
+// Get returns a snapshot of the job.
+func (p *Pusher) Get(id string, withItems bool) (*PushJob, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	job, ok := p.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return job.snapshot(withItems), true
+}
+
+// Cancel cancels the running job, the pending urls are marked canceled.
+func (p *Pusher) Cancel(id string) bool {
+	p.mu.RLock()
+	job, ok := p.jobs[id]
+	p.mu.RUnlock()
+
+	if ok {
+		job.cancel()
+	}
+	return ok
+}
+
+// Close cancels all running jobs.
+func (p *Pusher) Close() {
+	p.stop()
+}
+
+func (p *Pusher) run(ctx context.Context, job *PushJob) {
+	defer job.cancel()
+
+	jobSem := semaphore.NewWeighted(int64(job.Concurrency))
+	wg := sync.WaitGroup{}
+
+	for _, item := range job.Items {
+		if err := jobSem.Acquire(ctx, 1); err != nil {
+			break
+		}
+		if err := p.sem.Acquire(ctx, 1); err != nil {
+			jobSem.Release(1)
+			break
+		}
+
+		p.setItem(job, item, func() { item.State = PushRunning })
+
+		wg.Add(1)
+		go func(item *PushItem) {
+			defer func() {
+				p.sem.Release(1)
+				jobSem.Release(1)
+				wg.Done()
+			}()
+			p.fetch(ctx, job, item)
+		}(item)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	job.State = PushDone
+	if ctx.Err() != nil {
+		job.State = PushCanceled
+		for _, item := range job.Items {
+			if item.State == PushPending {
+				item.State = PushCanceled
+			}
+		}
+	}
+	job.FinishedAt = time.Now().Unix()
+
+	p.log.Infof("push job %s %s, %d/%d urls finished, %d failed", job.ID, job.State, job.Finished, job.Total, job.Failed)
+}
+
+// fetch sends the prefetch request to the caching middleware and drains the body.
+func (p *Pusher) fetch(ctx context.Context, job *PushJob, item *PushItem) {
+	now := time.Now()
+
+	code, cacheStatus, n, err := p.roundTrip(ctx, item)
+
+	p.setItem(job, item, func() {
+		item.Code = code
+		item.CacheStatus = cacheStatus
+		item.Bytes = n
+		item.Cost = time.Since(now).Milliseconds()
+		item.State = PushDone
+		if err == nil && code >= http.StatusBadRequest {
+			err = fmt.Errorf("upstream returns error status: %d", code)
+		}
+		if err != nil {
+			item.State = PushFailed
+			item.Error = err.Error()
+			if ctx.Err() != nil {
+				item.State = PushCanceled
+			} else {
+				job.Failed++
+			}
+		}
+		job.Finished++
+	})
+}
+
+func (p *Pusher) roundTrip(ctx context.Context, item *PushItem) (int, string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, item.URL, nil)
+	if err != nil {
+		return 0, "", 0, err
+	}
+
+	for k, v := range item.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", "tavern-pusher/1.0")
+
+	// the whole object is prefetched, a range only warms up its chunks.
+	if item.Range != "" {
+		req.Header.Set("Range", item.Range)
+	} else {
+		req.Header.Set(constants.PrefetchCacheKey, "1")
+	}
+
+	resp, err := p.tripper.RoundTrip(req)
+	if err != nil {
+		return 0, "", 0, err
+	}
+
+	var n int64
+	if resp.Body != nil {
+		n, err = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	return resp.StatusCode, resp.Header.Get(constants.ProtocolCacheStatusKey), n, err
+}
+
+func (p *Pusher) setItem(job *PushJob, item *PushItem, fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fn()
+	if job.Total > 0 {
+		job.Progress = float64(job.Finished) * 100 / float64(job.Total)
+	}
+}
+
+// gc drops the oldest finished jobs over the history limit.
+func (p *Pusher) gc() {
+	for len(p.order) > p.opt.History {
+		idx := slices.IndexFunc(p.order, func(id string) bool {
+			return p.jobs[id].State != PushRunning
+		})
+		if idx < 0 {
+			return
+		}
+		delete(p.jobs, p.order[idx])
+		p.order = slices.Delete(p.order, idx, idx+1)
+	}
+}
+
+func (j *PushJob) snapshot(withItems bool) *PushJob {
+	copied := *j
+	copied.cancel = nil
+	copied.Items = nil
+	if withItems {
+		copied.Items = make([]*PushItem, 0, len(j.Items))
+		for _, item := range j.Items {
+			it := *item
+			copied.Items = append(copied.Items, &it)
+		}
+	}
+	return &copied
+}
+
+func (p *Pusher) handleSubmit(w http.ResponseWriter, req *http.Request) {
+	body := &pushRequest{}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 32<<20)).Decode(body); err != nil {
+		xhttp.WriteJSONError(w, http.StatusBadRequest, "invalid push body: "+err.Error())
+		return
+	}
+
+	items := body.Items
+	for _, u := range body.URLs {
+		items = append(items, &PushItem{URL: u})
+	}
+
+	job, err := p.Submit(items, body.Concurrency)
+	if err != nil {
+		xhttp.WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	snapshot, _ := p.Get(job.ID, false)
+	xhttp.WriteJSON(w, http.StatusAccepted, snapshot)
+}
+
+func (p *Pusher) handleList(w http.ResponseWriter, _ *http.Request) {
+	p.mu.RLock()
+	jobs := make([]*PushJob, 0, len(p.order))
+	for i := len(p.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, p.jobs[p.order[i]].snapshot(false))
+	}
+	p.mu.RUnlock()
+
+	xhttp.WriteJSON(w, http.StatusOK, jobs)
+}
+
+func (p *Pusher) handleGet(w http.ResponseWriter, req *http.Request) {
+	job, ok := p.Get(req.PathValue("id"), true)
+	if !ok {
+		xhttp.WriteJSONError(w, http.StatusNotFound, "push job not found")
+		return
+	}
+	xhttp.WriteJSON(w, http.StatusOK, job)
+}
+
+func (p *Pusher) handleCancel(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	if !p.Cancel(id) {
+		xhttp.WriteJSONError(w, http.StatusNotFound, "push job not found")
+		return
+	}
+
+	job, _ := p.Get(id, false)
+	xhttp.WriteJSON(w, http.StatusOK, job)
+}
@@ -0,0 +1,285 @@
+package mod
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/omalloc/tavern/conf"
+	"github.com/omalloc/tavern/internal/constants"
+)
+
+// blockingTripper holds the requests until released, and records the max concurrent requests per host.
+type blockingTripper struct {
+	mu       sync.Mutex
+	inflight map[string]int
+	peak     map[string]int
+	total    int
+	peakAll  int
+	requests []*http.Request
+	release  chan struct{}
+}
+
+func newBlockingTripper() *blockingTripper {
+	return &blockingTripper{
+		inflight: make(map[string]int),
+		peak:     make(map[string]int),
+		release:  make(chan struct{}),
+	}
+}
+
+func (b *blockingTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.mu.Lock()
+	b.requests = append(b.requests, req)
+	b.inflight[req.Host]++
+	b.peak[req.Host] = max(b.peak[req.Host], b.inflight[req.Host])
+	b.total++
+	b.peakAll = max(b.peakAll, b.total)
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.inflight[req.Host]--
+		b.total--
+		b.mu.Unlock()
+	}()
+
+	select {
+	case <-b.release:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	code := http.StatusOK
+	if strings.HasSuffix(req.URL.Path, ".404") {
+		code = http.StatusNotFound
+	}
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{constants.ProtocolCacheStatusKey: {"MISS"}},
+		Body:       io.NopCloser(strings.NewReader("hello")),
+	}, nil
+}
+
+func (b *blockingTripper) running() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
+
+func pushItems(format string, n int) []*PushItem {
+	items := make([]*PushItem, 0, n)
+	for i := 0; i < n; i++ {
+		items = append(items, &PushItem{URL: fmt.Sprintf(format, i)})
+	}
+	return items
+}
+
+// waitJob waits for the job finished.
+func waitJob(t *testing.T, p *Pusher, id string) *PushJob {
+	var job *PushJob
+	require.Eventually(t, func() bool {
+		job, _ = p.Get(id, true)
+		return job != nil && job.State != PushRunning
+	}, 5*time.Second, 10*time.Millisecond)
+	return job
+}
+
+func TestPusherConcurrency(t *testing.T) {
+	tripper := newBlockingTripper()
+	p := NewPusher(&conf.ServerPush{MaxConcurrency: 3}, tripper)
+	t.Cleanup(p.Close)
+
+	a, err := p.Submit(pushItems("http://a.example.com/%d.jpg", 5), 2)
+	require.NoError(t, err)
+	b, err := p.Submit(pushItems("http://b.example.com/%d.jpg", 5), 2)
+	require.NoError(t, err)
+
+	// the global semaphore is full, the jobs wait for each other.
+	require.Eventually(t, func() bool { return tripper.running() == 3 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 3, tripper.running())
+
+	close(tripper.release)
+	waitJob(t, p, a.ID)
+	waitJob(t, p, b.ID)
+
+	tripper.mu.Lock()
+	defer tripper.mu.Unlock()
+	assert.Equal(t, 3, tripper.peakAll)
+	assert.LessOrEqual(t, tripper.peak["a.example.com"], 2)
+	assert.LessOrEqual(t, tripper.peak["b.example.com"], 2)
+	assert.Len(t, tripper.requests, 10)
+}
+
+func TestPusherSubmit(t *testing.T) {
+	tripper := newBlockingTripper()
+	close(tripper.release)
+	p := NewPusher(&conf.ServerPush{MaxConcurrency: 4, MaxURLs: 3}, tripper)
+	t.Cleanup(p.Close)
+
+	for _, items := range [][]*PushItem{
+		nil,
+		pushItems("http://www.example.com/%d.jpg", 4),
+		{{URL: "/1.jpg"}},
+		{{URL: "ftp://www.example.com/1.jpg"}},
+		{{URL: "http://www.example.com/1.mp4", Range: "bytes=a-b"}},
+	} {
+		_, err := p.Submit(items, 0)
+		assert.Error(t, err)
+	}
+
+	job, err := p.Submit([]*PushItem{
+		{URL: "http://www.example.com/1.apk", Headers: map[string]string{"Accept-Encoding": "gzip"}},
+		{URL: "http://www.example.com/1.mp4", Range: "bytes=0-1023"},
+		{URL: "http://www.example.com/1.404"},
+	}, 100)
+	require.NoError(t, err)
+	assert.Equal(t, 4, job.Concurrency)
+
+	job = waitJob(t, p, job.ID)
+	assert.Equal(t, PushDone, job.State)
+	assert.Equal(t, 3, job.Finished)
+	assert.Equal(t, 1, job.Failed)
+	assert.Equal(t, float64(100), job.Progress)
+	require.Len(t, job.Items, 3)
+	assert.Equal(t, PushDone, job.Items[0].State)
+	assert.Equal(t, "MISS", job.Items[0].CacheStatus)
+	assert.Equal(t, int64(5), job.Items[0].Bytes)
+	assert.Equal(t, PushFailed, job.Items[2].State)
+	assert.Equal(t, http.StatusNotFound, job.Items[2].Code)
+
+	// the whole object is prefetched, the range is fetched as is.
+	requests := make(map[string]*http.Request)
+	for _, req := range tripper.requests {
+		requests[req.URL.String()] = req
+	}
+	apk := requests["http://www.example.com/1.apk"]
+	assert.Equal(t, "1", apk.Header.Get(constants.PrefetchCacheKey))
+	assert.Equal(t, "gzip", apk.Header.Get("Accept-Encoding"))
+	mp4 := requests["http://www.example.com/1.mp4"]
+	assert.Empty(t, mp4.Header.Get(constants.PrefetchCacheKey))
+	assert.Equal(t, "bytes=0-1023", mp4.Header.Get("Range"))
+}
+
+func TestPusherCancel(t *testing.T) {
+	tripper := newBlockingTripper()
+	p := NewPusher(&conf.ServerPush{MaxConcurrency: 2}, tripper)
+	t.Cleanup(p.Close)
+
+	job, err := p.Submit(pushItems("http://www.example.com/%d.jpg", 5), 0)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return tripper.running() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	assert.True(t, p.Cancel(job.ID))
+	assert.False(t, p.Cancel("unknown"))
+
+	job = waitJob(t, p, job.ID)
+	assert.Equal(t, PushCanceled, job.State)
+	assert.Zero(t, job.Failed)
+	for _, item := range job.Items {
+		assert.Equal(t, PushCanceled, item.State)
+	}
+}
+
+func TestPusherHistory(t *testing.T) {
+	tripper := newBlockingTripper()
+	p := NewPusher(&conf.ServerPush{MaxConcurrency: 1, History: 2}, tripper)
+	t.Cleanup(p.Close)
+
+	// the running job is kept over the history limit.
+	running, err := p.Submit(pushItems("http://www.example.com/running/%d.jpg", 1), 0)
+	require.NoError(t, err)
+
+	ids := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		job, err1 := p.Submit(pushItems(fmt.Sprintf("http://www.example.com/%d/%%d.jpg", i), 1), 0)
+		require.NoError(t, err1)
+		ids = append(ids, job.ID)
+
+		p.Cancel(job.ID)
+		waitJob(t, p, job.ID)
+	}
+
+	_, ok := p.Get(running.ID, false)
+	assert.True(t, ok)
+	_, ok = p.Get(ids[1], false)
+	assert.False(t, ok)
+
+	p.mu.RLock()
+	assert.Equal(t, []string{running.ID, ids[2]}, p.order)
+	assert.Len(t, p.jobs, 2)
+	p.mu.RUnlock()
+
+	// the finished running job is dropped by the next submit.
+	close(tripper.release)
+	waitJob(t, p, running.ID)
+	last, err := p.Submit(pushItems("http://www.example.com/last/%d.jpg", 1), 0)
+	require.NoError(t, err)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	assert.Equal(t, []string{ids[2], last.ID}, p.order)
+	assert.Len(t, p.jobs, 2)
+}
+
+func TestHandlePush(t *testing.T) {
+	tripper := newBlockingTripper()
+	close(tripper.release)
+	p := NewPusher(nil, tripper)
+	t.Cleanup(p.Close)
+
+	serve := func(mux *http.ServeMux, method, target, remote string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// loopback only without the guard.
+	mux := http.NewServeMux()
+	HandlePush(mux, p, nil)
+
+	body := []byte(`{"urls":["http://www.example.com/1.jpg"],"items":[{"url":"http://www.example.com/2.jpg"}]}`)
+	assert.Equal(t, http.StatusForbidden, serve(mux, http.MethodPost, "/cache/push", "10.0.0.1:1234", body).Code)
+	assert.Equal(t, http.StatusForbidden, serve(mux, http.MethodGet, "/cache/push", "10.0.0.1:1234", nil).Code)
+
+	rec := serve(mux, http.MethodPost, "/cache/push", "127.0.0.1:1234", body)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	job := &PushJob{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), job))
+	assert.Equal(t, 2, job.Total)
+	waitJob(t, p, job.ID)
+
+	rec = serve(mux, http.MethodGet, "/cache/push/"+job.ID, "[::1]:1234", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), job))
+	assert.Len(t, job.Items, 2)
+
+	assert.Equal(t, http.StatusNotFound, serve(mux, http.MethodDelete, "/cache/push/unknown", "127.0.0.1:1234", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(mux, http.MethodPost, "/cache/push", "127.0.0.1:1234", []byte(`{`)).Code)
+
+	// the guard of the purge plugin.
+	mux = http.NewServeMux()
+	HandlePush(mux, p, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	})
+	assert.Equal(t, http.StatusUnauthorized, serve(mux, http.MethodGet, "/cache/push", "127.0.0.1:1234", nil).Code)
+}
@@ -53,6 +53,7 @@ type HTTPServer struct {
 	config       *conf.Bootstrap
 	serverConfig *conf.Server
 	listener     net.Listener
+	pusher       *mod.Pusher
 	cleanups     []func()
 }
 
@@ -81,19 +82,20 @@ func NewServer(flip *tableflip.Upgrader, config *conf.Bootstrap, plugins []plugi
 		}
 	}
 
+	// 初始化业务服务的路由监听
+	next, err := s.buildEndpoint()
+	if err != nil {
+		panic(err)
+	}
+
 	// 初始化内部路由
 	// - 探测接口
 	// - 监控接口
 	// - 查询接口
+	// - 推送接口
 	// - 用于注册插件的路由
 	mux := s.newServeMux()
 
-	// 初始化业务服务的路由监听
-	next, err := s.buildEndpoint()
-	if err != nil {
-		panic(err)
-	}
-
 	fmtAddr := func(addr string) string {
 		if i := strings.IndexByte(addr, ':'); i >= 0 {
 			return addr[:i]
@@ -142,6 +144,11 @@ func (s *HTTPServer) Stop(ctx context.Context) error {
 	if err := s.Shutdown(ctx); err != nil {
 		errs = append(errs, err)
 	}
+	// Cancel all running push jobs.
+	if s.pusher != nil {
+		s.pusher.Close()
+	}
+
 	// Call all middleware cleanup.
 	for _, cleanup := range s.cleanups {
 		cleanup()
@@ -190,6 +197,21 @@ func (s *HTTPServer) newServeMux() *http.ServeMux {
 		w.WriteHeader(http.StatusOK)
 	}))
 
+	// 缓存查询接口
+	mod.HandleCacheAPI(mux)
+	// ban 列表与推送接口, 与 purge 使用相同的鉴权
+	var guard mod.Guard
+	for _, plug := range s.plugins {
+		if g, ok := plug.(guarder); ok {
+			guard = g.Guard
+		}
+	}
+	mod.HandleBan(mux, guard)
+	// 缓存推送(预热)接口
+	if s.pusher != nil {
+		mod.HandlePush(mux, s.pusher, guard)
+	}
+
 	// 初始化插件的路由监听(如果插件需要)
 	for _, plug := range s.plugins {
 		plug.AddRouter(mux)
@@ -200,6 +222,11 @@ func (s *HTTPServer) newServeMux() *http.ServeMux {
 	return mux
 }
 
+// guarder 为内部接口提供鉴权的插件, e.g. purge
+type guarder interface {
+	Guard(next http.Handler) http.Handler
+}
+
 // buildHandler ... Cache 主流程入口
 func (s *HTTPServer) buildHandler(tripper http.RoundTripper) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
@@ -290,6 +317,9 @@ func (s *HTTPServer) buildEndpoint() (http.HandlerFunc, error) {
 		return nil, err
 	}
 
+	// push jobs are fetched through the middleware chain
+	s.pusher = mod.NewPusher(s.serverConfig.Push, tripper)
+
 	// build the final handler
 	next := s.buildHandler(tripper)
 
@@ -0,0 +1,146 @@
+package accounting
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OtherDomain is the label of the domains out of the metrics limit.
+const OtherDomain = "_other"
+
+var defaultTracker = New()
+
+// Default returns the tracker shared by all the buckets.
+func Default() *Tracker {
+	return defaultTracker
+}
+
+// Usage is the cached objects and the stored bytes of a domain.
+type Usage struct {
+	Domain  string `json:"domain"`
+	Objects int64  `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// Tracker keeps the per-domain usage in memory, the buckets add the deltas on
+// store, discard and evict, and rebuild it on loading.
+type Tracker struct {
+	mu      sync.RWMutex
+	domains map[string]*Usage
+}
+
+func New() *Tracker {
+	return &Tracker{
+		domains: make(map[string]*Usage),
+	}
+}
+
+// Add adds the deltas of the domain, the domain without objects is dropped.
+func (t *Tracker) Add(domain string, objects, bytes int64) {
+	if domain == "" || (objects == 0 && bytes == 0) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.domains[domain]
+	if !ok {
+		u = &Usage{Domain: domain}
+		t.domains[domain] = u
+	}
+	u.Objects += objects
+	u.Bytes += bytes
+
+	if u.Objects <= 0 {
+		delete(t.domains, domain)
+	}
+}
+
+// Get returns the usage of the domain.
+func (t *Tracker) Get(domain string) (Usage, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if u, ok := t.domains[domain]; ok {
+		return *u, true
+	}
+	return Usage{Domain: domain}, false
+}
+
+// List returns the usage of all the domains, sorted by bytes desc.
+func (t *Tracker) List() []Usage {
+	t.mu.RLock()
+	list := make([]Usage, 0, len(t.domains))
+	for _, u := range t.domains {
+		list = append(list, *u)
+	}
+	t.mu.RUnlock()
+
+	slices.SortFunc(list, func(a, b Usage) int {
+		if c := cmp.Compare(b.Bytes, a.Bytes); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Domain, b.Domain)
+	})
+	return list
+}
+
+// Reset drops all the usage, e.g. before the buckets reloading.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.domains = make(map[string]*Usage)
+}
+
+// Collector exports the usage of the top `limit` domains by bytes,
+// the rest are summed up as the `_other` domain to bound the label cardinality.
+type Collector struct {
+	tracker *Tracker
+	limit   int
+	objects *prometheus.Desc
+	bytes   *prometheus.Desc
+}
+
+func NewCollector(t *Tracker, limit int) *Collector {
+	if limit <= 0 {
+		limit = 100
+	}
+	return &Collector{
+		tracker: t,
+		limit:   limit,
+		objects: prometheus.NewDesc("tr_tavern_domain_objects", "The cached objects of the domain", []string{"domain"}, nil),
+		bytes:   prometheus.NewDesc("tr_tavern_domain_bytes", "The stored bytes of the domain", []string{"domain"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.objects
+	ch <- c.bytes
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	list := c.tracker.List()
+
+	other := Usage{Domain: OtherDomain}
+	for i, u := range list {
+		if i >= c.limit {
+			other.Objects += u.Objects
+			other.Bytes += u.Bytes
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.objects, prometheus.GaugeValue, float64(u.Objects), u.Domain)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(u.Bytes), u.Domain)
+	}
+
+	if len(list) > c.limit {
+		ch <- prometheus.MustNewConstMetric(c.objects, prometheus.GaugeValue, float64(other.Objects), other.Domain)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(other.Bytes), other.Domain)
+	}
+}
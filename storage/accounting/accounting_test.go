@@ -0,0 +1,158 @@
+package accounting_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/conf"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage"
+	"github.com/omalloc/tavern/storage/accounting"
+)
+
+func TestTrackerAdd(t *testing.T) {
+	tr := accounting.New()
+
+	// the empty domain and the zero deltas are ignored.
+	tr.Add("", 1, 100)
+	tr.Add("www.example.com", 0, 0)
+	assert.Empty(t, tr.List())
+
+	tr.Add("www.example.com", 1, 100)
+	tr.Add("www.example.com", 1, 300)
+	tr.Add("img.example.com", 1, 1000)
+	tr.Add("www.example.com", 0, 50) // the object stored more chunks
+
+	u, ok := tr.Get("www.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, accounting.Usage{Domain: "www.example.com", Objects: 2, Bytes: 450}, u)
+	assert.Equal(t, []accounting.Usage{
+		{Domain: "img.example.com", Objects: 1, Bytes: 1000},
+		{Domain: "www.example.com", Objects: 2, Bytes: 450},
+	}, tr.List())
+
+	// the removes are symmetric to the stores, the domain without objects is dropped.
+	tr.Add("www.example.com", -1, -150)
+	u, _ = tr.Get("www.example.com")
+	assert.Equal(t, accounting.Usage{Domain: "www.example.com", Objects: 1, Bytes: 300}, u)
+
+	tr.Add("www.example.com", -1, -300)
+	u, ok = tr.Get("www.example.com")
+	assert.False(t, ok)
+	assert.Equal(t, accounting.Usage{Domain: "www.example.com"}, u)
+	assert.Len(t, tr.List(), 1)
+
+	tr.Reset()
+	assert.Empty(t, tr.List())
+}
+
+func TestTrackerListOrder(t *testing.T) {
+	tr := accounting.New()
+	tr.Add("b.example.com", 1, 100)
+	tr.Add("a.example.com", 1, 100)
+	tr.Add("c.example.com", 1, 200)
+
+	domains := make([]string, 0, 3)
+	for _, u := range tr.List() {
+		domains = append(domains, u.Domain)
+	}
+	// bytes desc, then the domain.
+	assert.Equal(t, []string{"c.example.com", "a.example.com", "b.example.com"}, domains)
+}
+
+func TestCollectorOther(t *testing.T) {
+	tr := accounting.New()
+	for i := 1; i <= 5; i++ {
+		tr.Add(fmt.Sprintf("%d.example.com", i), int64(i), int64(i*100))
+	}
+
+	// the top 2 domains by bytes, the rest are summed up.
+	c := accounting.NewCollector(tr, 2)
+	assert.Equal(t, 6, testutil.CollectAndCount(c))
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP tr_tavern_domain_bytes The stored bytes of the domain
+# TYPE tr_tavern_domain_bytes gauge
+tr_tavern_domain_bytes{domain="5.example.com"} 500
+tr_tavern_domain_bytes{domain="4.example.com"} 400
+tr_tavern_domain_bytes{domain="_other"} 600
+# HELP tr_tavern_domain_objects The cached objects of the domain
+# TYPE tr_tavern_domain_objects gauge
+tr_tavern_domain_objects{domain="5.example.com"} 5
+tr_tavern_domain_objects{domain="4.example.com"} 4
+tr_tavern_domain_objects{domain="_other"} 6
+`)))
+
+	// no `_other` within the limit.
+	c = accounting.NewCollector(tr, 5)
+	assert.Equal(t, 10, testutil.CollectAndCount(c))
+	assert.Equal(t, 10, testutil.CollectAndCount(accounting.NewCollector(tr, 0)))
+}
+
+// newTestStorage sets the default storage of the bucket, closed by the caller.
+func newTestStorage(t *testing.T, bucketPath string) storagev1.Storage {
+	st, err := storage.New(&conf.Storage{
+		Driver:          "native",
+		DBType:          "pebble",
+		SelectionPolicy: "hashring",
+		EvictionPolicy:  "lru",
+		Buckets: []*conf.Bucket{
+			{Path: bucketPath, Type: "normal"},
+		},
+	}, log.GetLogger())
+	require.NoError(t, err)
+
+	storage.SetDefault(st)
+	return st
+}
+
+func TestStorageReinit(t *testing.T) {
+	bucketPath := t.TempDir()
+	accounting.Default().Add("stale.example.com", 1, 100)
+
+	// the usage of the previous storage is dropped.
+	st := newTestStorage(t, bucketPath)
+	_, ok := accounting.Default().Get("stale.example.com")
+	assert.False(t, ok)
+
+	var bytes int64
+	now := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		md := &object.Metadata{
+			Flags:       object.FlagCache,
+			ID:          object.NewID(fmt.Sprintf("http://www.example.com/%d.jpg", i)),
+			Code:        http.StatusOK,
+			Size:        1,
+			BlockSize:   1024,
+			RespUnix:    now,
+			LastRefUnix: now,
+			Refs:        1,
+			ExpiresAt:   now + 3600,
+			Headers:     make(http.Header),
+		}
+		md.Chunks.Set(0)
+		bytes += int64(md.StoredBytes())
+		require.NoError(t, st.Select(context.Background(), md.ID).Store(context.Background(), md))
+	}
+
+	want := accounting.Usage{Domain: "www.example.com", Objects: 3, Bytes: bytes}
+	u, _ := accounting.Default().Get("www.example.com")
+	assert.Equal(t, want, u)
+	require.NoError(t, st.Close())
+
+	// the reloaded buckets rebuild the usage from the index, not added twice.
+	st = newTestStorage(t, bucketPath)
+	t.Cleanup(func() { _ = st.Close() })
+	u, _ = accounting.Default().Get("www.example.com")
+	assert.Equal(t, want, u)
+	assert.Len(t, accounting.Default().List(), 1)
+}
@@ -0,0 +1,455 @@
+package ban
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage"
+)
+
+// key schema: ban/<uuid-v7>, value: json Ban
+const keyPrefix = "ban/"
+
+const (
+	maxActiveBans  = 1000
+	maxHistoryBans = 100
+	scanBatch      = 1000                  // objects scanned per batch of the lurker
+	scanPause      = 10 * time.Millisecond // pause between two batches
+)
+
+var ErrTooManyBans = errors.New("too many active bans")
+
+// errLurkStopped stops the lurker scan when the list is stopped.
+var errLurkStopped = errors.New("lurk stopped")
+
+var defaultList atomic.Pointer[List]
+
+func SetDefault(l *List) {
+	defaultList.Store(l)
+}
+
+// Current returns the default ban list, nil if not set.
+func Current() *List {
+	return defaultList.Load()
+}
+
+// Ban is a Varnish-style ban expression, all the non-empty conditions must match.
+//
+// the ban only applies to the objects stored at or before `Before`, the objects fetched
+// after the ban are never banned, so the ban can be retired once the lurker has scanned
+// all the objects.
+type Ban struct {
+	ID          string `json:"id"`
+	Host        string `json:"host,omitempty"`         // exact host, e.g. www.example.com
+	URL         string `json:"url,omitempty"`          // RE2 pattern of the object url
+	HeaderName  string `json:"header_name,omitempty"`  // stored response header, e.g. Content-Type
+	HeaderValue string `json:"header_value,omitempty"` // RE2 pattern of the header value
+	Before      int64  `json:"before"`                 // stored-before unix time, default the created time
+	CreatedAt   int64  `json:"created_at"`
+	Completed   bool   `json:"completed"`
+	CompletedAt int64  `json:"completed_at,omitempty"`
+	Removed     int64  `json:"removed"` // banned objects removed by lookup and lurker
+
+	removed  atomic.Int64
+	urlRe    *regexp.Regexp
+	headerRe *regexp.Regexp
+}
+
+func (b *Ban) compile() error {
+	if b.Host == "" && b.URL == "" && b.HeaderName == "" {
+		return errors.New("empty ban expression")
+	}
+
+	var err error
+	if b.URL != "" {
+		if b.urlRe, err = regexp.Compile(b.URL); err != nil {
+			return fmt.Errorf("invalid ban url %q: %w", b.URL, err)
+		}
+	}
+	if b.HeaderName != "" {
+		if b.headerRe, err = regexp.Compile(b.HeaderValue); err != nil {
+			return fmt.Errorf("invalid ban header value %q: %w", b.HeaderValue, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the object is banned.
+func (b *Ban) Match(md *object.Metadata) bool {
+	// the refreshes update RespUnix, the stored time is the creation of the object.
+	stored := md.CreatedUnix
+	if stored == 0 {
+		stored = md.RespUnix
+	}
+	if stored > b.Before {
+		return false
+	}
+
+	rawUrl := md.ID.Path()
+	if b.Host != "" && hostOf(rawUrl) != b.Host {
+		return false
+	}
+	if b.urlRe != nil && !b.urlRe.MatchString(rawUrl) {
+		return false
+	}
+	if b.headerRe != nil {
+		values := md.Headers.Values(b.HeaderName)
+		if !slices.ContainsFunc(values, b.headerRe.MatchString) {
+			return false
+		}
+	}
+	return true
+}
+
+// Discarded counts the banned object removed by the caller.
+func (b *Ban) Discarded() {
+	b.removed.Add(1)
+}
+
+func (b *Ban) snapshot() *Ban {
+	return &Ban{
+		ID:          b.ID,
+		Host:        b.Host,
+		URL:         b.URL,
+		HeaderName:  b.HeaderName,
+		HeaderValue: b.HeaderValue,
+		Before:      b.Before,
+		CreatedAt:   b.CreatedAt,
+		Completed:   b.Completed,
+		CompletedAt: b.CompletedAt,
+		Removed:     b.Removed + b.removed.Load(),
+	}
+}
+
+// List is the ban list in SharedKV, the active bans are cached in memory
+// and checked on every cache lookup.
+type List struct {
+	mu  sync.Mutex
+	log *log.Helper
+	kv  storagev1.SharedKV
+
+	interval time.Duration
+	active   atomic.Pointer[[]*Ban]
+	history  []*Ban // completed bans, oldest first
+
+	started atomic.Bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type Option func(l *List)
+
+// WithLurkInterval sets the interval of the background lurker.
+func WithLurkInterval(d time.Duration) Option {
+	return func(l *List) {
+		if d > 0 {
+			l.interval = d
+		}
+	}
+}
+
+func New(kv storagev1.SharedKV, logger log.Logger, opts ...Option) *List {
+	l := &List{
+		log:      log.NewHelper(logger),
+		kv:       kv,
+		interval: time.Minute,
+		history:  make([]*Ban, 0, maxHistoryBans),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	l.active.Store(&[]*Ban{})
+
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Load restores the bans from SharedKV.
+func (l *List) Load(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	active := make([]*Ban, 0)
+	err := l.kv.IteratePrefix(ctx, []byte(keyPrefix), func(key, val []byte) error {
+		b := &Ban{}
+		if err := json.Unmarshal(val, b); err != nil {
+			l.log.Warnf("drop invalid ban %s: %s", key, err)
+			_ = l.kv.Delete(ctx, key)
+			return nil
+		}
+
+		if b.Completed {
+			l.history = append(l.history, b)
+			return nil
+		}
+		if err := b.compile(); err != nil {
+			l.log.Warnf("drop invalid ban %s: %s", key, err)
+			_ = l.kv.Delete(ctx, key)
+			return nil
+		}
+		active = append(active, b)
+		return nil
+	})
+
+	l.active.Store(&active)
+	return err
+}
+
+// Add validates and adds the ban, it takes effect immediately.
+func (l *List) Add(ctx context.Context, b *Ban) (*Ban, error) {
+	if err := b.compile(); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	active := *l.active.Load()
+	if len(active) >= maxActiveBans {
+		return nil, ErrTooManyBans
+	}
+
+	now := time.Now().Unix()
+	b.ID = uuid.Must(uuid.NewV7()).String()
+	b.CreatedAt = now
+	if b.Before <= 0 || b.Before > now {
+		b.Before = now
+	}
+	if err := l.save(ctx, b); err != nil {
+		return nil, err
+	}
+
+	next := append(slices.Clone(active), b)
+	l.active.Store(&next)
+
+	l.log.Infof("ban %s added: host=%q url=%q header=%q~%q before=%d", b.ID, b.Host, b.URL, b.HeaderName, b.HeaderValue, b.Before)
+	return b.snapshot(), nil
+}
+
+// Remove deletes the ban, the objects not yet removed are no longer banned.
+func (l *List) Remove(ctx context.Context, id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	active := *l.active.Load()
+	idx := slices.IndexFunc(active, func(b *Ban) bool { return b.ID == id })
+	if idx >= 0 {
+		next := slices.Delete(slices.Clone(active), idx, idx+1)
+		l.active.Store(&next)
+	}
+
+	hidx := slices.IndexFunc(l.history, func(b *Ban) bool { return b.ID == id })
+	if hidx >= 0 {
+		l.history = slices.Delete(l.history, hidx, hidx+1)
+	}
+
+	if idx < 0 && hidx < 0 {
+		return false
+	}
+	_ = l.kv.Delete(ctx, []byte(keyPrefix+id))
+	return true
+}
+
+// List returns the active and completed bans.
+func (l *List) List() []*Ban {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bans := make([]*Ban, 0, len(l.history))
+	for _, b := range l.history {
+		bans = append(bans, b.snapshot())
+	}
+	for _, b := range *l.active.Load() {
+		bans = append(bans, b.snapshot())
+	}
+	return bans
+}
+
+// Banned returns the first active ban matched the object, nil if not banned.
+func (l *List) Banned(md *object.Metadata) *Ban {
+	if l == nil || md == nil {
+		return nil
+	}
+
+	for _, b := range *l.active.Load() {
+		if b.Match(md) {
+			return b
+		}
+	}
+	return nil
+}
+
+// Start implements transport.Server, runs the background lurker.
+func (l *List) Start(ctx context.Context) error {
+	l.started.Store(true)
+	go l.run()
+	return nil
+}
+
+// Stop implements transport.Server.
+func (l *List) Stop(ctx context.Context) error {
+	close(l.stop)
+	if l.started.Load() {
+		<-l.done
+	}
+	return nil
+}
+
+func (l *List) run() {
+	defer close(l.done)
+
+	tick := time.NewTicker(l.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-tick.C:
+			for _, b := range *l.active.Load() {
+				if !l.lurk(b) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// lurk removes the objects matched by the ban and retires it, returns false if stopped.
+//
+// the matched objects are discarded in batches while scanning, at most `scanBatch` are held in memory.
+func (l *List) lurk(b *Ban) bool {
+	ctx := context.Background()
+	current := storage.Current()
+
+	scanned, stopped := 0, false
+	for _, bucket := range current.Buckets() {
+		matched := make([]*object.Metadata, 0, scanBatch)
+		discard := func() {
+			for _, md := range matched {
+				if err := bucket.DiscardWithMetadata(ctx, md); err == nil {
+					b.Discarded()
+				}
+			}
+			matched = matched[:0]
+		}
+
+		// check returns errLurkStopped to stop the iteration.
+		check := func(md *object.Metadata) error {
+			if md != nil && b.Match(md) {
+				if matched = append(matched, md); len(matched) >= scanBatch {
+					discard()
+				}
+			}
+			if scanned++; scanned%scanBatch == 0 && !l.pause() {
+				stopped = true
+				return errLurkStopped
+			}
+			return nil
+		}
+
+		if b.Host != "" {
+			// only the host objects with the `ix/` index.
+			for _, scheme := range []string{"http", "https"} {
+				prefix := fmt.Sprintf("ix/%s/%s://%s/", bucket.ID(), scheme, b.Host)
+				_ = current.SharedKV().IteratePrefix(ctx, []byte(prefix), func(key, val []byte) error {
+					// the rest of the index is not looked up once stopped.
+					if stopped {
+						return errLurkStopped
+					}
+					if len(val) < object.IdHashSize {
+						return nil
+					}
+					var h object.IDHash
+					copy(h[:], val[:object.IdHashSize])
+					md, _ := bucket.LookupWithHash(ctx, h)
+					return check(md)
+				})
+				if stopped {
+					break
+				}
+			}
+		} else {
+			_ = bucket.Iterate(ctx, check)
+		}
+
+		discard()
+		if stopped {
+			return false
+		}
+	}
+
+	l.retire(ctx, b)
+	l.log.Infof("ban %s completed, scanned %d objects, removed %d", b.ID, scanned, b.Removed)
+	return true
+}
+
+// retire moves the ban from the active list to the history.
+func (l *List) retire(ctx context.Context, b *Ban) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	active := *l.active.Load()
+	idx := slices.Index(active, b)
+	if idx < 0 {
+		// removed while lurking
+		return
+	}
+	next := slices.Delete(slices.Clone(active), idx, idx+1)
+	l.active.Store(&next)
+
+	b.Completed = true
+	b.CompletedAt = time.Now().Unix()
+	b.Removed += b.removed.Swap(0)
+	_ = l.save(ctx, b)
+
+	l.history = append(l.history, b)
+	if n := len(l.history) - maxHistoryBans; n > 0 {
+		for _, old := range l.history[:n] {
+			_ = l.kv.Delete(ctx, []byte(keyPrefix+old.ID))
+		}
+		l.history = slices.Delete(l.history, 0, n)
+	}
+}
+
+func (l *List) pause() bool {
+	select {
+	case <-l.stop:
+		return false
+	case <-time.After(scanPause):
+		return true
+	}
+}
+
+func (l *List) save(ctx context.Context, b *Ban) error {
+	val, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return l.kv.Set(ctx, []byte(keyPrefix+b.ID), val)
+}
+
+func hostOf(rawUrl string) string {
+	if u, err := url.Parse(rawUrl); err == nil {
+		return u.Host
+	}
+	return ""
+}
@@ -0,0 +1,286 @@
+package ban
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	storagev1 "github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/conf"
+	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage"
+	"github.com/omalloc/tavern/storage/sharedkv"
+)
+
+func newTestStorage(t *testing.T) storagev1.Storage {
+	st, err := storage.New(&conf.Storage{
+		Driver:          "native",
+		DBType:          "pebble",
+		SelectionPolicy: "hashring",
+		EvictionPolicy:  "lru",
+		Buckets: []*conf.Bucket{
+			{Path: t.TempDir(), Type: "normal"},
+		},
+	}, log.GetLogger())
+	require.NoError(t, err)
+
+	storage.SetDefault(st)
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func newMetadata(rawUrl string, stored int64, header http.Header) *object.Metadata {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &object.Metadata{
+		Flags:       object.FlagCache,
+		ID:          object.NewID(rawUrl),
+		Code:        http.StatusOK,
+		Size:        1,
+		RespUnix:    stored,
+		LastRefUnix: stored,
+		Refs:        1,
+		ExpiresAt:   stored + 3600,
+		Headers:     header,
+	}
+}
+
+// storeObjects stores the objects of the url format, e.g. `http://www.example.com/%d.jpg`, in the past.
+func storeObjects(t *testing.T, st storagev1.Storage, n int, format string) {
+	stored := time.Now().Add(-time.Hour).Unix()
+	for i := 0; i < n; i++ {
+		md := newMetadata(fmt.Sprintf(format, i), stored, http.Header{"Content-Type": {"image/jpeg"}})
+		require.NoError(t, st.Select(context.Background(), md.ID).Store(context.Background(), md))
+	}
+}
+
+// countObjects counts the stored objects of the host.
+func countObjects(t *testing.T, st storagev1.Storage, host string) int {
+	n := 0
+	for _, bucket := range st.Buckets() {
+		require.NoError(t, bucket.Iterate(context.Background(), func(md *object.Metadata) error {
+			if md != nil && hostOf(md.ID.Path()) == host {
+				n++
+			}
+			return nil
+		}))
+	}
+	return n
+}
+
+func TestBanMatch(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name string
+		ban  *Ban
+		md   *object.Metadata
+		want bool
+	}{
+		{
+			name: "host",
+			ban:  &Ban{Host: "www.example.com"},
+			md:   newMetadata("http://www.example.com/1.jpg", now-10, nil),
+			want: true,
+		},
+		{
+			name: "other host",
+			ban:  &Ban{Host: "www.example.com"},
+			md:   newMetadata("http://img.example.com/1.jpg", now-10, nil),
+			want: false,
+		},
+		{
+			name: "host and url",
+			ban:  &Ban{Host: "www.example.com", URL: `\.jpg$`},
+			md:   newMetadata("http://www.example.com/1.jpg", now-10, nil),
+			want: true,
+		},
+		{
+			name: "url not matched",
+			ban:  &Ban{Host: "www.example.com", URL: `\.png$`},
+			md:   newMetadata("http://www.example.com/1.jpg", now-10, nil),
+			want: false,
+		},
+		{
+			name: "header",
+			ban:  &Ban{HeaderName: "Content-Type", HeaderValue: "^image/"},
+			md:   newMetadata("http://www.example.com/1.jpg", now-10, http.Header{"Content-Type": {"image/jpeg"}}),
+			want: true,
+		},
+		{
+			name: "header not matched",
+			ban:  &Ban{HeaderName: "Content-Type", HeaderValue: "^image/"},
+			md:   newMetadata("http://www.example.com/1.css", now-10, http.Header{"Content-Type": {"text/css"}}),
+			want: false,
+		},
+		{
+			name: "header absent",
+			ban:  &Ban{HeaderName: "Content-Type", HeaderValue: ".*"},
+			md:   newMetadata("http://www.example.com/1.css", now-10, nil),
+			want: false,
+		},
+		{
+			name: "stored after the ban",
+			ban:  &Ban{Host: "www.example.com"},
+			md:   newMetadata("http://www.example.com/1.jpg", now+10, nil),
+			want: false,
+		},
+		{
+			name: "refreshed after the ban, created before",
+			ban:  &Ban{Host: "www.example.com"},
+			md: func() *object.Metadata {
+				md := newMetadata("http://www.example.com/1.jpg", now+10, nil)
+				md.CreatedUnix = now - 10
+				return md
+			}(),
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ban.Before = now
+			require.NoError(t, tt.ban.compile())
+			assert.Equal(t, tt.want, tt.ban.Match(tt.md))
+		})
+	}
+}
+
+func TestListAdd(t *testing.T) {
+	l := New(sharedkv.NewMemSharedKV(), log.GetLogger())
+	ctx := context.Background()
+
+	for _, b := range []*Ban{
+		{},
+		{URL: "("},
+		{HeaderName: "Content-Type", HeaderValue: "["},
+	} {
+		_, err := l.Add(ctx, b)
+		assert.Error(t, err)
+	}
+
+	// the ban in the future applies from now.
+	added, err := l.Add(ctx, &Ban{Host: "www.example.com", Before: time.Now().Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	assert.NotEmpty(t, added.ID)
+	assert.LessOrEqual(t, added.Before, time.Now().Unix())
+
+	past := time.Now().Add(-time.Minute).Unix()
+	assert.NotNil(t, l.Banned(newMetadata("http://www.example.com/1.jpg", past, nil)))
+	assert.Nil(t, l.Banned(newMetadata("http://img.example.com/1.jpg", past, nil)))
+	assert.Nil(t, l.Banned(newMetadata("http://www.example.com/1.jpg", time.Now().Add(time.Minute).Unix(), nil)))
+	assert.Len(t, l.List(), 1)
+
+	assert.True(t, l.Remove(ctx, added.ID))
+	assert.False(t, l.Remove(ctx, added.ID))
+	assert.Nil(t, l.Banned(newMetadata("http://www.example.com/1.jpg", past, nil)))
+	assert.Empty(t, l.List())
+}
+
+func TestListLoad(t *testing.T) {
+	kv := sharedkv.NewMemSharedKV()
+	ctx := context.Background()
+
+	l := New(kv, log.GetLogger())
+	active, err := l.Add(ctx, &Ban{Host: "www.example.com", URL: `\.jpg$`})
+	require.NoError(t, err)
+	completed, err := l.Add(ctx, &Ban{HeaderName: "Content-Type", HeaderValue: "^text/"})
+	require.NoError(t, err)
+
+	// retire the second ban as the lurker does.
+	for _, b := range *l.active.Load() {
+		if b.ID == completed.ID {
+			b.Discarded()
+			l.retire(ctx, b)
+		}
+	}
+	require.NoError(t, kv.Set(ctx, []byte(keyPrefix+"invalid"), []byte("{")))
+
+	// the restarted list.
+	l = New(kv, log.GetLogger())
+	require.NoError(t, l.Load(ctx))
+
+	bans := l.List()
+	require.Len(t, bans, 2)
+	assert.Equal(t, completed.ID, bans[0].ID)
+	assert.True(t, bans[0].Completed)
+	assert.Equal(t, int64(1), bans[0].Removed)
+	assert.Equal(t, active.ID, bans[1].ID)
+	assert.False(t, bans[1].Completed)
+
+	past := time.Now().Add(-time.Minute).Unix()
+	assert.NotNil(t, l.Banned(newMetadata("http://www.example.com/1.jpg", past, nil)))
+	assert.Nil(t, l.Banned(newMetadata("http://www.example.com/1.css", past, http.Header{"Content-Type": {"text/css"}})))
+
+	// the invalid ban is dropped.
+	_, err = kv.Get(ctx, []byte(keyPrefix+"invalid"))
+	assert.ErrorIs(t, err, storagev1.ErrKeyNotFound)
+}
+
+func TestLurk(t *testing.T) {
+	st := newTestStorage(t)
+	storeObjects(t, st, 10, "http://www.example.com/%d.jpg")
+	storeObjects(t, st, 10, "http://img.example.com/%d.jpg")
+
+	tests := []struct {
+		name string
+		ban  *Ban
+		host string
+	}{
+		// the `ix/` index of the host.
+		{name: "host", ban: &Ban{Host: "www.example.com", URL: `\.jpg$`}, host: "www.example.com"},
+		// all the objects of the bucket.
+		{name: "url", ban: &Ban{URL: `^http://img\.example\.com/`}, host: "img.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(st.SharedKV(), log.GetLogger())
+			b, err := l.Add(context.Background(), tt.ban)
+			require.NoError(t, err)
+
+			assert.True(t, l.lurk((*l.active.Load())[0]))
+			assert.Equal(t, 0, countObjects(t, st, tt.host))
+
+			bans := l.List()
+			require.Len(t, bans, 1)
+			assert.Equal(t, b.ID, bans[0].ID)
+			assert.True(t, bans[0].Completed)
+			assert.Equal(t, int64(10), bans[0].Removed)
+		})
+	}
+}
+
+func TestLurkStopped(t *testing.T) {
+	tests := []struct {
+		name string
+		ban  *Ban
+	}{
+		{name: "host", ban: &Ban{Host: "www.example.com"}},
+		{name: "header", ban: &Ban{HeaderName: "Content-Type", HeaderValue: "^image/"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newTestStorage(t)
+			storeObjects(t, st, scanBatch+500, "http://www.example.com/%d.jpg")
+
+			l := New(st.SharedKV(), log.GetLogger())
+			_, err := l.Add(context.Background(), tt.ban)
+			require.NoError(t, err)
+			require.NoError(t, l.Stop(context.Background()))
+
+			// the scan stops at the first batch, the rest is left to the next run.
+			assert.False(t, l.lurk((*l.active.Load())[0]))
+			assert.Equal(t, 500, countObjects(t, st, "www.example.com"))
+			assert.False(t, l.List()[0].Completed)
+		})
+	}
+}
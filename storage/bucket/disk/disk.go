@@ -12,6 +12,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/paulbellamy/ratecounter"
@@ -21,11 +22,16 @@ import (
 	"github.com/omalloc/tavern/conf"
 	"github.com/omalloc/tavern/contrib/log"
 	"github.com/omalloc/tavern/pkg/algorithm/lru"
+	"github.com/omalloc/tavern/storage/accounting"
 	"github.com/omalloc/tavern/storage/indexdb"
 )
 
 var _ storage.Bucket = (*diskBucket)(nil)
 
+// lockStripes serializes the store and discard of the same object,
+// the domain usage is only counted on the object added or removed.
+const lockStripes = 64
+
 type diskBucket struct {
 	path      string
 	dbPath    string
@@ -36,6 +42,9 @@ type diskBucket struct {
 	sharedkv  storage.SharedKV
 	indexdb   storage.IndexDB
 	cache     *lru.Cache[object.IDHash, storage.Mark]
+	usage     *accounting.Tracker
+	locks     [lockStripes]sync.Mutex
+	touches   *touchBuffer
 	fileMode  fs.FileMode
 	stop      chan struct{}
 }
@@ -52,6 +61,8 @@ func New(config *conf.Bucket, sharedkv storage.SharedKV) (storage.Bucket, error)
 		weight:    100, // default weight
 		sharedkv:  sharedkv,
 		cache:     lru.New[object.IDHash, storage.Mark](config.MaxObjectLimit),
+		usage:     accounting.Default(),
+		touches:   newTouchBuffer(),
 		fileMode:  fs.FileMode(0o755),
 		stop:      make(chan struct{}, 1),
 	}
@@ -73,6 +84,9 @@ func New(config *conf.Bucket, sharedkv storage.SharedKV) (storage.Bucket, error)
 	// load lru
 	bucket.loadLRU()
 
+	// flush hits
+	go bucket.flushLoop()
+
 	return bucket, nil
 }
 
@@ -128,12 +142,19 @@ func (d *diskBucket) loadLRU() {
 			if meta != nil {
 				mdCount++
 				chunkCount += meta.Chunks.Count()
-				d.cache.Set(meta.ID.Hash(), storage.NewMark(meta.LastRefUnix, uint64(meta.Refs)))
+				// 按持久化的引用计数恢复初始频次, 重启后淘汰顺序仍反映真实热度
+				d.cache.SetWithFrequency(meta.ID.Hash(), storage.NewMark(meta.LastRefUnix, uint64(meta.Refs)), int(min(meta.Refs, maxLoadFrequency))+1)
 
 				// store service domains
 				// TODO: add Debounce incr
 				if u, err1 := url.Parse(meta.ID.Path()); err1 == nil {
 					_, _ = d.sharedkv.Incr(context.Background(), []byte(fmt.Sprintf("if/domain/%s", u.Host)), 1)
+					d.usage.Add(u.Host, 1, int64(meta.StoredBytes()))
+
+					// backfill surrogate-key index for tag purge
+					for _, tag := range meta.Tags {
+						_ = d.sharedkv.Set(context.Background(), tagIndexKey(d.ID(), u.Host, tag, meta.ID), meta.ID.Bytes())
+					}
 				}
 
 				// backfill inverted index for directory purge
@@ -202,9 +223,14 @@ func (d *diskBucket) discard(ctx context.Context, md *object.Metadata) error {
 	clog := log.Context(ctx)
 
 	// 先删除 db 中的数据, 避免被其他协程 HIT
+	// 仅在对象确实被删除时扣减域名用量, 并发 discard 同一对象只计一次
+	mu := d.lock(md.ID)
+	mu.Lock()
+	cur, _ := d.indexdb.Get(ctx, md.ID.Bytes())
 	if err := d.indexdb.Delete(ctx, md.ID.Bytes()); err != nil {
 		clog.Warnf("failed to delete metadata %s: %v", md.ID.WPath(d.path), err)
 	}
+	mu.Unlock()
 
 	// 如果缓存为1级，则清除全部子缓存(vary)
 	if md.IsVary() && len(md.VirtualKey) > 0 {
@@ -231,7 +257,15 @@ func (d *diskBucket) discard(ctx context.Context, md *object.Metadata) error {
 	_ = d.sharedkv.Delete(ctx, []byte(fmt.Sprintf("ix/%s/%s", d.ID(), md.ID.Key())))
 
 	if u, err1 := url.Parse(md.ID.Path()); err1 == nil {
-		_, _ = d.sharedkv.Decr(ctx, []byte(fmt.Sprintf("if/domain/%s", u.Host)), 1)
+		if cur != nil {
+			_, _ = d.sharedkv.Decr(ctx, []byte(fmt.Sprintf("if/domain/%s", u.Host)), 1)
+			d.usage.Add(u.Host, -1, -int64(cur.StoredBytes()))
+		}
+
+		// 删除标签倒排索引
+		for _, tag := range md.Tags {
+			_ = d.sharedkv.Delete(ctx, tagIndexKey(d.ID(), u.Host, tag, md.ID))
+		}
 	}
 
 	return nil
@@ -248,11 +282,16 @@ func (d *diskBucket) Expired(ctx context.Context, id *object.ID, md *object.Meta
 	return false
 }
 
-// Iterate implements storage.Bucket.
+// Iterate implements storage.Bucket, the iteration stops at the first error of fn.
 func (d *diskBucket) Iterate(ctx context.Context, fn func(*object.Metadata) error) error {
-	return d.indexdb.Iterate(ctx, nil, func(key []byte, val *object.Metadata) bool {
-		return fn(val) == nil
-	})
+	var ferr error
+	if err := d.indexdb.Iterate(ctx, nil, func(key []byte, val *object.Metadata) bool {
+		ferr = fn(val)
+		return ferr == nil
+	}); err != nil {
+		return err
+	}
+	return ferr
 }
 
 // Lookup implements storage.Bucket.
@@ -261,9 +300,26 @@ func (d *diskBucket) Lookup(ctx context.Context, id *object.ID) (*object.Metadat
 	return md, err
 }
 
+// LookupWithHash implements storage.Bucket.
+func (d *diskBucket) LookupWithHash(ctx context.Context, hash object.IDHash) (*object.Metadata, error) {
+	return d.indexdb.Get(ctx, hash[:])
+}
+
 // Remove implements storage.Bucket.
 func (d *diskBucket) Remove(ctx context.Context, id *object.ID) error {
-	return d.indexdb.Delete(ctx, id.Bytes())
+	mu := d.lock(id)
+	mu.Lock()
+	cur, _ := d.indexdb.Get(ctx, id.Bytes())
+	err := d.indexdb.Delete(ctx, id.Bytes())
+	mu.Unlock()
+
+	if err == nil && cur != nil {
+		if u, err1 := url.Parse(id.Path()); err1 == nil {
+			_, _ = d.sharedkv.Decr(ctx, []byte(fmt.Sprintf("if/domain/%s", u.Host)), 1)
+			d.usage.Add(u.Host, -1, -int64(cur.StoredBytes()))
+		}
+	}
+	return err
 }
 
 // Store implements storage.Bucket.
@@ -287,16 +343,40 @@ func (d *diskBucket) Store(ctx context.Context, meta *object.Metadata) error {
 		d.cache.Set(meta.ID.Hash(), storage.NewMark(meta.LastRefUnix, uint64(meta.Refs)))
 	}
 
+	mu := d.lock(meta.ID)
+	mu.Lock()
+	prev, _ := d.indexdb.Get(ctx, meta.ID.Bytes())
+	if prev != nil {
+		// keep the flushed hits, the caller's metadata may be loaded before the flushing.
+		meta.Refs = max(meta.Refs, prev.Refs)
+		meta.LastRefUnix = max(meta.LastRefUnix, prev.LastRefUnix)
+		// the concurrent writers of the same content (parallel parts, read-ahead, completion)
+		// each hold a copy of the metadata, merge the stored chunks to not lose the others.
+		if sameContent(prev, meta) {
+			meta.Chunks.Or(prev.Chunks)
+		}
+	}
 	if err := d.indexdb.Set(ctx, meta.ID.Bytes(), meta); err != nil {
+		mu.Unlock()
 		return err
 	}
+	mu.Unlock()
 
-	// 写入域名 counter
+	// 写入域名 counter, 仅新对象计数; soft purge / 分片写入等重复 Store 只更新字节数
 	if u, err1 := url.Parse(meta.ID.Path()); err1 == nil {
-		if _, err1 = d.sharedkv.Incr(context.Background(), []byte(fmt.Sprintf("if/domain/%s", u.Host)), 1); err1 != nil {
-			log.Warnf("save kvstore domain %s failed", u.Host)
+		if prev == nil {
+			if _, err1 = d.sharedkv.Incr(context.Background(), []byte(fmt.Sprintf("if/domain/%s", u.Host)), 1); err1 != nil {
+				log.Warnf("save kvstore domain %s failed", u.Host)
+			}
+			d.usage.Add(u.Host, 1, int64(meta.StoredBytes()))
+		} else {
+			d.usage.Add(u.Host, 0, int64(meta.StoredBytes())-int64(prev.StoredBytes()))
 		}
 
+		// 写入标签倒排索引
+		for _, tag := range meta.Tags {
+			_ = d.sharedkv.Set(ctx, tagIndexKey(d.ID(), u.Host, tag, meta.ID), meta.ID.Bytes())
+		}
 	}
 	// 写入目录倒排索引
 	if err := d.sharedkv.Set(ctx, []byte(fmt.Sprintf("ix/%s/%s", d.ID(), meta.ID.Key())), meta.ID.Bytes()); err != nil {
@@ -348,6 +428,8 @@ func (d *diskBucket) Path() string {
 
 // Close implements storage.Bucket.
 func (d *diskBucket) Close() error {
+	close(d.stop)
+	d.flushTouched(context.Background())
 	return d.indexdb.Close()
 }
 
@@ -383,3 +465,32 @@ func IDPathRandomSuffix(path string) string {
 	_, _ = rand.Read(buf)
 	return path + "_" + hex.EncodeToString(buf)
 }
+
+func (d *diskBucket) lock(id *object.ID) *sync.Mutex {
+	return d.lockHash(id.Hash())
+}
+
+func (d *diskBucket) lockHash(hash object.IDHash) *sync.Mutex {
+	return &d.locks[hash[0]%lockStripes]
+}
+
+// tagIndexKey returns the surrogate-key inverted index key.
+//
+// key schema: tg/<bucketID>/<host>/<tag>/<hash>
+// value: object.IDHash bytes
+func tagIndexKey(bucketID, host, tag string, id *object.ID) []byte {
+	return []byte(fmt.Sprintf("tg/%s/%s/%s/%s", bucketID, host, tag, id.HashStr()))
+}
+
+// sameContent reports whether the chunks of the metadata belong to the same content,
+// the changed object is discarded before stored again, so its chunks are never merged.
+//
+// the content without the strong ETag or Last-Modified can not be told apart, never merged.
+func sameContent(a, b *object.Metadata) bool {
+	etag, lm := a.Headers.Get("ETag"), a.Headers.Get("Last-Modified")
+	if (etag == "" || strings.HasPrefix(etag, "W/")) && lm == "" {
+		return false
+	}
+	return a.Size == b.Size && a.BlockSize == b.BlockSize &&
+		etag == b.Headers.Get("ETag") && lm == b.Headers.Get("Last-Modified")
+}
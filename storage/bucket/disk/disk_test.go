@@ -79,3 +79,89 @@ func TestHitKey(t *testing.T) {
 
 	t.Logf("filepath=%s", cackeKey.WPath("/"))
 }
+
+func TestTouchPersistAfterClose(t *testing.T) {
+	basepath := t.TempDir()
+
+	bucket := newTestBucket(t, basepath)
+
+	cackeKey := object.NewID("http://www.example.com/path/to/hot.bin")
+
+	err := bucket.Store(context.Background(), &object.Metadata{
+		Flags:     object.FlagCache,
+		ID:        cackeKey,
+		Code:      http.StatusOK,
+		Size:      1,
+		RespUnix:  time.Now().Unix(),
+		Refs:      1,
+		ExpiresAt: time.Now().Add(time.Second * 30).Unix(),
+		Headers:   make(http.Header),
+	})
+	assert.NoError(t, err)
+
+	for range 3 {
+		bucket.Touch(context.Background(), cackeKey)
+	}
+
+	// the pending hits are flushed on close.
+	assert.NoError(t, bucket.Close())
+
+	bucket = newTestBucket(t, basepath)
+	defer bucket.Close()
+
+	md, err := bucket.Lookup(context.Background(), cackeKey)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), md.Refs)
+	assert.NotZero(t, md.LastRefUnix)
+}
+
+func TestStoreMergeChunks(t *testing.T) {
+	bucket := newTestBucket(t, t.TempDir())
+	defer bucket.Close()
+
+	cackeKey := object.NewID("http://www.example.com/path/to/parts.bin")
+	newMeta := func(etag string, chunks ...uint32) *object.Metadata {
+		md := &object.Metadata{
+			Flags:     object.FlagCache,
+			ID:        cackeKey,
+			Code:      http.StatusOK,
+			Size:      4096,
+			BlockSize: 1024,
+			RespUnix:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(time.Second * 30).Unix(),
+			Headers:   http.Header{"Etag": {etag}},
+		}
+		for _, idx := range chunks {
+			md.Chunks.Set(idx)
+		}
+		return md
+	}
+
+	// the writers of the same content keep the chunks of each other.
+	assert.NoError(t, bucket.Store(context.Background(), newMeta(`"v1"`, 0, 1)))
+	assert.NoError(t, bucket.Store(context.Background(), newMeta(`"v1"`, 3)))
+
+	md, err := bucket.Lookup(context.Background(), cackeKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, md.Chunks.Count())
+	assert.False(t, md.Chunks.Contains(2))
+
+	// the changed content replaces the chunks.
+	assert.NoError(t, bucket.Store(context.Background(), newMeta(`"v2"`, 2)))
+
+	md, err = bucket.Lookup(context.Background(), cackeKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, md.Chunks.Count())
+	assert.True(t, md.Chunks.Contains(2))
+
+	// the same size without the strong validators may be changed, the chunks are replaced.
+	for _, etag := range []string{"", `W/"v3"`} {
+		assert.NoError(t, bucket.Store(context.Background(), newMeta(etag, 0)))
+		assert.NoError(t, bucket.Store(context.Background(), newMeta(etag, 1)))
+
+		md, err = bucket.Lookup(context.Background(), cackeKey)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, md.Chunks.Count(), etag)
+		assert.True(t, md.Chunks.Contains(1), etag)
+	}
+}
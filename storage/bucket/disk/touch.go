@@ -0,0 +1,124 @@
+package disk
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/contrib/log"
+)
+
+const (
+	touchFlushInterval = 10 * time.Second // debounce of the hits flushing
+	touchFlushBatch    = 4096             // flush early when the pending objects reach the batch
+	maxLoadFrequency   = 64               // cap of the initial lru frequency restored from the refs
+)
+
+// touched is the hits of an object not flushed to the indexdb yet.
+type touched struct {
+	refs       int64
+	lastAccess int64
+}
+
+// touchBuffer collects the hits between flushes, the same object is merged.
+type touchBuffer struct {
+	mu      sync.Mutex
+	pending map[object.IDHash]*touched
+	notify  chan struct{}
+}
+
+func newTouchBuffer() *touchBuffer {
+	return &touchBuffer{
+		pending: make(map[object.IDHash]*touched),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+func (t *touchBuffer) add(hash object.IDHash, now int64) {
+	t.mu.Lock()
+	p, ok := t.pending[hash]
+	if !ok {
+		p = &touched{}
+		t.pending[hash] = p
+	}
+	p.refs++
+	p.lastAccess = now
+	full := len(t.pending) >= touchFlushBatch
+	t.mu.Unlock()
+
+	if full {
+		select {
+		case t.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *touchBuffer) take() map[object.IDHash]*touched {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending := t.pending
+	t.pending = make(map[object.IDHash]*touched, len(pending))
+	return pending
+}
+
+// Touch implements storage.Bucket.
+//
+// the hit bumps the lru mark in memory at once, the refs and the last access time
+// of the metadata are flushed to the indexdb in debounced batches.
+func (d *diskBucket) Touch(ctx context.Context, id *object.ID) {
+	now := time.Now().Unix()
+	hash := id.Hash()
+
+	if !d.cache.Update(hash, func(m *storage.Mark) {
+		m.SetRefs(m.Refs() + 1)
+		m.SetLastAccess(now)
+	}) {
+		return
+	}
+
+	d.touches.add(hash, now)
+}
+
+func (d *diskBucket) flushLoop() {
+	tick := time.NewTicker(touchFlushInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-tick.C:
+		case <-d.touches.notify:
+		}
+		d.flushTouched(context.Background())
+	}
+}
+
+// flushTouched writes the pending hits to the metadata, the discarded objects are skipped.
+func (d *diskBucket) flushTouched(ctx context.Context) {
+	pending := d.touches.take()
+	if len(pending) == 0 {
+		return
+	}
+
+	flushed := 0
+	for hash, p := range pending {
+		mu := d.lockHash(hash)
+		mu.Lock()
+		md, err := d.indexdb.Get(ctx, hash[:])
+		if err == nil && md != nil {
+			md.Refs += p.refs
+			md.LastRefUnix = max(md.LastRefUnix, p.lastAccess)
+			if err = d.indexdb.Set(ctx, hash[:], md); err == nil {
+				flushed++
+			}
+		}
+		mu.Unlock()
+	}
+
+	log.Debugf("bucket %s flushed hits of %d/%d objects", d.ID(), flushed, len(pending))
+}
@@ -44,6 +44,10 @@ func (e *emptyBucket) DiscardWithMetadata(ctx context.Context, meta *object.Meta
 	return nil
 }
 
+// Touch implements storage.Bucket.
+func (e *emptyBucket) Touch(ctx context.Context, id *object.ID) {
+}
+
 // Exist implements storage.Bucket.
 func (e *emptyBucket) Exist(ctx context.Context, id []byte) bool {
 	return false
@@ -74,6 +78,11 @@ func (e *emptyBucket) Lookup(ctx context.Context, id *object.ID) (*object.Metada
 	return nil, storage.ErrKeyNotFound
 }
 
+// LookupWithHash implements storage.Bucket.
+func (e *emptyBucket) LookupWithHash(ctx context.Context, hash object.IDHash) (*object.Metadata, error) {
+	return nil, storage.ErrKeyNotFound
+}
+
 // Remove implements storage.Bucket.
 func (e *emptyBucket) Remove(ctx context.Context, id *object.ID) error {
 	return nil
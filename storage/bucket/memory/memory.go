@@ -25,6 +25,11 @@ func (r *memoryBucket) Lookup(ctx context.Context, id *object.ID) (*object.Metad
 	panic("implement me")
 }
 
+func (r *memoryBucket) LookupWithHash(ctx context.Context, hash object.IDHash) (*object.Metadata, error) {
+	//TODO implement me
+	panic("implement me")
+}
+
 func (r *memoryBucket) Store(ctx context.Context, meta *object.Metadata) error {
 	//TODO implement me
 	panic("implement me")
@@ -70,6 +75,11 @@ func (r *memoryBucket) Expired(ctx context.Context, id *object.ID, md *object.Me
 	panic("implement me")
 }
 
+func (r *memoryBucket) Touch(ctx context.Context, id *object.ID) {
+	//TODO implement me
+	panic("implement me")
+}
+
 func (r *memoryBucket) ID() string {
 	//TODO implement me
 	panic("implement me")
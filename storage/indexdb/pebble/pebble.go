@@ -21,6 +21,7 @@ type PebbleDB struct {
 	db            *pebble.DB
 	writeMode     *pebble.WriteOptions
 	skipErrRecord bool
+	readOnly      bool
 }
 
 func init() {
@@ -72,7 +73,9 @@ func (p *PebbleDB) Iterate(ctx context.Context, prefix []byte, f storage.Iterate
 			if err = p.codec.Unmarshal(buf, meta); err != nil {
 				continue
 			}
-			f(iter.Key(), meta)
+			if !f(iter.Key(), meta) {
+				break
+			}
 		}
 		return nil
 	}
@@ -80,7 +83,7 @@ func (p *PebbleDB) Iterate(ctx context.Context, prefix []byte, f storage.Iterate
 	for iter.First(); iter.Valid(); iter.Next() {
 		buf, err1 := iter.ValueAndErr()
 		if err1 != nil {
-			return err
+			return err1
 		}
 
 		meta := &object.Metadata{}
@@ -88,7 +91,9 @@ func (p *PebbleDB) Iterate(ctx context.Context, prefix []byte, f storage.Iterate
 			return err
 		}
 
-		f(iter.Key(), meta)
+		if !f(iter.Key(), meta) {
+			break
+		}
 	}
 	return nil
 }
@@ -112,7 +117,9 @@ func (p *PebbleDB) Expired(ctx context.Context, f storage.IterateFunc) error {
 // Close implements storage.IndexDB.
 func (p *PebbleDB) Close() error {
 	// force flush data to disk
-	_ = p.db.Flush()
+	if !p.readOnly {
+		_ = p.db.Flush()
+	}
 	return p.db.Close()
 }
 
@@ -129,6 +136,7 @@ type pebbleOption struct {
 	WalBytesPerSync    int  `json:"wal_bytes_per_sync" yaml:"wal_bytes_per_sync"`
 	WalMinSyncInterval int  `json:"wal_min_sync_interval" yaml:"wal_min_sync_interval"`
 	WriteSyncMode      bool `json:"write_sync_mode" yaml:"write_sync_mode"`
+	ReadOnly           bool `json:"read_only" yaml:"read_only"`
 }
 
 func New(path string, option storage.Option) (storage.IndexDB, error) {
@@ -154,6 +162,7 @@ func New(path string, option storage.Option) (storage.IndexDB, error) {
 		WALMinSyncInterval: func() time.Duration {
 			return time.Duration(pebbleOption.WalMinSyncInterval) * time.Second
 		},
+		ReadOnly: pebbleOption.ReadOnly, // offline inspection, e.g. tavern-ctl
 	})
 	if err != nil {
 		return nil, err
@@ -170,5 +179,6 @@ func New(path string, option storage.Option) (storage.IndexDB, error) {
 		db:            pdb,
 		writeMode:     writeMode, // 是否异步写操作
 		skipErrRecord: true,
+		readOnly:      pebbleOption.ReadOnly,
 	}, nil
 }
@@ -0,0 +1,95 @@
+package pebble_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/api/defined/v1/storage/object"
+	"github.com/omalloc/tavern/storage/indexdb"
+	"github.com/omalloc/tavern/storage/indexdb/pebble"
+)
+
+func newTestDB(t *testing.T, path string, config map[string]any) storage.IndexDB {
+	db, err := pebble.New(path, indexdb.NewOption(path, indexdb.WithType("pebble"), indexdb.WithDBConfig(config)))
+	require.NoError(t, err)
+	return db
+}
+
+// storeObjects stores n objects, returns the keys in order.
+func storeObjects(t *testing.T, db storage.IndexDB, n int) [][]byte {
+	keys := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		id := object.NewID(fmt.Sprintf("http://www.example.com/%d.jpg", i))
+		require.NoError(t, db.Set(context.Background(), id.Bytes(), &object.Metadata{ID: id, Code: http.StatusOK, Size: uint64(i)}))
+		keys = append(keys, id.Bytes())
+	}
+	return keys
+}
+
+func TestIterateStop(t *testing.T) {
+	db := newTestDB(t, t.TempDir(), map[string]any{})
+	t.Cleanup(func() { _ = db.Close() })
+	storeObjects(t, db, 10)
+
+	tests := []struct {
+		name string
+		stop int // the callback returns false at the n-th record
+		want int
+	}{
+		{name: "stop at first", stop: 1, want: 1},
+		{name: "stop in the middle", stop: 4, want: 4},
+		{name: "never stop", stop: 0, want: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			visited := 0
+			err := db.Iterate(context.Background(), nil, func(key []byte, md *object.Metadata) bool {
+				visited++
+				return visited != tt.stop
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, visited)
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path := t.TempDir()
+	db := newTestDB(t, path, map[string]any{})
+	keys := storeObjects(t, db, 3)
+	require.NoError(t, db.Close())
+
+	// the offline inspection opens the db read only, e.g. tavern-ctl.
+	db = newTestDB(t, path, map[string]any{"read_only": true})
+
+	md, err := db.Get(context.Background(), keys[1])
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), md.Size)
+
+	visited := 0
+	require.NoError(t, db.Iterate(context.Background(), nil, func(key []byte, md *object.Metadata) bool {
+		visited++
+		return true
+	}))
+	assert.Equal(t, 3, visited)
+
+	id := object.NewID("http://www.example.com/new.jpg")
+	assert.Error(t, db.Set(context.Background(), id.Bytes(), &object.Metadata{ID: id}))
+	assert.Error(t, db.Delete(context.Background(), keys[0]))
+	require.NoError(t, db.Close())
+
+	// nothing is written by the read only db.
+	db = newTestDB(t, path, map[string]any{})
+	t.Cleanup(func() { _ = db.Close() })
+	_, err = db.Get(context.Background(), keys[0])
+	assert.NoError(t, err)
+	_, err = db.Get(context.Background(), id.Bytes())
+	assert.Error(t, err)
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"slices"
 
 	"github.com/cockroachdb/pebble/v2"
 	"github.com/cockroachdb/pebble/v2/vfs"
 	"github.com/omalloc/tavern/api/defined/v1/storage"
+	"github.com/omalloc/tavern/contrib/log"
 )
 
 var _ storage.SharedKV = (*memSharedKV)(nil)
@@ -31,7 +33,8 @@ func (r *memSharedKV) Get(_ context.Context, key []byte) ([]byte, error) {
 
 	defer func() { _ = c.Close() }()
 
-	return val, nil
+	// the value is only valid until the closer is closed.
+	return slices.Clone(val), nil
 }
 
 func (r *memSharedKV) Set(_ context.Context, key []byte, val []byte) error {
@@ -196,3 +199,22 @@ func NewMemSharedKV() storage.SharedKV {
 	}
 	return r
 }
+
+// NewSharedKV opens the SharedKV on the disk path, the keys survive restart.
+// empty path falls back to the in-memory SharedKV.
+func NewSharedKV(path string) (storage.SharedKV, error) {
+	if path == "" {
+		return NewMemSharedKV(), nil
+	}
+
+	db, err := pebble.Open(path, &pebble.Options{
+		Logger: log.NewHelper(log.NewFilter(log.GetLogger(), log.FilterLevel(log.LevelWarn))),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &memSharedKV{
+		db: db,
+	}, nil
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +15,7 @@ import (
 	"github.com/omalloc/tavern/api/defined/v1/storage/object"
 	"github.com/omalloc/tavern/conf"
 	"github.com/omalloc/tavern/contrib/log"
+	"github.com/omalloc/tavern/storage/accounting"
 	"github.com/omalloc/tavern/storage/bucket/empty"
 	"github.com/omalloc/tavern/storage/selector"
 	"github.com/omalloc/tavern/storage/sharedkv"
@@ -19,6 +23,11 @@ import (
 
 var _ storage.Storage = (*nativeStorage)(nil)
 
+const (
+	purgeScanBatch = 1000                  // objects scanned per batch of the regex purge
+	purgeScanPause = 10 * time.Millisecond // pause between two batches
+)
+
 type nativeStorage struct {
 	closed bool
 	mu     sync.Mutex
@@ -34,13 +43,18 @@ type nativeStorage struct {
 
 func New(config *conf.Storage, logger log.Logger) (storage.Storage, error) {
 	nopBucket, _ := empty.New(&conf.Bucket{}, sharedkv.NewEmpty())
+	kv, err := sharedkv.NewSharedKV(config.SharedKVPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sharedkv %s: %w", config.SharedKVPath, err)
+	}
+
 	n := &nativeStorage{
 		closed: false,
 		mu:     sync.Mutex{},
 		log:    log.NewHelper(logger),
 
 		selector:     selector.New([]storage.Bucket{}, config.SelectionPolicy),
-		sharedkv:     sharedkv.NewMemSharedKV(),
+		sharedkv:     kv,
 		nopBucket:    nopBucket,
 		memoryBucket: make([]storage.Bucket, 0, len(config.Buckets)),
 		hotBucket:    make([]storage.Bucket, 0, len(config.Buckets)),
@@ -61,6 +75,13 @@ func (n *nativeStorage) reinit(config *conf.Storage) error {
 	if err := n.sharedkv.DropPrefix(ctx, []byte("if/domain/")); err != nil {
 		n.log.Warnf("failed to drop prefix key `if/domain/` counter: %s", err)
 	}
+	accounting.Default().Reset()
+	// the inverted index is backfilled by bucket loading, drop the stale keys of persistent sharedkv.
+	for _, prefix := range []string{"ix/", "tg/"} {
+		if err := n.sharedkv.DropPrefix(ctx, []byte(prefix)); err != nil {
+			n.log.Warnf("failed to drop prefix key `%s` index: %s", prefix, err)
+		}
+	}
 
 	globalConfig := &globalBucketOption{
 		AsyncLoad:       config.AsyncLoad,
@@ -113,7 +134,22 @@ func (n *nativeStorage) Buckets() []storage.Bucket {
 }
 
 // PURGE implements storage.Storage.
-func (n *nativeStorage) PURGE(storeUrl string, typ storage.PurgeControl) error {
+func (n *nativeStorage) PURGE(storeUrl string, typ storage.PurgeControl) (int, error) {
+	// Surrogate-Key purge
+	if typ.Tag != "" {
+		return n.purgeTag(storeUrl, typ)
+	}
+
+	// regex / glob purge
+	if typ.Match != "" {
+		return n.purgeMatch(storeUrl, typ)
+	}
+
+	// domain-wide purge
+	if typ.Domain {
+		return n.purgeDomain(storeUrl, typ)
+	}
+
 	// Directory prefix purge
 	if typ.Dir {
 		// For directory purge, we prefer SharedKV inverted index when available:
@@ -138,12 +174,22 @@ func (n *nativeStorage) PURGE(storeUrl string, typ storage.PurgeControl) error {
 					if err := b.DiscardWithHash(ctx, h); err == nil {
 						processed++
 					}
-				} else {
-					// For mark-expired on dir, skip sharedkv hits and fallback to full scan below.
+
+					// remove index mapping
+					_ = n.sharedkv.Delete(ctx, key)
+					return nil
 				}
 
-				// remove index mapping
-				_ = n.sharedkv.Delete(ctx, key)
+				// mark-expired keeps the index mapping, the vary variants have their own mapping.
+				md, err := b.LookupWithHash(ctx, h)
+				if err != nil {
+					// stale index mapping
+					_ = n.sharedkv.Delete(ctx, key)
+					return nil
+				}
+				if err = markExpired(ctx, b, md); err == nil {
+					processed++
+				}
 				return nil
 			})
 		}
@@ -159,8 +205,7 @@ func (n *nativeStorage) PURGE(storeUrl string, typ storage.PurgeControl) error {
 						if typ.Hard || !typ.MarkExpired {
 							_ = b.DiscardWithMetadata(ctx, md)
 						} else {
-							md.ExpiresAt = time.Now().Add(-1).Unix()
-							_ = b.Store(ctx, md)
+							_ = markExpired(ctx, b, md)
 						}
 						processed++
 					}
@@ -170,35 +215,265 @@ func (n *nativeStorage) PURGE(storeUrl string, typ storage.PurgeControl) error {
 		}
 
 		if processed == 0 {
-			return storage.ErrKeyNotFound
+			return 0, storage.ErrKeyNotFound
 		}
-		return nil
+		return processed, nil
 	}
 
 	// Single object purge
 	cacheKey := object.NewID(storeUrl)
 
+	// the vary variants live in the bucket of the vary index.
 	bucket := n.Select(context.Background(), cacheKey)
 	if bucket == nil {
-		return fmt.Errorf("bucket not found")
+		return 0, fmt.Errorf("bucket not found")
+	}
+
+	ctx := context.Background()
+
+	// single vary variant
+	if typ.VirtualKey != "" {
+		vid := object.NewVirtualID(storeUrl, typ.VirtualKey)
+		if typ.Hard {
+			if err := bucket.Discard(ctx, vid); err != nil {
+				return 0, err
+			}
+			return 1, nil
+		}
+
+		vmd, err := bucket.Lookup(ctx, vid)
+		if err != nil {
+			return 0, err
+		}
+		if err = markExpired(ctx, bucket, vmd); err != nil {
+			return 0, err
+		}
+		return 1, nil
 	}
 
 	// hard delete cache file mode.
 	if typ.Hard {
-		return bucket.Discard(context.Background(), cacheKey)
+		md, err := bucket.Lookup(ctx, cacheKey)
+		if err != nil {
+			return 0, err
+		}
+
+		// the variants are discarded with the vary index.
+		processed := 1
+		if md.IsVary() {
+			for _, vkey := range md.VirtualKey {
+				if bucket.Exist(ctx, object.NewVirtualID(md.ID.Path(), vkey).Bytes()) {
+					processed++
+				}
+			}
+		}
+
+		if err = bucket.DiscardWithMetadata(ctx, md); err != nil {
+			return 0, err
+		}
+		return processed, nil
 	}
 
 	// MarkExpired to revalidate.
 	// soft delete cache file mode.
-	md, err := bucket.Lookup(context.Background(), cacheKey)
+	md, err := bucket.Lookup(ctx, cacheKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = markExpired(ctx, bucket, md); err != nil {
+		return 0, err
+	}
+	processed := 1
+
+	// vary index, mark all the variants expired.
+	if md.IsVary() {
+		for _, vkey := range md.VirtualKey {
+			vmd, err1 := bucket.Lookup(ctx, object.NewVirtualID(md.ID.Path(), vkey))
+			if err1 != nil {
+				continue
+			}
+			if err1 = markExpired(ctx, bucket, vmd); err1 == nil {
+				processed++
+			}
+		}
+	}
+	return processed, nil
+}
+
+// purgeDomain purges all the objects of the storeUrl host with the `ix/` index of both schemes.
+func (n *nativeStorage) purgeDomain(storeUrl string, typ storage.PurgeControl) (int, error) {
+	u, err := url.Parse(storeUrl)
+	if err != nil || u.Host == "" {
+		return 0, fmt.Errorf("invalid purge url %q", storeUrl)
+	}
+
+	ctx := context.Background()
+	processed, scanned := 0, 0
+	for _, b := range n.Buckets() {
+		hashes := make([]object.IDHash, 0)
+		for _, scheme := range []string{"http", "https"} {
+			prefix := fmt.Sprintf("ix/%s/%s://%s/", b.ID(), scheme, u.Host)
+			_ = n.sharedkv.IteratePrefix(ctx, []byte(prefix), func(key, val []byte) error {
+				if len(val) >= object.IdHashSize {
+					var h object.IDHash
+					copy(h[:], val[:object.IdHashSize])
+					hashes = append(hashes, h)
+				}
+				return nil
+			})
+		}
+
+		for _, h := range hashes {
+			if scanned++; scanned%purgeScanBatch == 0 {
+				time.Sleep(purgeScanPause)
+			}
+
+			if typ.Hard || !typ.MarkExpired {
+				if err = b.DiscardWithHash(ctx, h); err == nil {
+					processed++
+				}
+				continue
+			}
+
+			md, err1 := b.LookupWithHash(ctx, h)
+			if err1 != nil {
+				continue
+			}
+			if err1 = markExpired(ctx, b, md); err1 == nil {
+				processed++
+			}
+		}
+
+		// drop the stale tag index of the domain.
+		if typ.Hard || !typ.MarkExpired {
+			_ = n.sharedkv.DropPrefix(ctx, []byte(fmt.Sprintf("tg/%s/%s/", b.ID(), u.Host)))
+		}
+	}
+
+	n.log.Infof("purge domain %s, scanned %d objects, processed %d", u.Host, scanned, processed)
+
+	if processed == 0 {
+		return 0, storage.ErrKeyNotFound
+	}
+	return processed, nil
+}
+
+// purgeTag purges the objects of the storeUrl host with the tag.
+func (n *nativeStorage) purgeTag(storeUrl string, typ storage.PurgeControl) (int, error) {
+	u, err := url.Parse(storeUrl)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	processed := 0
+
+	for _, b := range n.Buckets() {
+		// key schema: tg/<bucketID>/<host>/<tag>/<hash>
+		// value: object.IDHash bytes
+		prefix := fmt.Sprintf("tg/%s/%s/%s/", b.ID(), u.Host, typ.Tag)
+		_ = n.sharedkv.IteratePrefix(ctx, []byte(prefix), func(key, val []byte) error {
+			// skip the longer tags with the same prefix, e.g. `a/b` of `a`
+			if len(key)-len(prefix) != object.IdHashSize*2 || len(val) < object.IdHashSize {
+				return nil
+			}
+
+			var h object.IDHash
+			copy(h[:], val[:object.IdHashSize])
+
+			md, err1 := b.LookupWithHash(ctx, h)
+			if err1 != nil || !slices.Contains(md.Tags, typ.Tag) {
+				// stale index mapping, the object is gone or re-tagged.
+				_ = n.sharedkv.Delete(ctx, key)
+				return nil
+			}
+
+			if typ.Hard || !typ.MarkExpired {
+				err1 = b.DiscardWithMetadata(ctx, md)
+			} else {
+				err1 = markExpired(ctx, b, md)
+			}
+			if err1 == nil {
+				processed++
+			}
+			return nil
+		})
+	}
+
+	if processed == 0 {
+		return 0, storage.ErrKeyNotFound
+	}
+	return processed, nil
+}
+
+// purgeMatch purges the objects of the storeUrl host whose url matches the RE2 pattern.
+//
+// the host objects are listed from the `ix/` index, then scanned in batches
+// to avoid blocking the indexdb of the online requests.
+func (n *nativeStorage) purgeMatch(storeUrl string, typ storage.PurgeControl) (int, error) {
+	u, err := url.Parse(storeUrl)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	re, err := regexp.Compile(typ.Match)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	processed, scanned := 0, 0
+
+	for _, b := range n.Buckets() {
+		hashes := make([]object.IDHash, 0)
+		prefix := fmt.Sprintf("ix/%s/%s://%s/", b.ID(), u.Scheme, u.Host)
+		_ = n.sharedkv.IteratePrefix(ctx, []byte(prefix), func(key, val []byte) error {
+			if len(val) < object.IdHashSize {
+				return nil
+			}
+			var h object.IDHash
+			copy(h[:], val[:object.IdHashSize])
+			hashes = append(hashes, h)
+			return nil
+		})
+
+		for _, h := range hashes {
+			scanned++
+			if scanned%purgeScanBatch == 0 {
+				time.Sleep(purgeScanPause)
+			}
+
+			md, err1 := b.LookupWithHash(ctx, h)
+			if err1 != nil || !re.MatchString(md.ID.Path()) {
+				continue
+			}
+
+			if typ.Hard || !typ.MarkExpired {
+				err1 = b.DiscardWithMetadata(ctx, md)
+			} else {
+				err1 = markExpired(ctx, b, md)
+			}
+			if err1 == nil {
+				processed++
+			}
+		}
 	}
 
-	// set expire time to past time. and then store it back.
-	md.ExpiresAt = time.Now().Add(-1).Unix()
+	n.log.Debugf("purge match %s of %s, scanned %d objects, processed %d", typ.Match, u.Host, scanned, processed)
+
+	if processed == 0 {
+		return 0, storage.ErrKeyNotFound
+	}
+	return processed, nil
+}
+
+// markExpired sets the expire time to past time and stores it back,
+// the next request revalidates the object with the origin.
+func markExpired(ctx context.Context, bucket storage.Bucket, md *object.Metadata) error {
+	md.ExpiresAt = time.Now().Add(-time.Second).Unix()
 	// TODO: we should acquire a globalResourceLock before updating.
-	return bucket.Store(context.Background(), md)
+	return bucket.Store(ctx, md)
 }
 
 func (n *nativeStorage) SharedKV() storage.SharedKV {